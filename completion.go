@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// completionCommand, given as the first argument, prints a shell completion
+// script
+const completionCommand = "completion"
+
+// completionShells are the shells completion scripts can be printed for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completedCommand is a command as completion scripts see it. The command
+// with no name is run without a command, and takes every flag.
+type completedCommand struct {
+	name        string
+	description string
+	flags       []*flag.Flag
+	// args are the fixed set of arguments the command takes, if it has one
+	args []string
+}
+
+// completedCommands lists the commands, and the flags each takes
+func completedCommands() []completedCommand {
+	completed := []completedCommand{}
+	// without a command, every flag is taken
+	for _, command := range append(commands, commandInfo{}) {
+		var fs *flag.FlagSet
+		var args []string
+		switch command.name {
+		case controlCommand:
+			fs, _ = controlClientFlags()
+			args = controlCommands
+		case uploadCommand:
+			fs, _ = uploadFlags()
+		case completionCommand:
+			fs = flag.NewFlagSet(command.name, flag.ContinueOnError)
+			args = completionShells
+		default:
+			fs = flag.NewFlagSet(command.name, flag.ContinueOnError)
+			c := defaultConfig()
+			c.command = command.name
+			c.registerFlags(fs)
+		}
+
+		flags := []*flag.Flag{}
+		fs.VisitAll(func(f *flag.Flag) {
+			flags = append(flags, f)
+		})
+		completed = append(completed, completedCommand{
+			name:        command.name,
+			description: command.description,
+			flags:       flags,
+			args:        args,
+		})
+	}
+	return completed
+}
+
+// isBoolFlag checks if the flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// runCompletion prints the completion script for the shell named in args, and
+// returns the exit code
+func runCompletion(args []string, w io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: sync-github-ssh-keys %v %v\n", completionCommand, strings.Join(completionShells, "|"))
+		return 2
+	}
+
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(w, completedCommands())
+	case "zsh":
+		writeZshCompletion(w, completedCommands())
+	case "fish":
+		writeFishCompletion(w, completedCommands())
+	default:
+		fmt.Fprintf(os.Stderr, "sync-github-ssh-keys: unknown shell %q, expected one of %v\n", args[0], strings.Join(completionShells, ", "))
+		return 2
+	}
+	return 0
+}
+
+// writeBashCompletion writes a script for bash, to be sourced, e.g. from
+// /etc/bash_completion.d
+func writeBashCompletion(w io.Writer, commands []completedCommand) {
+	names := []string{}
+	for _, command := range commands {
+		if command.name != "" {
+			names = append(names, command.name)
+		}
+	}
+
+	fmt.Fprintln(w, "# bash completion for sync-github-ssh-keys")
+	fmt.Fprintln(w, "_sync_github_ssh_keys() {")
+	fmt.Fprintln(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} command=${COMP_WORDS[1]} words")
+	fmt.Fprintln(w, "\tif [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $command in")
+	for _, command := range commands {
+		flags := []string{}
+		for _, f := range command.flags {
+			flags = append(flags, "-"+f.Name)
+		}
+		pattern := command.name
+		if pattern == "" {
+			pattern = "*"
+		}
+		fmt.Fprintf(w, "\t%v)\n", pattern)
+		if len(command.args) != 0 && len(command.flags) != 0 {
+			fmt.Fprintf(w, "\t\t[[ $cur == -* ]] && words=%q || words=%q ;;\n", strings.Join(flags, " "), strings.Join(command.args, " "))
+		} else if len(command.args) != 0 {
+			fmt.Fprintf(w, "\t\twords=%q ;;\n", strings.Join(command.args, " "))
+		} else {
+			fmt.Fprintf(w, "\t\twords=%q ;;\n", strings.Join(flags, " "))
+		}
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _sync_github_ssh_keys sync-github-ssh-keys")
+}
+
+// writeZshCompletion writes a script for zsh, to be installed as
+// _sync-github-ssh-keys in a directory in $fpath
+func writeZshCompletion(w io.Writer, commands []completedCommand) {
+	fmt.Fprintln(w, "#compdef sync-github-ssh-keys")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "_sync_github_ssh_keys() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, command := range commands {
+		if command.name != "" {
+			fmt.Fprintf(w, "\t\t%v\n", zshQuote(command.name+":"+zshEscape(command.description)))
+		}
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then")
+	fmt.Fprintln(w, "\t\t_describe command commands")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	for _, command := range commands {
+		if command.name == "" {
+			fmt.Fprintln(w, "\t*)")
+		} else {
+			// the command itself isn't an argument to complete
+			fmt.Fprintf(w, "\t%v)\n\t\tshift words\n\t\t(( CURRENT-- ))\n", command.name)
+		}
+		fmt.Fprint(w, "\t\t_arguments")
+		for _, f := range command.flags {
+			spec := "-" + f.Name + "[" + zshEscape(f.Usage) + "]"
+			if !isBoolFlag(f) {
+				spec += ":" + f.Name + ":_files"
+			}
+			fmt.Fprintf(w, " \\\n\t\t\t%v", zshQuote(spec))
+		}
+		if len(command.args) != 0 {
+			fmt.Fprintf(w, " \\\n\t\t\t%v", zshQuote("1:argument:("+strings.Join(command.args, " ")+")"))
+		} else {
+			fmt.Fprintf(w, " \\\n\t\t\t%v", zshQuote("*:username:"))
+		}
+		fmt.Fprintln(w, " ;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "compdef _sync_github_ssh_keys sync-github-ssh-keys")
+}
+
+// zshEscape escapes the characters _arguments and _describe treat specially
+// in descriptions
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// zshQuote single quotes s
+func zshQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// writeFishCompletion writes a script for fish, to be installed as
+// sync-github-ssh-keys.fish in ~/.config/fish/completions
+func writeFishCompletion(w io.Writer, commands []completedCommand) {
+	names := []string{}
+	for _, command := range commands {
+		if command.name != "" {
+			names = append(names, command.name)
+		}
+	}
+
+	fmt.Fprintln(w, "# fish completion for sync-github-ssh-keys")
+	fmt.Fprintln(w, "complete -c sync-github-ssh-keys -f")
+	for _, command := range commands {
+		if command.name == "" {
+			continue
+		}
+		fmt.Fprintf(w, "complete -c sync-github-ssh-keys -n __fish_use_subcommand -a %v -d %v\n", command.name, fishQuote(command.description))
+	}
+	for _, command := range commands {
+		condition := "__fish_seen_subcommand_from " + command.name
+		if command.name == "" {
+			condition = "not __fish_seen_subcommand_from " + strings.Join(names, " ")
+		}
+		for _, f := range command.flags {
+			requires := " -rF"
+			if isBoolFlag(f) {
+				requires = ""
+			}
+			fmt.Fprintf(w, "complete -c sync-github-ssh-keys -n %v -o %v%v -d %v\n", fishQuote(condition), f.Name, requires, fishQuote(f.Usage))
+		}
+		if len(command.args) != 0 {
+			fmt.Fprintf(w, "complete -c sync-github-ssh-keys -n %v -a %v\n", fishQuote(condition), fishQuote(strings.Join(command.args, " ")))
+		}
+	}
+}
+
+// fishQuote single quotes s, in which fish only treats backslashes and single
+// quotes specially
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
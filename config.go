@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// config holds every option, as read from the config file, environment and
+// flags. Flags given on the command line take precedence over the
+// environment, which takes precedence over the config file.
+type config struct {
+	SyncInterval        time.Duration `yaml:"sync_interval"`
+	Schedule            string        `yaml:"schedule"`
+	MaxFetchInterval    time.Duration `yaml:"max_fetch_interval"`
+	SyncJitter          float64       `yaml:"sync_jitter"`
+	InitialDelay        time.Duration `yaml:"initial_delay"`
+	DisablePeriodicSync bool          `yaml:"disable_periodic_sync"`
+	ShutdownTimeout     time.Duration `yaml:"shutdown_timeout"`
+	AuthorizedKeysPath  string        `yaml:"authorized_keys_path"`
+	ExtraPaths          stringList    `yaml:"extra_authorized_keys_paths"`
+	SshdConfig          string        `yaml:"sshd_config"`
+	Inventory           string        `yaml:"inventory"`
+	PushConcurrency     int           `yaml:"push_concurrency"`
+	SSHUser             string        `yaml:"ssh_user"`
+	SSHIdentityFile     string        `yaml:"ssh_identity_file"`
+	SSHKnownHosts       string        `yaml:"ssh_known_hosts"`
+	GCPMetadata         string        `yaml:"gcp_metadata"`
+	GCPProject          string        `yaml:"gcp_project"`
+	GCPOSUser           string        `yaml:"gcp_os_user"`
+	GCPComputeURL       string        `yaml:"gcp_compute_url"`
+	KubeSecret          string        `yaml:"kubernetes_secret"`
+	KubeConfigMap       string        `yaml:"kubernetes_configmap"`
+	KubeKey             string        `yaml:"kubernetes_key"`
+	Kubeconfig          string        `yaml:"kubeconfig"`
+	KVTarget            string        `yaml:"kv_target"`
+	Create              bool          `yaml:"create"`
+	Owner               string        `yaml:"owner"`
+	Backups             int           `yaml:"backups"`
+	AuditFile           string        `yaml:"audit_file"`
+	GPGKeyring          string        `yaml:"gpg_keyring"`
+	AllowedSigners      string        `yaml:"allowed_signers"`
+	KnownHosts          string        `yaml:"known_hosts"`
+	PrincipalsPath      string        `yaml:"authorized_principals_path"`
+	CertDir             string        `yaml:"cert_dir"`
+	CertSigningKey      string        `yaml:"cert_signing_key_file"`
+	CertValidity        time.Duration `yaml:"cert_validity"`
+	EC2Instances        stringList    `yaml:"ec2_instance_ids"`
+	EC2OSUser           string        `yaml:"ec2_os_user"`
+	EC2Region           string        `yaml:"ec2_region"`
+	EC2ConnectURL       string        `yaml:"ec2_instance_connect_url"`
+	EventWebhookURL     string        `yaml:"event_webhook_url"`
+	EventSecret         string        `yaml:"event_webhook_secret"`
+	EventFailures       int           `yaml:"event_webhook_failures"`
+	SlackWebhookURL     string        `yaml:"slack_webhook_url"`
+	DiscordWebhookURL   string        `yaml:"discord_webhook_url"`
+	MatrixHomeserver    string        `yaml:"matrix_homeserver_url"`
+	MatrixRoom          string        `yaml:"matrix_room_id"`
+	MatrixToken         string        `yaml:"matrix_access_token"`
+	SMTPAddr            string        `yaml:"smtp_addr"`
+	SMTPUsername        string        `yaml:"smtp_username"`
+	SMTPPassword        string        `yaml:"smtp_password"`
+	EmailFrom           string        `yaml:"email_from"`
+	EmailTo             stringList    `yaml:"email_to"`
+	NotifyFailingAfter  time.Duration `yaml:"notify_failing_after"`
+	DegradedAfter       int           `yaml:"degraded_after"`
+	PagerURL            string        `yaml:"pager_url"`
+	PagerRoutingKey     string        `yaml:"pager_routing_key"`
+	MinKeys             int           `yaml:"min_keys"`
+	NoPrune             bool          `yaml:"no_prune"`
+	AllowEmpty          bool          `yaml:"allow_empty"`
+	FailPolicy          string        `yaml:"fail_policy"`
+	FailTTL             time.Duration `yaml:"fail_ttl"`
+	Exclusive           bool          `yaml:"exclusive"`
+	RemovalWindow       string        `yaml:"removal_window"`
+	KeyOptions          string        `yaml:"key_options"`
+	KeyTTL              time.Duration `yaml:"key_ttl"`
+	Marker              string        `yaml:"marker"`
+	PreviousMarkers     stringList    `yaml:"previous_markers"`
+	AllowedKeyTypes     stringList    `yaml:"allowed_key_types"`
+	MinRSABits          int           `yaml:"min_rsa_bits"`
+	AllowedFingerprints string        `yaml:"allowed_fingerprints"`
+	DeniedFingerprints  string        `yaml:"denied_fingerprints"`
+	Source              string        `yaml:"source"`
+	Usernames           []string      `yaml:"usernames"`
+	ExtraKeysFile       string        `yaml:"extra_keys_file"`
+	MirrorURLs          stringList    `yaml:"mirror_urls"`
+	PrintTimeout        time.Duration `yaml:"print_timeout"`
+	HTTPConnectTimeout  time.Duration `yaml:"http_connect_timeout"`
+	HTTPTimeout         time.Duration `yaml:"http_timeout"`
+	HTTPRetries         int           `yaml:"http_retries"`
+	HTTPRetryBackoff    time.Duration `yaml:"http_retry_backoff"`
+	FetchConcurrency    int           `yaml:"fetch_concurrency"`
+	Proxy               string        `yaml:"proxy"`
+	CAFile              string        `yaml:"ca_file"`
+	PinnedSPKI          stringList    `yaml:"pinned_spki"`
+	TLSClientCert       string        `yaml:"tls_client_cert"`
+	TLSClientKey        string        `yaml:"tls_client_key"`
+	CacheDir            string        `yaml:"cache_dir"`
+	MetricsAddr         string        `yaml:"metrics_addr"`
+	TextfilePath        string        `yaml:"textfile_path"`
+	StatsdAddr          string        `yaml:"statsd_addr"`
+	HealthAddr          string        `yaml:"health_addr"`
+	HealthMaxAge        time.Duration `yaml:"health_max_age"`
+	WebhookAddr         string        `yaml:"webhook_addr"`
+	ControlSocket       string        `yaml:"control_socket"`
+	PauseFile           string        `yaml:"pause_file"`
+	PIDFile             string        `yaml:"pid_file"`
+	UserMap             string        `yaml:"user_map"`
+	LogFormat           string        `yaml:"log_format"`
+	LogLevel            string        `yaml:"log_level"`
+	LogDest             string        `yaml:"log_dest"`
+	LogFile             string        `yaml:"log_file"`
+	Debug               bool          `yaml:"debug"`
+	// Users maps local users to the usernames to sync keys for, in the
+	// same way as the user map file
+	Users map[string][]string `yaml:"users"`
+	// UserKeyOptions overrides KeyOptions for the keys of specific usernames
+	UserKeyOptions map[string]string `yaml:"user_key_options"`
+
+	Github struct {
+		BaseURL string `yaml:"base_url"`
+		API     bool   `yaml:"api"`
+		GraphQL bool   `yaml:"graphql"`
+		Token   string `yaml:"token"`
+		Org     string `yaml:"org"`
+		Team    string `yaml:"team"`
+		// TokenFile is read for Token, which then needn't be in the
+		// environment
+		TokenFile string `yaml:"token_file"`
+		// AppID, AppKeyFile and InstallationID authenticate as an
+		// installation of a GitHub App, rather than with Token
+		AppID          int64  `yaml:"app_id"`
+		AppKeyFile     string `yaml:"app_private_key_file"`
+		InstallationID int64  `yaml:"app_installation_id"`
+		// WebhookSecret is the secret webhooks sent to WebhookAddr are
+		// signed with
+		WebhookSecret string `yaml:"webhook_secret"`
+	} `yaml:"github"`
+	Gitlab struct {
+		BaseURL string `yaml:"base_url"`
+	} `yaml:"gitlab"`
+	Gitea struct {
+		BaseURL   string `yaml:"base_url"`
+		Token     string `yaml:"token"`
+		TokenFile string `yaml:"token_file"`
+	} `yaml:"gitea"`
+	URL struct {
+		SigningKey string `yaml:"signing_key"`
+	} `yaml:"url"`
+
+	// options that only make sense on the command line
+	command    string
+	configPath string
+	printKeys  bool
+	dryRun     bool
+	statusJSON bool
+	version    bool
+}
+
+func defaultConfig() *config {
+	home, _ := os.UserHomeDir()
+	c := &config{
+		SyncInterval:       time.Minute,
+		ShutdownTimeout:    30 * time.Second,
+		AuthorizedKeysPath: filepath.Join(home, ".ssh", "authorized_keys"),
+		Create:             true,
+		Source:             sourceGithub,
+		PrintTimeout:       5 * time.Second,
+		HTTPConnectTimeout: 10 * time.Second,
+		HTTPTimeout:        30 * time.Second,
+		HTTPRetries:        3,
+		HTTPRetryBackoff:   time.Second,
+		FetchConcurrency:   8,
+		CacheDir:           "/var/cache/sync-github-ssh-keys",
+		PauseFile:          "/etc/sync-github-ssh-keys/pause",
+		DegradedAfter:      5,
+		FailPolicy:         failOpen,
+		FailTTL:            24 * time.Hour,
+		PagerURL:           keysync.DefaultPagerURL,
+		EventFailures:      3,
+		CertValidity:       24 * time.Hour,
+		PushConcurrency:    8,
+		EC2OSUser:          "ec2-user",
+		KubeKey:            "authorized_keys",
+		Marker:             keysync.DefaultMarker,
+		LogFormat:          logFormatText,
+		LogLevel:           "info",
+		LogDest:            logDestStderr,
+	}
+	c.Github.BaseURL = keysync.DefaultGithubBaseURL
+	c.Github.API = os.Getenv("GITHUB_TOKEN") != ""
+	c.Github.Token = os.Getenv("GITHUB_TOKEN")
+	c.Github.WebhookSecret = os.Getenv("GITHUB_WEBHOOK_SECRET")
+	c.Gitlab.BaseURL = keysync.DefaultGitlabBaseURL
+	c.Gitea.BaseURL = keysync.DefaultGiteaBaseURL
+	c.Gitea.Token = os.Getenv("GITEA_TOKEN")
+	c.EventSecret = os.Getenv("EVENT_WEBHOOK_SECRET")
+	c.MatrixToken = os.Getenv("MATRIX_ACCESS_TOKEN")
+	c.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	c.PagerRoutingKey = os.Getenv("PAGER_ROUTING_KEY")
+	return c
+}
+
+// registerFlags binds the flags of the command to the config, using its
+// current values as the defaults
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	c.registerCommonFlags(fs)
+	if c.command != commandRemove && c.command != commandStatus {
+		c.registerFetchFlags(fs)
+	}
+	switch c.command {
+	case commandDaemon:
+		c.registerFileFlags(fs)
+		c.registerSyncFlags(fs)
+		c.registerDaemonFlags(fs)
+	case commandSync:
+		c.registerFileFlags(fs)
+		c.registerSyncFlags(fs)
+		fs.BoolVar(&c.dryRun, "dry-run", c.dryRun, "print a diff of the changes that would be made to the authorized_keys file rather than making them")
+	case commandCheck:
+		c.registerFileFlags(fs)
+	case commandPrint:
+		c.registerPrintFlags(fs)
+	case commandRemove, commandRepair:
+		c.registerTargetFlags(fs)
+	case commandStatus:
+		c.registerTargetFlags(fs)
+		c.registerCacheFlags(fs)
+		fs.BoolVar(&c.statusJSON, "json", c.statusJSON, "print the keys as JSON")
+	case "":
+		// without a command, every flag is accepted, along with the flags
+		// that used to select the mode
+		c.registerFileFlags(fs)
+		c.registerSyncFlags(fs)
+		c.registerDaemonFlags(fs)
+		c.registerPrintFlags(fs)
+		fs.BoolVar(&c.DisablePeriodicSync, "disable-periodic-sync", c.DisablePeriodicSync, "sync just once then exit; the same as the sync command")
+		fs.BoolVar(&c.printKeys, "print", c.printKeys, "print the keys to stdout rather than syncing them; the same as the print command")
+		fs.BoolVar(&c.dryRun, "dry-run", c.dryRun, "sync once, printing a diff of the changes that would be made rather than making them; the same as sync -dry-run")
+	}
+}
+
+// registerCommonFlags binds the flags for finding synced keys and logging,
+// which every command takes
+func (c *config) registerCommonFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.version, "version", c.version, "print the version and exit")
+	fs.StringVar(&c.configPath, "config", "", "yaml config file, or toml if it ends in .toml, to read options from; flags take precedence over it")
+	fs.StringVar(&c.Marker, "marker", c.Marker, "marker starting the comment of synced keys")
+	fs.Var(&c.PreviousMarkers, "previous-markers", "comma separated markers that synced keys were previously marked with, to remark them with -marker")
+	fs.StringVar(&c.UserMap, "user-map", c.UserMap, "file mapping local users to the usernames to sync keys for, to sync every local user's authorized_keys when running as root")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format to log in, text or json")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of messages to log, one of debug, info, warn or error")
+	fs.StringVar(&c.LogDest, "log-dest", c.LogDest, "where to log to, one of stderr, file, syslog or journald")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "file to append logs to, with -log-dest file")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "log routine events, such as syncs that didn't change anything; the same as -log-level debug")
+}
+
+// registerFetchFlags binds the flags for fetching keys and choosing which to
+// sync
+func (c *config) registerFetchFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Source, "source", c.Source, "where to fetch keys from, one of github, gitlab, gitea, url, kv, or exec:<command> to run a command with the username as its last argument; usernames qualified with another source, e.g. gitlab:alice, are fetched from it")
+	fs.StringVar(&c.Github.BaseURL, "github-base-url", c.Github.BaseURL, "base url of the github instance to fetch keys from, e.g. https://ghe.example.com for GitHub Enterprise")
+	fs.BoolVar(&c.Github.API, "github-api", c.Github.API, "fetch keys from the github API rather than the .keys endpoint (defaults to true if GITHUB_TOKEN is set)")
+	fs.StringVar(&c.Gitlab.BaseURL, "gitlab-base-url", c.Gitlab.BaseURL, "base url of the gitlab instance to fetch keys from, when -source is gitlab or for gitlab: usernames")
+	fs.StringVar(&c.Gitea.BaseURL, "gitea-base-url", c.Gitea.BaseURL, "base url of the gitea or forgejo instance to fetch keys from, when -source is gitea or for gitea: usernames")
+	fs.StringVar(&c.Gitea.TokenFile, "gitea-token-file", c.Gitea.TokenFile, "file to read the gitea token from rather than GITEA_TOKEN, or fd:<n> to read it from an inherited file descriptor")
+	fs.Var(&c.MirrorURLs, "mirror-urls", "comma separated base urls of mirrors of -source, e.g. an internal caching mirror, to fetch keys from in order before falling back to the next, and lastly to the source's own base url")
+	fs.StringVar(&c.URL.SigningKey, "url-signing-key", c.URL.SigningKey, "ssh-ed25519 public key that documents fetched by the url source must be signed with")
+	fs.StringVar(&c.Github.Org, "org", c.Github.Org, "sync keys for all members of this github organisation (requires GITHUB_TOKEN)")
+	fs.StringVar(&c.Github.Team, "team", c.Github.Team, "only sync keys for members of this team within -org")
+	fs.StringVar(&c.Github.TokenFile, "github-token-file", c.Github.TokenFile, "file to read the github token from rather than GITHUB_TOKEN, or fd:<n> to read it from an inherited file descriptor")
+	fs.Int64Var(&c.Github.AppID, "github-app-id", c.Github.AppID, "authenticate to github as an installation of this GitHub App, rather than with GITHUB_TOKEN")
+	fs.StringVar(&c.Github.AppKeyFile, "github-app-private-key-file", c.Github.AppKeyFile, "PEM encoded private key of -github-app-id")
+	fs.Int64Var(&c.Github.InstallationID, "github-app-installation-id", c.Github.InstallationID, "installation of -github-app-id to authenticate as; defaults to its installation on -org")
+	fs.BoolVar(&c.Github.GraphQL, "github-graphql", c.Github.GraphQL, "list the members of -org with the github GraphQL API, fetching their keys in the same requests rather than one request per member")
+	fs.StringVar(&c.ExtraKeysFile, "extra-keys-file", c.ExtraKeysFile, "file of keys in authorized_keys format, e.g. break-glass keys, to always sync along with the users' keys; they're removed again once removed from the file")
+	fs.StringVar(&c.KeyOptions, "key-options", c.KeyOptions, `options to prepend to every synced key, e.g. from="10.0.0.0/8",no-agent-forwarding`)
+	fs.DurationVar(&c.KeyTTL, "key-ttl", c.KeyTTL, "add an expiry-time option to synced keys this far in the future, so they expire if they stop being synced")
+	fs.Var(&c.AllowedKeyTypes, "allowed-key-types", "comma separated key types to sync, e.g. ed25519,ecdsa, rejecting any others; any type is synced if unset")
+	fs.IntVar(&c.MinRSABits, "min-rsa-bits", c.MinRSABits, "reject rsa keys shorter than this many bits")
+	fs.StringVar(&c.AllowedFingerprints, "allowed-fingerprints", c.AllowedFingerprints, "file listing the SHA256 fingerprints of the only keys that may be synced")
+	fs.StringVar(&c.DeniedFingerprints, "denied-fingerprints", c.DeniedFingerprints, "file listing the SHA256 fingerprints, or public keys, of keys that must never be in the authorized_keys file, removing them even if they were added by hand")
+	fs.DurationVar(&c.HTTPConnectTimeout, "http-connect-timeout", c.HTTPConnectTimeout, "how long to wait to connect to key sources")
+	fs.DurationVar(&c.HTTPTimeout, "http-timeout", c.HTTPTimeout, "how long to wait for each attempt at a request to key sources to complete")
+	fs.IntVar(&c.HTTPRetries, "http-retries", c.HTTPRetries, "how many times to retry requests to key sources that fail with network or server errors")
+	fs.DurationVar(&c.HTTPRetryBackoff, "http-retry-backoff", c.HTTPRetryBackoff, "how long to wait before the first retry, doubling for each further retry")
+	fs.IntVar(&c.FetchConcurrency, "fetch-concurrency", c.FetchConcurrency, "how many users' keys to fetch at once")
+	fs.StringVar(&c.Proxy, "proxy", c.Proxy, "proxy to fetch keys through, e.g. http://proxy:3128 or socks5://localhost:1080; defaults to HTTPS_PROXY")
+	fs.StringVar(&c.CAFile, "ca-file", c.CAFile, "file of PEM encoded CA certificates to trust when fetching keys, in addition to the system's")
+	fs.Var(&c.PinnedSPKI, "pinned-spki", "comma separated base64 SHA256 hashes of public keys, one of which must be in the certificate chain of servers keys are fetched from")
+	fs.StringVar(&c.TLSClientCert, "tls-client-cert", c.TLSClientCert, "PEM encoded certificate to authenticate to key sources with; requires -tls-client-key")
+	fs.StringVar(&c.TLSClientKey, "tls-client-key", c.TLSClientKey, "PEM encoded private key for -tls-client-cert")
+	c.registerCacheFlags(fs)
+}
+
+// registerCacheFlags binds the flags for caching fetched keys
+func (c *config) registerCacheFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.CacheDir, "cache-dir", c.CacheDir, "directory to cache the last fetched keys in, to fall back to when they can't be fetched; empty to only cache keys when printing them")
+}
+
+// registerTargetFlags binds the flags for the authorized_keys files to change
+func (c *config) registerTargetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.AuthorizedKeysPath, "authorized-keys-path", c.AuthorizedKeysPath, "authorized_keys file to write keys into, in which %h, %u and %U are replaced with the home directory, name and uid of -owner or the user running, as in sshd's AuthorizedKeysFile; with a user map, it's expanded for each local user if it has any")
+	fs.Var(&c.ExtraPaths, "extra-authorized-keys-paths", "comma separated authorized_keys files to write the same keys into, for sshd configs that read other locations; tokens are replaced as in -authorized-keys-path")
+	fs.StringVar(&c.SshdConfig, "sshd-config", c.SshdConfig, "sshd_config to find the AuthorizedKeysFile of -owner, or the user running, in, e.g. /etc/ssh/sshd_config, rather than using -authorized-keys-path; with a user map, it's found for each local user")
+	fs.BoolVar(&c.Create, "create", c.Create, "create the authorized_keys file and its directory if they don't exist")
+	fs.StringVar(&c.Inventory, "inventory", c.Inventory, "file listing hosts, as [user@]host[:port] [path] on each line, to push keys to over ssh rather than writing a local authorized_keys file; path defaults to "+defaultRemotePath)
+	fs.IntVar(&c.PushConcurrency, "push-concurrency", c.PushConcurrency, "how many hosts in the inventory to push keys to at once")
+	fs.StringVar(&c.SSHUser, "ssh-user", c.SSHUser, "user to log in to hosts in the inventory as, unless given for the host; defaults to the user running")
+	fs.StringVar(&c.SSHIdentityFile, "ssh-identity-file", c.SSHIdentityFile, "unencrypted private key to log in to hosts in the inventory with; defaults to the keys in the ssh agent")
+	fs.StringVar(&c.SSHKnownHosts, "ssh-known-hosts", c.SSHKnownHosts, "known_hosts file to check the host keys of hosts in the inventory against; defaults to ~/.ssh/known_hosts")
+	fs.StringVar(&c.GCPMetadata, "gcp-metadata", c.GCPMetadata, "sync keys into the ssh-keys metadata of the GCP project, given as project, or of an instance, given as <zone>/<instance>, rather than a local authorized_keys file")
+	fs.StringVar(&c.GCPProject, "gcp-project", c.GCPProject, "GCP project of -gcp-metadata; defaults to the project of GOOGLE_APPLICATION_CREDENTIALS, or of the instance running")
+	fs.StringVar(&c.GCPOSUser, "gcp-os-user", c.GCPOSUser, "user on the GCP instances that keys synced into -gcp-metadata let the users log in as")
+	fs.StringVar(&c.GCPComputeURL, "gcp-compute-url", c.GCPComputeURL, "base url of the GCP compute API, e.g. a private endpoint; defaults to "+keysync.DefaultGCPComputeURL)
+	fs.StringVar(&c.KubeSecret, "kubernetes-secret", c.KubeSecret, "kubernetes Secret, as [namespace/]name, to write the keys into the -kubernetes-key of rather than a local authorized_keys file, for pods that run sshd to mount")
+	fs.StringVar(&c.KubeConfigMap, "kubernetes-configmap", c.KubeConfigMap, "kubernetes ConfigMap, as [namespace/]name, to write the keys into the -kubernetes-key of rather than a local authorized_keys file, for pods that run sshd to mount")
+	fs.StringVar(&c.KubeKey, "kubernetes-key", c.KubeKey, "key of -kubernetes-secret or -kubernetes-configmap to write the keys into")
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "kubeconfig file to authenticate to kubernetes with; defaults to KUBECONFIG, the pod's service account when running in a cluster, or ~/.kube/config")
+	fs.StringVar(&c.KVTarget, "kv-target", c.KVTarget, "url of an etcd or consul key, e.g. consul://consul.example.com:8500/ssh/authorized_keys, to publish the keys to rather than a local authorized_keys file, for a fleet to consume with -source kv")
+	fs.StringVar(&c.Owner, "owner", c.Owner, "local user that should own the authorized_keys file; when running as root, defaults to the owner of its directory")
+	fs.IntVar(&c.Backups, "backups", c.Backups, "copy the authorized_keys file to authorized_keys.bak.<timestamp> before changing it, keeping this many backups")
+	fs.StringVar(&c.AuditFile, "audit-file", c.AuditFile, "file to append a JSON line to for every key added or removed, with its fingerprint, user, source and time, for access reviews")
+	fs.StringVar(&c.EventWebhookURL, "event-webhook-url", c.EventWebhookURL, "url to POST a JSON event to whenever keys change, and when syncs fail repeatedly, signed with EVENT_WEBHOOK_SECRET, e.g. for a SIEM")
+	fs.IntVar(&c.EventFailures, "event-webhook-failures", c.EventFailures, "how many syncs in a row must fail before an event is sent for them; 0 to not send events for failures")
+	c.registerNotifyFlags(fs)
+}
+
+// registerNotifyFlags binds the flags for posting key changes to chat
+// channels
+func (c *config) registerNotifyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.SlackWebhookURL, "slack-webhook-url", c.SlackWebhookURL, "slack incoming webhook to post a message to whenever keys change")
+	fs.StringVar(&c.DiscordWebhookURL, "discord-webhook-url", c.DiscordWebhookURL, "discord webhook to post a message to whenever keys change")
+	fs.StringVar(&c.MatrixHomeserver, "matrix-homeserver-url", c.MatrixHomeserver, "matrix homeserver to send a message to -matrix-room-id through whenever keys change, e.g. https://matrix.example.com (requires MATRIX_ACCESS_TOKEN)")
+	fs.StringVar(&c.MatrixRoom, "matrix-room-id", c.MatrixRoom, "matrix room to send messages to, e.g. !abcdefg:example.com")
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", c.SMTPAddr, "smtp server to email -email-to through whenever keys change, e.g. smtp.example.com:587")
+	fs.StringVar(&c.SMTPUsername, "smtp-username", c.SMTPUsername, "user to authenticate with the smtp server as, with the password in SMTP_PASSWORD")
+	fs.StringVar(&c.EmailFrom, "email-from", c.EmailFrom, "address to send emails from")
+	fs.Var(&c.EmailTo, "email-to", "comma separated addresses to email")
+	fs.DurationVar(&c.NotifyFailingAfter, "notify-failing-after", c.NotifyFailingAfter, "also notify once syncs have been failing for this long, and when they succeed again; unset to only notify of key changes")
+}
+
+// registerFileFlags binds the flags for syncing keys into authorized_keys
+// files
+func (c *config) registerFileFlags(fs *flag.FlagSet) {
+	c.registerTargetFlags(fs)
+	fs.IntVar(&c.MinKeys, "min-keys", c.MinKeys, "abort the sync rather than leave fewer than this many keys in the authorized_keys file")
+	fs.BoolVar(&c.NoPrune, "no-prune", c.NoPrune, "only add keys, never removing previously synced keys")
+	fs.BoolVar(&c.AllowEmpty, "allow-empty", c.AllowEmpty, "remove the synced keys of users the source returns no keys for, rather than keeping them in case their account has a problem")
+	fs.StringVar(&c.FailPolicy, "fail-policy", c.FailPolicy, "what to do with the synced keys of users whose keys couldn't be fetched for longer than -fail-ttl, e.g. as the source is unreachable: open to keep them, or closed to remove them")
+	fs.DurationVar(&c.FailTTL, "fail-ttl", c.FailTTL, "how long users' keys can go without being fetched before -fail-policy applies")
+	fs.BoolVar(&c.Exclusive, "exclusive", c.Exclusive, "remove every key that isn't synced, including keys added by hand")
+	fs.StringVar(&c.RemovalWindow, "removal-window", c.RemovalWindow, `cron expression matching the minutes keys may be removed in, e.g. "* 9-16 * * 1-5" for weekday working hours; keys are added at any time`)
+}
+
+// registerSyncFlags binds the flags for syncs that change authorized_keys
+// files
+func (c *config) registerSyncFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.PauseFile, "pause-file", c.PauseFile, "skip syncs while this file exists, e.g. to freeze keys during an incident; its contents are logged as the reason")
+	fs.StringVar(&c.PrincipalsPath, "authorized-principals-path", c.PrincipalsPath, "sshd AuthorizedPrincipalsFile to keep the users' github usernames in as principals, for hosts that trust certificates signed by a CA; no authorized_keys files are synced when this is set")
+	fs.StringVar(&c.CertDir, "cert-dir", c.CertDir, "directory to write a certificate for each of the users' keys to, as <username>/<fingerprint>-cert.pub, signed by -cert-signing-key-file with the username as its principal")
+	fs.StringVar(&c.CertSigningKey, "cert-signing-key-file", c.CertSigningKey, "unencrypted private key of the CA to sign certificates with")
+	fs.DurationVar(&c.CertValidity, "cert-validity", c.CertValidity, "how long certificates are valid for; they're reissued once half of it has passed")
+	fs.Var(&c.EC2Instances, "ec2-instance-ids", "comma separated EC2 instances to push keys to with EC2 Instance Connect, letting the users log in for 60 seconds, rather than writing them into authorized_keys files")
+	fs.StringVar(&c.EC2OSUser, "ec2-os-user", c.EC2OSUser, "user on -ec2-instance-ids that pushed keys let the users log in as")
+	fs.StringVar(&c.EC2Region, "ec2-region", c.EC2Region, "region of -ec2-instance-ids; defaults to AWS_REGION, or the region of the instance running")
+	fs.StringVar(&c.EC2ConnectURL, "ec2-instance-connect-url", c.EC2ConnectURL, "EC2 Instance Connect endpoint to push keys through, e.g. a VPC endpoint; defaults to the region's public one")
+	fs.StringVar(&c.GPGKeyring, "gpg-keyring", c.GPGKeyring, "GnuPG keyring file to keep in sync with the gpg keys the users have published on github, e.g. to verify their signed commits; it's rebuilt on each sync, so shouldn't hold any other keys")
+	fs.StringVar(&c.AllowedSigners, "allowed-signers", c.AllowedSigners, "git allowed_signers file to keep in sync with the ssh signing keys the users have registered on github, for git verify-commit; other signers in it are left as they are")
+	fs.StringVar(&c.KnownHosts, "known-hosts", c.KnownHosts, "known_hosts file to keep github's ssh host keys up to date in, as published by its meta API, so its host key rotations are picked up; other hosts in it are left as they are")
+	fs.StringVar(&c.PIDFile, "pid-file", c.PIDFile, "file to write the pid to while syncing, refusing to sync if another process holds it; defaults to the authorized_keys file's path with .pid appended")
+	c.registerReportFlags(fs)
+}
+
+// registerReportFlags binds the flags for reporting the outcome of syncs
+func (c *config) registerReportFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.TextfilePath, "textfile-path", c.TextfilePath, "file to write prometheus metrics to after each sync, for node_exporter's textfile collector; it must end in .prom")
+	fs.StringVar(&c.StatsdAddr, "statsd-addr", c.StatsdAddr, "statsd server to send metrics to over udp, e.g. localhost:8125")
+	fs.IntVar(&c.DegradedAfter, "degraded-after", c.DegradedAfter, "consider syncing degraded once this many syncs in a row have failed, notifying and paging if PAGER_ROUTING_KEY is set; 0 to never")
+	fs.StringVar(&c.PagerURL, "pager-url", c.PagerURL, "Events API v2 endpoint to page through when syncing is degraded")
+}
+
+// registerDaemonFlags binds the flags for syncing periodically
+func (c *config) registerDaemonFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.SyncInterval, "sync-interval", c.SyncInterval, "interval to sync keys at")
+	fs.DurationVar(&c.MaxFetchInterval, "max-fetch-interval", c.MaxFetchInterval, "fetch the keys of users whose keys haven't changed less often, backing off up to this long between fetches; unset to fetch every user on every sync")
+	fs.StringVar(&c.Schedule, "schedule", c.Schedule, `cron expression to sync keys on instead of every -sync-interval, e.g. "*/5 * * * *"`)
+	fs.Float64Var(&c.SyncJitter, "sync-jitter", c.SyncJitter, "randomly vary the sync interval by up to this fraction of it, e.g. 0.1 for ±10%")
+	fs.DurationVar(&c.InitialDelay, "initial-delay", c.InitialDelay, "wait a random duration up to this long before the first periodic sync")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for an in-flight sync to finish on SIGTERM or SIGINT before exiting anyway")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address to serve prometheus metrics on at /metrics, e.g. :9100; unset to not serve them")
+	fs.StringVar(&c.HealthAddr, "health-addr", c.HealthAddr, "address to serve a health check on at /healthz, e.g. :8080; unset to not serve it")
+	fs.DurationVar(&c.HealthMaxAge, "health-max-age", c.HealthMaxAge, "how recently the last sync must have succeeded for /healthz to report healthy; defaults to three sync intervals")
+	fs.StringVar(&c.WebhookAddr, "webhook-addr", c.WebhookAddr, "address to receive github organization webhooks on at /webhook, syncing as soon as members change (requires GITHUB_WEBHOOK_SECRET)")
+	fs.StringVar(&c.ControlSocket, "control-socket", c.ControlSocket, "unix socket to accept commands from the ctl subcommand on, e.g. "+defaultControlSocket)
+}
+
+// registerPrintFlags binds the flags for printing keys
+func (c *config) registerPrintFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.PrintTimeout, "print-timeout", c.PrintTimeout, "how long to wait for keys to be fetched before falling back to the cache")
+}
+
+// stringList is a list flag, set from a comma separated string
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envPrefix is prepended to the upper cased flag names to give the
+// environment variables options can be set with, e.g. SGSK_SYNC_INTERVAL
+const envPrefix = "SGSK_"
+
+// usernamesEnvVars can be set to a space or comma separated list of usernames
+var usernamesEnvVars = []string{"SGSK_USERNAMES", "SGSK_GITHUB_USERNAME"}
+
+// the commands, given as the first argument
+const (
+	commandDaemon = "daemon"
+	commandSync   = "sync"
+	commandPrint  = "print"
+	commandCheck  = "check"
+	commandRemove = "remove"
+	commandStatus = "status"
+	commandRepair = "repair"
+)
+
+// the -fail-policy values
+const (
+	failOpen   = "open"
+	failClosed = "closed"
+)
+
+// instanceConnectPushTime is how long pushing keys with EC2 Instance Connect is
+// allowed to take, which syncs must leave room for before the keys pushed by
+// the last one expire
+const instanceConnectPushTime = 10 * time.Second
+
+// gcpMetadataProject is the -gcp-metadata value that syncs the project's
+// metadata, rather than an instance's
+const gcpMetadataProject = "project"
+
+// commandInfo describes a command for its usage
+type commandInfo struct {
+	name        string
+	description string
+}
+
+// commands describes each command, in the order they're listed in the usage
+var commands = []commandInfo{
+	{commandDaemon, "sync keys every -sync-interval or on a -schedule (the default without a command)"},
+	{commandSync, "sync keys once, then exit"},
+	{commandPrint, "print the keys to stdout, for use as sshd's AuthorizedKeysCommand"},
+	{commandCheck, "exit 2 if the authorized_keys files are out of date, without changing them"},
+	{commandRemove, "remove synced keys, or only those of the usernames given"},
+	{commandStatus, "list the synced keys, and when they were last fetched"},
+	{commandRepair, "remove duplicate keys and the synced keys of users no longer synced, and normalize whitespace"},
+	{uploadCommand, "add a public key to the github account of GITHUB_TOKEN, or as a deploy key of a -repo"},
+	{controlCommand, "send a command to a running daemon's -control-socket"},
+	{completionCommand, "print a bash, zsh or fish completion script"},
+}
+
+// isCommand checks if the argument names a command parsed by parseConfig
+func isCommand(arg string) bool {
+	if arg == controlCommand || arg == completionCommand || arg == uploadCommand {
+		return false
+	}
+	for _, command := range commands {
+		if command.name == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConfig parses the command line, reading the config file if one is
+// given. Options are taken from the flags first, then the environment, then
+// the config file.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	c := defaultConfig()
+	if len(args) != 0 && isCommand(args[0]) {
+		c.command = args[0]
+		args = args[1:]
+	}
+	c.registerFlags(fs)
+	fs.Usage = func() {
+		c.usage(fs)
+	}
+	err := c.applyEnv(fs)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.configPath != "" {
+		contents, err := ioutil.ReadFile(c.configPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read config file")
+		}
+		isTOML := strings.EqualFold(filepath.Ext(c.configPath), ".toml")
+		if isTOML {
+			contents, err = tomlToYAML(contents)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse config file %v", c.configPath)
+			}
+		}
+		err = yaml.UnmarshalStrict(contents, c)
+		if typeErr, ok := err.(*yaml.TypeError); ok && isTOML {
+			// the lines are those of the converted yaml, not the toml file
+			for i, message := range typeErr.Errors {
+				typeErr.Errors[i] = yamlLineRe.ReplaceAllString(message, "")
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse config file %v", c.configPath)
+		}
+		err = c.applyEnv(fs)
+		if err != nil {
+			return nil, err
+		}
+		err = fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.NArg() != 0 {
+		c.Usernames = fs.Args()
+	}
+
+	if c.version {
+		return c, nil
+	}
+
+	err = c.loadSecrets(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	// before commands, the mode was chosen with flags
+	if c.command == "" {
+		switch {
+		case c.printKeys:
+			c.command = commandPrint
+		case c.dryRun, c.DisablePeriodicSync:
+			c.command = commandSync
+		default:
+			c.command = commandDaemon
+		}
+	}
+
+	return c, c.validate()
+}
+
+// yamlLineRe matches the line number yaml errors start with
+var yamlLineRe = regexp.MustCompile(`^line \d+: `)
+
+// tomlToYAML converts a toml config file to yaml, so it's decoded, and its
+// unknown options rejected, just as a yaml one is. Tables become maps, so
+// e.g. [user_key_options] sets user_key_options.
+func tomlToYAML(contents []byte) ([]byte, error) {
+	values := map[string]interface{}{}
+	_, err := toml.Decode(string(contents), &values)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(values)
+}
+
+// loadSecrets reads the API tokens from their files, or from the systemd
+// credentials named github_token and gitea_token, so they needn't be in the
+// environment, where they'd be visible in /proc/<pid>/environ
+func (c *config) loadSecrets(fs *flag.FlagSet) error {
+	secrets := []struct {
+		value      *string
+		file       string
+		credential string
+		// api is set if there's a token, unless its flag was given
+		api     *bool
+		apiFlag string
+	}{
+		{&c.Github.Token, c.Github.TokenFile, "github_token", &c.Github.API, "github-api"},
+		{&c.Gitea.Token, c.Gitea.TokenFile, "gitea_token", nil, ""},
+	}
+	for _, secret := range secrets {
+		var value string
+		var err error
+		if secret.file != "" {
+			value, err = readSecretFile(secret.file)
+		} else {
+			value, err = systemdCredential(secret.credential)
+		}
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			continue
+		}
+		*secret.value = value
+		if secret.api != nil && !flagSet(fs, secret.apiFlag) {
+			*secret.api = true
+		}
+	}
+	return nil
+}
+
+// readSecretFile reads a secret from the file, or from an inherited file
+// descriptor given as fd:<n>
+func readSecretFile(path string) (string, error) {
+	var contents []byte
+	if strings.HasPrefix(path, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(path, "fd:"))
+		if err != nil || fd < 0 {
+			return "", errors.Errorf("invalid file descriptor %q", path)
+		}
+		file := os.NewFile(uintptr(fd), path)
+		defer file.Close()
+		contents, err = ioutil.ReadAll(file)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not read secret from %v", path)
+		}
+	} else {
+		var err error
+		contents, err = ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrap(err, "could not read secret")
+		}
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// flagSet checks if the flag was given, on the command line or in the
+// environment
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// usage prints how to use the command, and its flags
+func (c *config) usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	if c.command != "" {
+		fmt.Fprintf(w, "usage: sync-github-ssh-keys %v [flags] <username>...\n\nflags:\n", c.command)
+		fs.PrintDefaults()
+		return
+	}
+
+	fmt.Fprintf(w, "usage: sync-github-ssh-keys [command] [flags] <username>...\n\ncommands:\n")
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %-8v %v\n", command.name, command.description)
+	}
+	fmt.Fprintf(w, "\nrun sync-github-ssh-keys <command> -h for the flags each command takes\n")
+}
+
+// envVarName returns the environment variable that sets the flag
+func envVarName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnv sets the options given in the environment
+func (c *config) applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envVarName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = errors.Wrapf(setErr, "invalid value for %v", envVarName(f.Name))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range usernamesEnvVars {
+		if value := os.Getenv(name); value != "" {
+			c.Usernames = strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			})
+		}
+	}
+	return nil
+}
+
+func (c *config) validate() error {
+	usesUserMap := c.UserMap != "" || len(c.Users) != 0
+	// remove takes the usernames to remove keys for, if any, and status
+	// only reads the file
+	needsUsernames := c.command != commandRemove && c.command != commandStatus
+	if len(c.Usernames) == 0 && c.Github.Org == "" && !usesUserMap && c.ExtraKeysFile == "" && needsUsernames {
+		return errors.New("one or more usernames are required, or -org, -user-map or -extra-keys-file")
+	}
+	if c.SyncInterval <= 0 && c.command == commandDaemon {
+		return errors.New("sync interval must be positive")
+	}
+	schedule, err := c.schedule()
+	if err != nil {
+		return err
+	}
+	if schedule != nil && schedule.Next(time.Now()).IsZero() {
+		return errors.Errorf("schedule %q never runs", c.Schedule)
+	}
+	if schedule != nil && (c.SyncJitter != 0 || c.InitialDelay != 0) {
+		return errors.New("-schedule can not be used with -sync-jitter or -initial-delay")
+	}
+	if c.MinKeys < 0 {
+		return errors.New("min keys can not be negative")
+	}
+	if c.Backups < 0 {
+		return errors.New("backups can not be negative")
+	}
+	if c.EventFailures < 0 {
+		return errors.New("event webhook failures can not be negative")
+	}
+	if c.NoPrune && c.Exclusive {
+		return errors.New("-no-prune can not be used with -exclusive")
+	}
+	if c.RemovalWindow != "" {
+		window, err := cron.ParseStandard(c.RemovalWindow)
+		if err != nil {
+			return errors.Wrapf(err, "invalid removal window %q", c.RemovalWindow)
+		}
+		if window.Next(time.Now()).IsZero() {
+			return errors.Errorf("removal window %q never opens", c.RemovalWindow)
+		}
+	}
+	if !keysync.ValidKeyOptions(c.KeyOptions) {
+		return errors.Errorf("invalid key options %v", c.KeyOptions)
+	}
+	for username, options := range c.UserKeyOptions {
+		if !keysync.ValidKeyOptions(options) {
+			return errors.Errorf("invalid key options for %v: %v", username, options)
+		}
+	}
+	if c.KeyTTL < 0 {
+		return errors.New("key ttl can not be negative")
+	}
+	if c.SyncJitter < 0 || c.SyncJitter >= 1 {
+		return errors.New("sync jitter must be at least 0 and less than 1")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown timeout can not be negative")
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case logFormatText, logFormatJSON:
+	default:
+		return errors.Errorf("unknown log format %q, expected text or json", c.LogFormat)
+	}
+	if _, err := c.logLevel(); err != nil {
+		return err
+	}
+	switch c.LogDest {
+	case logDestStderr, logDestSyslog, logDestJournald:
+	case logDestFile:
+		if c.LogFile == "" {
+			return errors.New("-log-dest file requires -log-file")
+		}
+	default:
+		return errors.Errorf("unknown log destination %q, expected stderr, file, syslog or journald", c.LogDest)
+	}
+	// node_exporter ignores files without the extension
+	if c.TextfilePath != "" && !strings.HasSuffix(c.TextfilePath, ".prom") {
+		return errors.New("textfile path must end in .prom")
+	}
+	if c.HealthMaxAge < 0 {
+		return errors.New("health max age can not be negative")
+	}
+	if c.InitialDelay < 0 {
+		return errors.New("initial delay can not be negative")
+	}
+	if c.MaxFetchInterval < 0 {
+		return errors.New("max fetch interval can not be negative")
+	}
+	// syncs can be as far apart as the interval stretched by its jitter
+	if c.KeyTTL != 0 && c.command == commandDaemon && c.KeyTTL <= c.syncPeriod() {
+		return errors.Errorf("key ttl must be longer than the sync interval, plus its jitter, of %v, or keys will expire between syncs", c.syncPeriod())
+	}
+	for _, marker := range append([]string{c.Marker}, c.PreviousMarkers...) {
+		if !keysync.ValidMarker(marker) {
+			return errors.Errorf("invalid marker %q, markers can't be empty or contain colons or whitespace", marker)
+		}
+	}
+	for _, keyType := range c.AllowedKeyTypes {
+		if !keysync.ValidKeyType(keyType) {
+			return errors.Errorf("unknown key type %v", keyType)
+		}
+	}
+	if c.MinRSABits < 0 {
+		return errors.New("min rsa bits can not be negative")
+	}
+	if c.PrintTimeout <= 0 {
+		return errors.New("print timeout must be positive")
+	}
+	if c.HTTPConnectTimeout <= 0 || c.HTTPTimeout <= 0 {
+		return errors.New("http timeouts must be positive")
+	}
+	if c.HTTPRetries < 0 || c.HTTPRetryBackoff < 0 {
+		return errors.New("http retries and retry backoff can not be negative")
+	}
+	if c.FetchConcurrency < 1 {
+		return errors.New("fetch concurrency must be at least 1")
+	}
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return errors.Wrap(err, "invalid proxy")
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return errors.Errorf("proxy must be an http, https or socks5 url, not %q", c.Proxy)
+		}
+	}
+	if (c.TLSClientCert == "") != (c.TLSClientKey == "") {
+		return errors.New("-tls-client-cert and -tls-client-key must be set together")
+	}
+	for _, pin := range c.PinnedSPKI {
+		if !keysync.ValidSPKIPin(pin) {
+			return errors.Errorf("invalid pinned spki %q, pins must be base64 encoded SHA256 hashes", pin)
+		}
+	}
+	if usesUserMap && c.Github.Org != "" {
+		return errors.New("a user map can not be used with -org")
+	}
+	if c.UserMap != "" && len(c.Users) != 0 {
+		return errors.New("only one of user_map and users can be set")
+	}
+	if usesUserMap && len(c.ExtraPaths) != 0 {
+		return errors.New("a user map can not be used with -extra-authorized-keys-paths")
+	}
+	paths := map[string]bool{c.AuthorizedKeysPath: true}
+	for _, path := range c.ExtraPaths {
+		if paths[path] {
+			return errors.Errorf("authorized keys path %v is given more than once", path)
+		}
+		paths[path] = true
+	}
+	for path := range paths {
+		if !keysync.ValidPathTokens(path) {
+			return errors.Errorf("invalid authorized keys path %v, the only tokens allowed are %%h, %%u, %%U and %%%%", path)
+		}
+	}
+	if c.Github.Org != "" && c.Source != sourceGithub {
+		return errors.New("-org can only be used with the github source")
+	}
+	if c.Github.Team != "" && c.Github.Org == "" {
+		return errors.New("-team requires -org to be set")
+	}
+	if c.Github.GraphQL && c.Github.Org == "" {
+		return errors.New("-github-graphql requires -org to be set")
+	}
+	if c.GPGKeyring != "" && usesUserMap {
+		return errors.New("-gpg-keyring can't be used with a user map")
+	}
+	if c.Inventory != "" && (usesUserMap || c.PrincipalsPath != "") {
+		return errors.New("-inventory can't be used with a user map or -authorized-principals-path")
+	}
+	if c.Inventory != "" && c.command == commandPrint {
+		return errors.New("-inventory can't be used to print keys")
+	}
+	if c.GCPMetadata != "" && (usesUserMap || c.Inventory != "" || c.PrincipalsPath != "" || len(c.EC2Instances) != 0) {
+		return errors.New("-gcp-metadata can't be used with a user map, -inventory, -authorized-principals-path or -ec2-instance-ids")
+	}
+	if c.GCPMetadata != "" && c.command == commandPrint {
+		return errors.New("-gcp-metadata can't be used to print keys")
+	}
+	if parts := strings.Split(c.GCPMetadata, "/"); c.GCPMetadata != "" && c.GCPMetadata != gcpMetadataProject && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		return errors.New("-gcp-metadata must be project or <zone>/<instance>")
+	}
+	if c.GCPMetadata != "" && (c.GCPOSUser == "" || strings.ContainsAny(c.GCPOSUser, ": \t")) {
+		return errors.New("-gcp-metadata requires -gcp-os-user to be set to a valid username")
+	}
+	usesKubernetes := c.KubeSecret != "" || c.KubeConfigMap != ""
+	if usesKubernetes && (usesUserMap || c.Inventory != "" || c.PrincipalsPath != "" || len(c.EC2Instances) != 0 || c.GCPMetadata != "") {
+		return errors.New("-kubernetes-secret and -kubernetes-configmap can't be used with a user map, -inventory, -authorized-principals-path, -ec2-instance-ids or -gcp-metadata")
+	}
+	if usesKubernetes && c.command == commandPrint {
+		return errors.New("-kubernetes-secret and -kubernetes-configmap can't be used to print keys")
+	}
+	for _, object := range []string{c.KubeSecret, c.KubeConfigMap} {
+		if object == "" {
+			continue
+		}
+		if err := validKubernetesObject(object); err != nil {
+			return err
+		}
+	}
+	if usesKubernetes && (c.KubeKey == "" || strings.Trim(c.KubeKey, "-._abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "") {
+		return errors.New("-kubernetes-key must be a valid key, of letters, digits, -, _ and .")
+	}
+	if c.KVTarget != "" && (usesUserMap || c.Inventory != "" || c.PrincipalsPath != "" || len(c.EC2Instances) != 0 || c.GCPMetadata != "" || usesKubernetes) {
+		return errors.New("-kv-target can't be used with a user map, -inventory, -authorized-principals-path, -ec2-instance-ids, -gcp-metadata, -kubernetes-secret or -kubernetes-configmap")
+	}
+	if c.KVTarget != "" && c.command == commandPrint {
+		return errors.New("-kv-target can't be used to print keys")
+	}
+	if c.KVTarget != "" {
+		if _, _, err := keysync.ParseKVURL(c.KVTarget, nil); err != nil {
+			return errors.Wrap(err, "invalid -kv-target")
+		}
+	}
+	if c.PushConcurrency < 1 {
+		return errors.New("push concurrency must be at least 1")
+	}
+	if c.PrincipalsPath != "" && usesUserMap {
+		return errors.New("-authorized-principals-path can't be used with a user map")
+	}
+	if c.PrincipalsPath != "" && (c.command == commandPrint || c.dryRun) {
+		return errors.New("-authorized-principals-path can't be used to print keys or with -dry-run")
+	}
+	if c.CertDir != "" && c.CertSigningKey == "" {
+		return errors.New("-cert-dir requires -cert-signing-key-file to be set")
+	}
+	if c.CertDir != "" && usesUserMap {
+		return errors.New("-cert-dir can't be used with a user map")
+	}
+	if c.CertValidity <= 0 {
+		return errors.New("cert validity must be positive")
+	}
+	if c.CertDir != "" && c.command == commandDaemon && c.syncPeriod() >= c.CertValidity/2 {
+		return errors.Errorf("-cert-validity must be more than twice the longest wait between syncs, of %v including -sync-jitter or -schedule, so certificates are reissued before they expire", c.syncPeriod())
+	}
+	if len(c.EC2Instances) != 0 && (usesUserMap || c.Inventory != "" || c.PrincipalsPath != "") {
+		return errors.New("-ec2-instance-ids can't be used with a user map, -inventory or -authorized-principals-path")
+	}
+	if len(c.EC2Instances) != 0 && (c.command == commandPrint || c.dryRun) {
+		return errors.New("-ec2-instance-ids can't be used to print keys or with -dry-run")
+	}
+	if len(c.EC2Instances) != 0 && c.EC2OSUser == "" {
+		return errors.New("-ec2-instance-ids requires -ec2-os-user to be set")
+	}
+	// syncs can be as far apart as the interval stretched by its jitter, and
+	// the keys must be pushed again before the last push expires
+	if len(c.EC2Instances) != 0 && c.command == commandDaemon && (c.Schedule != "" || c.syncPeriod()+instanceConnectPushTime >= keysync.InstanceConnectTTL) {
+		return errors.Errorf("-ec2-instance-ids requires a -sync-interval, stretched by -sync-jitter, under %v, as keys pushed with EC2 Instance Connect are only valid for %v and pushing them takes time", keysync.InstanceConnectTTL-instanceConnectPushTime, keysync.InstanceConnectTTL)
+	}
+	if c.AllowedSigners != "" && usesUserMap {
+		return errors.New("-allowed-signers can't be used with a user map")
+	}
+	if len(c.MirrorURLs) != 0 && c.Source != sourceGithub && c.Source != sourceGitlab && c.Source != sourceGitea {
+		return errors.New("-mirror-urls can only be used with the github, gitlab and gitea sources")
+	}
+	// members' keys are fetched along with them from github itself
+	if len(c.MirrorURLs) != 0 && c.Github.GraphQL {
+		return errors.New("-mirror-urls can't be used with -github-graphql")
+	}
+	for _, mirror := range c.MirrorURLs {
+		if u, err := url.Parse(mirror); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid mirror url %q", mirror)
+		}
+	}
+	if c.Github.Org != "" && c.Github.Token == "" && c.Github.AppID == 0 {
+		return errors.New("-org requires a github token or app to be set")
+	}
+	if c.Github.AppID != 0 && c.Github.AppKeyFile == "" {
+		return errors.New("-github-app-id requires -github-app-private-key-file to be set")
+	}
+	if c.Github.AppID != 0 && c.Github.InstallationID == 0 && c.Github.Org == "" {
+		return errors.New("-github-app-id requires -github-app-installation-id or -org to be set")
+	}
+	// without a secret, anyone who can reach the address could trigger syncs
+	if c.WebhookAddr != "" && c.Github.WebhookSecret == "" {
+		return errors.New("-webhook-addr requires a github webhook secret to be set")
+	}
+	// unsigned events could be forged by anyone who can reach the receiver
+	if c.EventWebhookURL != "" && c.EventSecret == "" {
+		return errors.New("-event-webhook-url requires an event webhook secret to be set")
+	}
+	if (c.MatrixHomeserver == "") != (c.MatrixRoom == "") {
+		return errors.New("-matrix-homeserver-url and -matrix-room-id must be set together")
+	}
+	if c.MatrixHomeserver != "" && c.MatrixToken == "" {
+		return errors.New("-matrix-homeserver-url requires a matrix access token to be set")
+	}
+	if c.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			return errors.Wrapf(err, "invalid smtp address %q", c.SMTPAddr)
+		}
+		if c.EmailFrom == "" || len(c.EmailTo) == 0 {
+			return errors.New("-smtp-addr requires -email-from and -email-to to be set")
+		}
+		for _, address := range append([]string{c.EmailFrom}, c.EmailTo...) {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return errors.Wrapf(err, "invalid email address %q", address)
+			}
+		}
+	}
+	if c.NotifyFailingAfter < 0 {
+		return errors.New("notify failing after can not be negative")
+	}
+	if c.FailPolicy != failOpen && c.FailPolicy != failClosed {
+		return errors.Errorf("unknown fail policy %q, must be %v or %v", c.FailPolicy, failOpen, failClosed)
+	}
+	if c.FailTTL <= 0 {
+		return errors.New("fail ttl must be positive")
+	}
+	if c.DegradedAfter < 0 {
+		return errors.New("degraded after can not be negative")
+	}
+	if c.PagerRoutingKey != "" && c.DegradedAfter == 0 {
+		return errors.New("paging requires -degraded-after to be set")
+	}
+	return nil
+}
+
+// schedule parses -schedule, returning nil if it isn't set
+func (c *config) schedule() (cron.Schedule, error) {
+	if c.Schedule == "" {
+		return nil, nil
+	}
+	schedule, err := cron.ParseStandard(c.Schedule)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid schedule %q", c.Schedule)
+	}
+	return schedule, nil
+}
+
+// removalWindow returns a function checking if keys can be removed at a time,
+// which is during any minute matched by -removal-window, or nil if it isn't
+// set
+func (c *config) removalWindow() func(time.Time) bool {
+	window, err := cron.ParseStandard(c.RemovalWindow)
+	if err != nil || c.RemovalWindow == "" {
+		return nil
+	}
+	return func(now time.Time) bool {
+		minute := now.Truncate(time.Minute)
+		return window.Next(minute.Add(-time.Second)).Equal(minute)
+	}
+}
+
+// syncPeriod returns the longest the daemon waits between syncs, which with
+// -sync-jitter is the interval stretched by its spread
+func (c *config) syncPeriod() time.Duration {
+	schedule, err := c.schedule()
+	if err != nil || schedule == nil {
+		return c.SyncInterval + time.Duration(float64(c.SyncInterval)*c.SyncJitter)
+	}
+	return schedulePeriod(schedule, time.Now())
+}
+
+// schedulePeriod returns the longest gap between runs of the schedule over
+// the next couple of weeks, which covers schedules that skip weekends
+func schedulePeriod(schedule cron.Schedule, from time.Time) time.Duration {
+	longest := time.Duration(0)
+	last := schedule.Next(from)
+	for !last.IsZero() {
+		next := schedule.Next(last)
+		if next.IsZero() {
+			break
+		}
+		if gap := next.Sub(last); gap > longest {
+			longest = gap
+		}
+		last = next
+		if last.After(from.Add(15 * 24 * time.Hour)) {
+			break
+		}
+	}
+	return longest
+}
+
+// userMappings returns the configured mapping of local users to usernames,
+// reading the user map file if necessary
+func (c *config) userMappings() ([]userMapping, error) {
+	if c.UserMap != "" {
+		return readUserMap(c.UserMap)
+	}
+
+	mappings := []userMapping{}
+	for localUser, usernames := range c.Users {
+		mappings = append(mappings, userMapping{localUser: localUser, usernames: usernames})
+	}
+	return mappings, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseConfigTOML checks a toml config file sets the same options as the
+// yaml one it's equivalent to
+func TestParseConfigTOML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.yaml": `sync_interval: 10m
+sync_jitter: 0.1
+key_options: no-pty
+usernames: [alice, bob]
+github:
+  base_url: https://ghe.example.com
+user_key_options:
+  bob: from="10.0.0.0/8"
+`,
+		"config.toml": `sync_interval = "10m"
+sync_jitter = 0.1
+key_options = "no-pty"
+usernames = ["alice", "bob"]
+
+[github]
+base_url = "https://ghe.example.com"
+
+[user_key_options]
+bob = 'from="10.0.0.0/8"'
+`,
+	}
+	configs := map[string]*config{}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"sync", "-config", path})
+		if err != nil {
+			t.Fatalf("parseConfig() of %v failed: %v", name, err)
+		}
+		c.configPath = ""
+		configs[name] = c
+	}
+
+	got := configs["config.toml"]
+	if got.SyncInterval != 10*time.Minute || got.Github.BaseURL != "https://ghe.example.com" || got.UserKeyOptions["bob"] != `from="10.0.0.0/8"` {
+		t.Errorf("parseConfig() of toml = %+v, want the options it sets", got)
+	}
+	if !reflect.DeepEqual(got, configs["config.yaml"]) {
+		t.Errorf("parseConfig() of toml = %+v, want %+v as from yaml", got, configs["config.yaml"])
+	}
+}
+
+func TestParseConfigTOMLUnknownOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(path, []byte("usernames = [\"alice\"]\nbogus = 1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"sync", "-config", path})
+	if err == nil || !strings.Contains(err.Error(), "field bogus not found") {
+		t.Fatalf("parseConfig() = %v, want the unknown option rejected", err)
+	}
+	// the line numbers would be those of the converted yaml
+	if strings.Contains(err.Error(), "line ") {
+		t.Errorf("parseConfig() = %v, want no line number", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+)
+
+const (
+	// controlCommand, given as the first argument, sends a command to a
+	// running daemon's control socket
+	controlCommand = "ctl"
+	// defaultControlSocket is where the ctl client looks for the socket
+	defaultControlSocket = "/run/sync-github-ssh-keys.sock"
+	// controlTimeout bounds how long a connection to the control socket can
+	// take, other than waiting for a sync
+	controlTimeout = 10 * time.Second
+)
+
+// controlCommands are the commands the control socket accepts
+var controlCommands = []string{"status", "sync-now", "list-keys"}
+
+// controlServer answers commands sent to the control socket. Each connection
+// sends a single command on a line, and gets back "ok" or "error <reason>"
+// on a line followed by the command's output.
+type controlServer struct {
+	syncers map[string]*keysync.Syncer
+	// sync runs a sync of every syncer, returning whether they succeeded
+	sync func() bool
+}
+
+// serveControl listens on the unix socket at path, which only its owner can
+// connect to, replacing any left behind by a previous run
+func serveControl(path string, server *controlServer) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove old control socket")
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %v", path)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return errors.Wrap(err, "could not set permissions of control socket")
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Error("control socket failed", "path", path, "error", err)
+				return
+			}
+			go server.handle(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	command, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	command = strings.TrimSpace(command)
+	slog.Debug("control command", "command", command)
+
+	var output strings.Builder
+	switch command {
+	case "status":
+		err = s.status(&output)
+	case "sync-now":
+		if !s.sync() {
+			err = errors.New("sync failed, see the daemon's logs")
+		}
+	case "list-keys":
+		err = s.listKeys(&output)
+	default:
+		err = errors.Errorf("unknown command %q", command)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+	if err != nil {
+		fmt.Fprintf(conn, "error %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "ok\n%v", output.String())
+}
+
+// sortedSyncers returns the names of the syncers in order
+func (s *controlServer) sortedSyncers() []string {
+	names := []string{}
+	for name := range s.syncers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// status writes the state of each syncer
+func (s *controlServer) status(w io.Writer) error {
+	for _, name := range s.sortedSyncers() {
+		status := s.syncers[name].Status()
+		fmt.Fprintf(w, "%v:\n", name)
+		fmt.Fprintf(w, "  last sync:    %v\n", formatTime(status.LastSync))
+		fmt.Fprintf(w, "  last success: %v\n", formatTime(status.LastSuccess))
+		if status.LastError != nil {
+			fmt.Fprintf(w, "  last error:   %v\n", status.LastError)
+		}
+		fmt.Fprintf(w, "  managed keys: %v\n", status.ManagedKeys)
+		for _, username := range status.Usernames {
+			fmt.Fprintf(w, "  user %v: last fetched %v\n", username, formatTime(status.UserLastFetched[username]))
+		}
+	}
+	return nil
+}
+
+// listKeys writes the synced keys in each syncer's target
+func (s *controlServer) listKeys(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tUSER\tSYNCED ON\tFINGERPRINT")
+	for _, name := range s.sortedSyncers() {
+		keys, err := s.syncers[name].ManagedKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", name, key.Username, key.SyncedOn, key.Fingerprint)
+		}
+	}
+	return tw.Flush()
+}
+
+// runControlClient sends the command given in args to the daemon's control
+// socket, printing its output, and returns the exit code
+func runControlClient(args []string) int {
+	fs, socket := controlClientFlags()
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	err = sendControlCommand(*socket, fs.Arg(0), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync-github-ssh-keys: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// controlClientFlags returns the flags the ctl command takes
+func controlClientFlags() (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(controlCommand, flag.ContinueOnError)
+	socket := fs.String("control-socket", defaultControlSocket, "control socket of the daemon")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sync-github-ssh-keys %v [-control-socket path] %v\n", controlCommand, strings.Join(controlCommands, "|"))
+		fs.PrintDefaults()
+	}
+	return fs, socket
+}
+
+// sendControlCommand sends the command to the control socket and copies its
+// output to w
+func sendControlCommand(socket, command string, w io.Writer) error {
+	conn, err := net.DialTimeout("unix", socket, controlTimeout)
+	if err != nil {
+		return errors.Wrap(err, "could not connect to daemon")
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, command)
+	if err != nil {
+		return errors.Wrap(err, "could not send command")
+	}
+
+	reader := bufio.NewReader(conn)
+	result, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "could not read response")
+	}
+	result = strings.TrimSuffix(result, "\n")
+	if result != "ok" {
+		return errors.New(strings.TrimPrefix(result, "error "))
+	}
+	_, err = io.Copy(w, reader)
+	return errors.Wrap(err, "could not read response")
+}
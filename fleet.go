@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultRemotePath is the authorized_keys file on hosts in the inventory,
+// relative to the home directory of the user logged in as
+const defaultRemotePath = ".ssh/authorized_keys"
+
+// inventoryHost is a host in the inventory, given on a line as
+// [user@]host[:port] [path]
+type inventoryHost struct {
+	user string
+	addr string
+	path string
+}
+
+// fleet pushes keys to the hosts in the inventory, fetching each user's keys
+// once for all of them
+type fleet struct {
+	source      *keysync.SharedSource
+	concurrency int
+}
+
+// readInventory reads the hosts from the inventory file, skipping blank lines
+// and comments
+func readInventory(path string) ([]inventoryHost, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open inventory")
+	}
+	defer f.Close()
+
+	hosts := []inventoryHost{}
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, errors.Errorf("inventory line %v: expected [user@]host[:port] [path]", i)
+		}
+
+		host := inventoryHost{path: defaultRemotePath}
+		addr := fields[0]
+		if at := strings.LastIndex(addr, "@"); at != -1 {
+			host.user, addr = addr[:at], addr[at+1:]
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "22")
+		}
+		host.addr = addr
+		if len(fields) == 2 {
+			host.path = fields[1]
+		}
+		hosts = append(hosts, host)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read inventory")
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("inventory lists no hosts")
+	}
+	return hosts, nil
+}
+
+// sshClientConfig returns the config to log in to the hosts in the inventory
+// with, as user, authenticating with -ssh-identity-file or the ssh agent, and
+// checking host keys against -ssh-known-hosts
+func sshClientConfig(cfg *config, username string) (*ssh.ClientConfig, error) {
+	var auth ssh.AuthMethod
+	if cfg.SSHIdentityFile != "" {
+		encoded, err := ioutil.ReadFile(cfg.SSHIdentityFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read ssh identity file")
+		}
+		signer, err := ssh.ParsePrivateKey(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse ssh identity file")
+		}
+		auth = ssh.PublicKeys(signer)
+	} else if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		// the agent is connected to for as long as the process runs
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not connect to ssh agent")
+		}
+		auth = ssh.PublicKeysCallback(agent.NewClient(conn).Signers)
+	} else {
+		return nil, errors.New("-inventory requires -ssh-identity-file, or an ssh agent in SSH_AUTH_SOCK")
+	}
+
+	knownHostsPath := cfg.SSHKnownHosts
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not find known hosts file")
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read known hosts file")
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// inventorySyncers returns a syncer for each host in the inventory, pushing
+// keys to its authorized_keys file over ssh
+func inventorySyncers(cfg *config, source keysync.Source, usernames []string) (map[string]*keysync.Syncer, error) {
+	hosts, err := readInventory(cfg.Inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultUser := cfg.SSHUser
+	if defaultUser == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not find the user to log in as")
+		}
+		defaultUser = current.Username
+	}
+
+	configs := map[string]*ssh.ClientConfig{}
+	syncers := map[string]*keysync.Syncer{}
+	for _, host := range hosts {
+		username := host.user
+		if username == "" {
+			username = defaultUser
+		}
+		if configs[username] == nil {
+			configs[username], err = sshClientConfig(cfg, username)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		target := &keysync.SSHTarget{Addr: host.addr, Path: host.path, Config: configs[username], Create: cfg.Create}
+		if syncers[target.String()] != nil {
+			return nil, errors.Errorf("%v is in the inventory more than once", target)
+		}
+		syncers[target.String()] = newSyncer(cfg, target.String(), source, target, usernames)
+	}
+	return syncers, nil
+}
+
+// push syncs the hosts' authorized_keys files, up to concurrency at once,
+// then logs a summary of which changed and which failed. It returns true if
+// every host succeeded.
+func (f *fleet) push(ctx context.Context, syncers map[string]*keysync.Syncer) bool {
+	f.source.Reset()
+
+	concurrency := f.concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var mu sync.Mutex
+	changed, failed := 0, []string{}
+	work := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency && i < len(syncers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				err := syncers[name].Sync(ctx)
+				mu.Lock()
+				if err != nil {
+					slog.Error("sync failed", "target", name, "error", err)
+					failed = append(failed, name)
+				} else if target, ok := syncers[name].Target.(*keysync.SSHTarget); ok && target.Changed() {
+					changed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for name := range syncers {
+		work <- name
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Strings(failed)
+	slog.Info("pushed keys to hosts", "hosts", len(syncers), "changed", changed, "unchanged", len(syncers)-changed-len(failed), "failed", len(failed))
+	if len(failed) != 0 {
+		slog.Error("could not push keys to some hosts", "hosts", strings.Join(failed, " "))
+		return false
+	}
+	return true
+}
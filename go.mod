@@ -1,3 +1,12 @@
 module github.com/lclarkmichalek/sync-github-ssh-keys
 
-require github.com/pkg/errors v0.8.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/pkg/errors v0.8.0
+	github.com/prometheus/client_golang v1.19.1
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.28.0
+	gopkg.in/yaml.v2 v2.4.0
+)
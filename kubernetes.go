@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+)
+
+// kubernetesSyncers returns a syncer for -kubernetes-secret and for
+// -kubernetes-configmap, whichever are set, each writing the keys into the
+// -kubernetes-key of the object
+func kubernetesSyncers(cfg *config, source keysync.Source, usernames []string) (map[string]*keysync.Syncer, error) {
+	kubeConfig, err := keysync.NewKubernetesConfig(cfg.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	syncers := map[string]*keysync.Syncer{}
+	for kind, object := range map[string]string{keysync.KubernetesSecret: cfg.KubeSecret, keysync.KubernetesConfigMap: cfg.KubeConfigMap} {
+		if object == "" {
+			continue
+		}
+		namespace, name := splitKubernetesObject(object, kubeConfig.Namespace)
+		target := &keysync.KubernetesTarget{
+			Kind:      kind,
+			Namespace: namespace,
+			Name:      name,
+			Key:       cfg.KubeKey,
+			Config:    kubeConfig,
+			Create:    cfg.Create,
+		}
+		syncers[target.String()] = newSyncer(cfg, target.String(), source, target, usernames)
+	}
+	return syncers, nil
+}
+
+// splitKubernetesObject splits an object given as [namespace/]name, defaulting
+// to the namespace given
+func splitKubernetesObject(object, defaultNamespace string) (string, string) {
+	if i := strings.Index(object, "/"); i != -1 {
+		return object[:i], object[i+1:]
+	}
+	return defaultNamespace, object
+}
+
+// validKubernetesObject checks that an object is given as [namespace/]name
+func validKubernetesObject(object string) error {
+	parts := strings.Split(object, "/")
+	for _, part := range parts {
+		if part == "" || strings.ToLower(part) != part || strings.ContainsAny(part, " \t:") {
+			return errors.Errorf("invalid kubernetes object %q: expected [namespace/]name", object)
+		}
+	}
+	if len(parts) > 2 {
+		return errors.Errorf("invalid kubernetes object %q: expected [namespace/]name", object)
+	}
+	return nil
+}
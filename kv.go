@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+)
+
+// kvWatchURLs returns the urls of the etcd and consul keys that keys are
+// fetched from with the kv source, so the daemon can watch them
+func kvWatchURLs(cfg *config) ([]string, error) {
+	usernames := append([]string{}, cfg.Usernames...)
+	if cfg.UserMap != "" || len(cfg.Users) != 0 {
+		mappings, err := cfg.userMappings()
+		if err != nil {
+			return nil, err
+		}
+		for _, mapping := range mappings {
+			usernames = append(usernames, mapping.usernames...)
+		}
+	}
+
+	urls := []string{}
+	seen := map[string]bool{}
+	for _, username := range usernames {
+		if strings.HasPrefix(username, sourceKV+":") {
+			username = strings.TrimPrefix(username, sourceKV+":")
+		} else if cfg.Source != sourceKV || keysync.IsLocalSource(username) || qualifiedUsername(cfg.Source, username) {
+			continue
+		}
+		if !seen[username] {
+			seen[username] = true
+			urls = append(urls, username)
+		}
+	}
+	return urls, nil
+}
+
+// qualifiedUsername checks if the username is qualified with a source other
+// than the named one
+func qualifiedUsername(name, username string) bool {
+	for _, other := range otherSources(name) {
+		if strings.HasPrefix(username, other+":") {
+			return true
+		}
+	}
+	return false
+}
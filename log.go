@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logDestStderr   = "stderr"
+	logDestFile     = "file"
+	logDestSyslog   = "syslog"
+	logDestJournald = "journald"
+
+	// logTag identifies our messages in the system logger
+	logTag = "sync-github-ssh-keys"
+)
+
+// logLevel returns the minimum level of messages to log
+func (c *config) logLevel() (slog.Level, error) {
+	if c.Debug {
+		return slog.LevelDebug, nil
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	if err != nil {
+		return level, errors.Errorf("unknown log level %q, expected debug, info, warn or error", c.LogLevel)
+	}
+	return level, nil
+}
+
+// logHandler returns the handler to log with, as configured
+func (c *config) logHandler() (slog.Handler, error) {
+	switch c.LogDest {
+	case logDestFile:
+		f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open log file")
+		}
+		return c.formatHandler(f, false), nil
+	case logDestSyslog:
+		send, err := syslogSender()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not connect to syslog")
+		}
+		return newPriorityHandler(c, send), nil
+	case logDestJournald:
+		send, err := journaldSender()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not connect to journald")
+		}
+		return newPriorityHandler(c, send), nil
+	}
+	return c.formatHandler(os.Stderr, false), nil
+}
+
+// formatHandler returns a handler writing logs to w in the configured format.
+// If the destination records the time and level itself, they can be left out.
+func (c *config) formatHandler(w io.Writer, omitTimeAndLevel bool) slog.Handler {
+	// validated with the rest of the config
+	level, _ := c.logLevel()
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if omitTimeAndLevel && len(groups) == 0 && (attr.Key == slog.TimeKey || attr.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			// the text handler formats errors with %+v, which includes the
+			// stack trace of errors from pkg/errors
+			if err, ok := attr.Value.Any().(error); ok {
+				return slog.String(attr.Key, err.Error())
+			}
+			return attr
+		},
+	}
+
+	if strings.ToLower(c.LogFormat) == logFormatJSON {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// priorityHandler formats each record as a line, and sends it to a system
+// logger with a priority according to its level
+type priorityHandler struct {
+	inner slog.Handler
+	send  func(level slog.Level, line string) error
+
+	// inner, and every handler derived from it, writes to buf
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func newPriorityHandler(c *config, send func(slog.Level, string) error) *priorityHandler {
+	buf := &bytes.Buffer{}
+	return &priorityHandler{
+		inner: c.formatHandler(buf, true),
+		send:  send,
+		mu:    &sync.Mutex{},
+		buf:   buf,
+	}
+}
+
+func (h *priorityHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *priorityHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.mu.Lock()
+	h.buf.Reset()
+	err := h.inner.Handle(ctx, record)
+	line := strings.TrimSuffix(h.buf.String(), "\n")
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return h.send(record.Level, line)
+}
+
+func (h *priorityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *h
+	derived.inner = h.inner.WithAttrs(attrs)
+	return &derived
+}
+
+func (h *priorityHandler) WithGroup(name string) slog.Handler {
+	derived := *h
+	derived.inner = h.inner.WithGroup(name)
+	return &derived
+}
@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+)
+
+// journaldSocket is where journald accepts messages in its native protocol
+const journaldSocket = "/run/systemd/journal/socket"
+
+// syslogSender returns a function sending log lines to the local syslog daemon
+func syslogSender() (func(slog.Level, string) error, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logTag)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(level slog.Level, line string) error {
+		switch syslogPriority(level) {
+		case syslog.LOG_ERR:
+			return writer.Err(line)
+		case syslog.LOG_WARNING:
+			return writer.Warning(line)
+		case syslog.LOG_INFO:
+			return writer.Info(line)
+		default:
+			return writer.Debug(line)
+		}
+	}, nil
+}
+
+// journaldSender returns a function sending log lines to journald
+func journaldSender() (func(slog.Level, string) error, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(level slog.Level, line string) error {
+		// lines are formatted by slog, so never contain newlines, which
+		// would need a binary encoding
+		_, err := fmt.Fprintf(conn, "PRIORITY=%v\nSYSLOG_IDENTIFIER=%v\nMESSAGE=%v\n", syslogPriority(level), logTag, line)
+		return err
+	}, nil
+}
+
+// syslogPriority returns the syslog priority, as used by journald, for the
+// level
+func syslogPriority(level slog.Level) syslog.Priority {
+	switch {
+	case level >= slog.LevelError:
+		return syslog.LOG_ERR
+	case level >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case level >= slog.LevelInfo:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
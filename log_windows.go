@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/pkg/errors"
+)
+
+func syslogSender() (func(slog.Level, string) error, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
+
+func journaldSender() (func(slog.Level, string) error, error) {
+	return nil, errors.New("journald is not supported on windows")
+}
@@ -1,63 +1,436 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
-	"time"
 	"os"
 	"os/signal"
-	"syscall"
-	"fmt"
-	"io"
-	"bufio"
+	"os/user"
+	"path/filepath"
+	"sort"
 	"strings"
-	"log"
-	"bytes"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const (
-	keyMagicComment = "synced from github"
-)
+// cancelTimeout is how long to wait for a cancelled sync to return on
+// shutdown
+const cancelTimeout = 5 * time.Second
 
 func main() {
-	var (
-		syncInterval time.Duration
-		disablePeriodicSync bool
-		authorizedKeysFilePath string
-		githubUsername string
-	)
-
-	flag.DurationVar(&syncInterval, "sync-interval", time.Minute, "interval to sync keys at")
-	flag.BoolVar(&disablePeriodicSync, "disable-periodic-sync", false, "sync just once then exit")
-	flag.StringVar(&authorizedKeysFilePath, "authorized-keys-path", os.Getenv("HOME") + "/.ssh/authorized_keys", "authorized_keys file to write keys into")
-	flag.Parse()
-
-	githubUsername = flag.Arg(0)
-	if githubUsername == "" {
-		fmt.Fprintln(os.Stderr, "sync-github-ssh-keys requires a github username as its first argument")
-		flag.PrintDefaults()
+	if len(os.Args) > 1 && os.Args[1] == controlCommand {
+		os.Exit(runControlClient(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == completionCommand {
+		os.Exit(runCompletion(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == uploadCommand {
+		os.Exit(runUpload(os.Args[2:]))
+	}
+
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync-github-ssh-keys: %v\n", err)
+		flag.CommandLine.Usage()
 		os.Exit(1)
 	}
+	if cfg.version {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
 
+	logHandler, err := cfg.logHandler()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync-github-ssh-keys: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(logHandler))
+	// cancelled to abandon a sync that's holding up shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// so jittered syncs and retries differ between hosts
+	rand.Seed(time.Now().UnixNano())
 
-	if disablePeriodicSync {
-		err := syncGithubKeys(githubUsername, authorizedKeysFilePath)
+	httpConfig := keysync.HTTPConfig{
+		ConnectTimeout: cfg.HTTPConnectTimeout,
+		Timeout:        cfg.HTTPTimeout,
+		Retries:        cfg.HTTPRetries,
+		RetryBackoff:   cfg.HTTPRetryBackoff,
+		Proxy:          cfg.Proxy,
+		CAFile:         cfg.CAFile,
+		PinnedSPKI:     cfg.PinnedSPKI,
+		ClientCertFile: cfg.TLSClientCert,
+		ClientKeyFile:  cfg.TLSClientKey,
+		UserAgent:      userAgent(),
+		Concurrency:    cfg.FetchConcurrency,
+	}
+	client, err := keysync.NewHTTPClient(httpConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sources := sourceConfig{}
+	sources.github.Client = client
+	sources.gitlab.Client = client
+	sources.gitea.Client = client
+	sources.url.Client = client
+	sources.kv.Client = client
+	sources.github.BaseURL = cfg.Github.BaseURL
+	sources.github.UseAPI = cfg.Github.API
+	sources.github.Token = cfg.Github.Token
+	sources.github.UseGraphQL = cfg.Github.GraphQL
+	if cfg.Github.AppID != 0 {
+		sources.github.App, err = githubApp(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid github app: %v\n", err)
+			os.Exit(1)
+		}
+		// installation tokens only authenticate API requests
+		sources.github.UseAPI = true
+	}
+	sources.gitlab.BaseURL = cfg.Gitlab.BaseURL
+	sources.gitea.BaseURL = cfg.Gitea.BaseURL
+	sources.gitea.Token = cfg.Gitea.Token
+	sources.local.Stdin = os.Stdin
+	sources.mirrors = cfg.MirrorURLs
+	if cfg.URL.SigningKey != "" {
+		sources.url.SigningKey, err = keysync.ParseEd25519PublicKey(cfg.URL.SigningKey)
 		if err != nil {
-			log.Printf("sync failed: %v", err)
+			fmt.Fprintf(os.Stderr, "invalid url signing key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	source, err := sources.keySource(cfg.Source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	usesUserMap := cfg.UserMap != "" || len(cfg.Users) != 0
+	usernames := cfg.Usernames
+	if cfg.command == commandPrint {
+		source = &keysync.CachedSource{
+			Source: keysync.WithTimeout(source, cfg.PrintTimeout),
+			Dir:    cfg.CacheDir,
+		}
+		// with a user map, the argument is the local user sshd is
+		// authenticating, e.g. from AuthorizedKeysCommand's %u
+		if usesUserMap {
+			usernames, err = mappedUsernames(cfg, usernames)
+			if err != nil {
+				slog.Error("print failed", "error", err)
+				os.Exit(1)
+			}
+		}
+	} else if cfg.CacheDir != "" {
+		// so keys can still be synced if the source is unreachable at boot
+		cached := &keysync.CachedSource{Source: source, Dir: cfg.CacheDir}
+		if cfg.FailPolicy == failClosed {
+			// failing closed mustn't be put off by falling back to the cache
+			cached.MaxAge = cfg.FailTTL
+		}
+		source = cached
+	}
+
+	syncers := map[string]*keysync.Syncer{}
+	var pushing *fleet
+	if cfg.PrincipalsPath != "" {
+		// hosts trusting a CA authorize the users by their principals,
+		// rather than their keys
+	} else if len(cfg.EC2Instances) != 0 {
+		// keys are pushed to the instances rather than written anywhere
+	} else if cfg.Inventory != "" {
+		pushing = &fleet{source: &keysync.SharedSource{Source: source}, concurrency: cfg.PushConcurrency}
+		syncers, err = inventorySyncers(cfg, pushing.source, usernames)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, syncer := range syncers {
+			syncer.Members = orgMembers(cfg, &sources)
+		}
+	} else if cfg.GCPMetadata != "" {
+		target := &keysync.GCPMetadataTarget{Project: cfg.GCPProject, OSUser: cfg.GCPOSUser, URL: cfg.GCPComputeURL, Client: client}
+		if cfg.GCPMetadata != gcpMetadataProject {
+			parts := strings.SplitN(cfg.GCPMetadata, "/", 2)
+			target.Zone, target.Instance = parts[0], parts[1]
+		}
+		syncer := newSyncer(cfg, target.String(), source, target, usernames)
+		syncer.Members = orgMembers(cfg, &sources)
+		syncers[target.String()] = syncer
+	} else if cfg.KubeSecret != "" || cfg.KubeConfigMap != "" {
+		syncers, err = kubernetesSyncers(cfg, source, usernames)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, syncer := range syncers {
+			syncer.Members = orgMembers(cfg, &sources)
+		}
+	} else if cfg.KVTarget != "" {
+		store, key, err := keysync.ParseKVURL(cfg.KVTarget, client)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		target := &keysync.KVTarget{Store: store, Key: key, Create: cfg.Create}
+		syncer := newSyncer(cfg, target.String(), source, target, usernames)
+		syncer.Members = orgMembers(cfg, &sources)
+		syncers[target.String()] = syncer
+	} else if usesUserMap && cfg.command != commandPrint {
+		syncers, err = userMapSyncers(cfg, source)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		if cfg.command != commandPrint {
+			err = resolveAuthorizedKeysPaths(cfg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		paths := []string{cfg.AuthorizedKeysPath}
+		if cfg.command != commandPrint {
+			// each path gets the same keys
+			paths = append(paths, cfg.ExtraPaths...)
+		}
+		for _, path := range paths {
+			target := &keysync.FileTarget{Path: path, Create: cfg.Create, Backups: cfg.Backups}
+			if cfg.command != commandPrint {
+				target.Owner, err = authorizedKeysOwner(cfg, path)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			syncer := newSyncer(cfg, path, source, target, usernames)
+			syncer.Members = orgMembers(cfg, &sources)
+			syncers[path] = syncer
+		}
+	}
+
+	// other files kept in sync with the users' keys alongside the
+	// authorized_keys files
+	files := map[string]fileSyncer{}
+	if cfg.GPGKeyring != "" {
+		files[cfg.GPGKeyring] = &keysync.GPGKeyring{
+			Path:      cfg.GPGKeyring,
+			BaseURL:   cfg.Github.BaseURL,
+			Client:    client,
+			Usernames: usernames,
+			Members:   orgMembers(cfg, &sources),
+		}
+	}
+	if cfg.AllowedSigners != "" {
+		files[cfg.AllowedSigners] = &keysync.AllowedSigners{
+			Path:      cfg.AllowedSigners,
+			Github:    &sources.github,
+			Usernames: usernames,
+			Members:   orgMembers(cfg, &sources),
+			Marker:    cfg.Marker,
+		}
+	}
+	if cfg.PrincipalsPath != "" {
+		files[cfg.PrincipalsPath] = &keysync.AuthorizedPrincipals{
+			Path:      cfg.PrincipalsPath,
+			Usernames: usernames,
+			Members:   orgMembers(cfg, &sources),
+			Options:   cfg.KeyOptions,
+			Marker:    cfg.Marker,
+		}
+	}
+	if cfg.CertDir != "" {
+		encoded, err := ioutil.ReadFile(cfg.CertSigningKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not read cert signing key: %v\n", err)
+			os.Exit(1)
+		}
+		ca, err := keysync.ParseCAKey(encoded)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		keys := newSyncer(cfg, cfg.CertDir, source, nil, usernames)
+		keys.Members = orgMembers(cfg, &sources)
+		files[cfg.CertDir] = &keysync.CertIssuer{
+			Dir:      cfg.CertDir,
+			Keys:     keys,
+			CA:       ca,
+			Validity: cfg.CertValidity,
+		}
+	}
+	if len(cfg.EC2Instances) != 0 {
+		keys := newSyncer(cfg, "ec2-instance-connect", source, nil, usernames)
+		keys.Members = orgMembers(cfg, &sources)
+		files["ec2-instance-connect"] = &keysync.InstanceConnect{
+			Instances: cfg.EC2Instances,
+			OSUser:    cfg.EC2OSUser,
+			Region:    cfg.EC2Region,
+			URL:       cfg.EC2ConnectURL,
+			Keys:      keys,
+			Client:    client,
+		}
+	}
+	if cfg.KnownHosts != "" {
+		files[cfg.KnownHosts] = &keysync.KnownHosts{
+			Path:   cfg.KnownHosts,
+			Github: &sources.github,
+			Marker: cfg.Marker,
+		}
+	}
+
+	if cfg.StatsdAddr != "" {
+		statsd, err := keysync.NewStatsdClient(cfg.StatsdAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, syncer := range syncers {
+			syncer.Statsd = statsd
+		}
+	}
+
+	if cfg.AuditFile != "" {
+		audit := keysync.NewAuditLog(cfg.AuditFile)
+		for _, syncer := range syncers {
+			syncer.Audit = audit
+		}
+	}
+
+	if cfg.EventWebhookURL != "" {
+		events := keysync.NewEventWebhook(cfg.EventWebhookURL, cfg.EventSecret, cfg.EventFailures, client)
+		for _, syncer := range syncers {
+			syncer.Events = events
+		}
+	}
+
+	notifiers := notifiers(cfg, client)
+	for _, syncer := range syncers {
+		syncer.Notifiers = notifiers
+		syncer.NotifyFailingAfter = cfg.NotifyFailingAfter
+		syncer.DegradedAfter = cfg.DegradedAfter
+	}
+
+	if cfg.PagerRoutingKey != "" {
+		pager := &keysync.Pager{URL: cfg.PagerURL, RoutingKey: cfg.PagerRoutingKey, Client: client}
+		for _, syncer := range syncers {
+			syncer.Pager = pager
+		}
+	}
+
+	if cfg.command == commandStatus {
+		statuses, err := keyStatuses(syncers, cfg.CacheDir)
+		if err == nil {
+			err = writeStatus(os.Stdout, statuses, cfg.statusJSON)
+		}
+		if err != nil {
+			slog.Error("status failed", "error", err)
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
-	doSync := make(chan bool, 1)
-	doSync <- true
+	if cfg.command == commandRemove {
+		if !removeAll(ctx, syncers, cfg.Usernames) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.command == commandRepair {
+		if !repairAll(ctx, syncers) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.command == commandPrint {
+		err := syncers[cfg.AuthorizedKeysPath].Print(ctx, os.Stdout)
+		if err != nil {
+			slog.Error("print failed", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.command == commandCheck {
+		changed, ok := diffAll(ctx, syncers, ioutil.Discard)
+		switch {
+		case !ok:
+			os.Exit(1)
+		case changed:
+			slog.Info("authorized keys are out of date")
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.dryRun {
+		_, ok := diffAll(ctx, syncers, os.Stdout)
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	ticker := time.NewTicker(syncInterval)
-	defer ticker.Stop()
+	if cfg.command == commandSync {
+		if paused(cfg.PauseFile) {
+			os.Exit(0)
+		}
+		pidFiles, err := claimPIDFiles(cfg, syncers)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		ok := syncAll(ctx, syncers, files, pushing)
+		writeTextfile(cfg.TextfilePath)
+		releasePIDFiles(pidFiles)
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// the daemon holds the pid files for as long as it runs
+	pidFiles, err := claimPIDFiles(cfg, syncers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// spread out syncs, so a fleet started together doesn't hit the source
+	// at the same moment
+	doSync := make(chan bool, 1)
+	schedule, _ := cfg.schedule()
 	go func() {
-		for range ticker.C {
+		if schedule != nil {
+			// sync straight away, so keys are in place at boot
+			doSync <- true
+			for {
+				time.Sleep(time.Until(schedule.Next(time.Now())))
+				doSync <- true
+			}
+		}
+
+		time.Sleep(randomDuration(cfg.InitialDelay))
+		doSync <- true
+		for {
+			time.Sleep(jitter(cfg.SyncInterval, cfg.SyncJitter))
 			doSync <- true
 		}
 	}()
@@ -69,140 +442,613 @@ func main() {
 		doSync <- true
 	}()
 
-	for range doSync {
-		err := syncGithubKeys(githubUsername, authorizedKeysFilePath)
+	// metrics and health checks can share an address
+	muxes := map[string]*http.ServeMux{}
+	handle := func(addr, pattern string, handler http.Handler) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, handler)
+	}
+	if cfg.MetricsAddr != "" {
+		handle(cfg.MetricsAddr, "/metrics", promhttp.Handler())
+	}
+	if cfg.HealthAddr != "" {
+		maxAge := cfg.HealthMaxAge
+		if maxAge == 0 {
+			maxAge = 3 * (cfg.syncPeriod() + cfg.InitialDelay)
+		}
+		handle(cfg.HealthAddr, "/healthz", healthHandler(syncers, maxAge))
+	}
+	// a sync already queued will pick up the change
+	requestSync := func() {
+		select {
+		case doSync <- true:
+		default:
+		}
+	}
+	if cfg.WebhookAddr != "" {
+		handle(cfg.WebhookAddr, "/webhook", webhookHandler(cfg.Github.WebhookSecret, requestSync))
+	}
+	for addr, mux := range muxes {
+		err := serveHTTP(addr, mux)
 		if err != nil {
-			log.Printf("sync failed: %v", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 	}
-}
 
-func syncGithubKeys(githubUsername string, authorizedKeysFilePath string) error {
-	publicKeys, err := getSSHKeys(githubUsername)
+	// sync as soon as keysets consumed from etcd or consul change
+	watched, err := kvWatchURLs(cfg)
 	if err != nil {
-		return errors.Wrap(err, "could not get public keys from github")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(watched) != 0 {
+		// watches wait for changes for minutes at a time, so mustn't time
+		// out like other requests
+		watchConfig := httpConfig
+		watchConfig.Timeout, watchConfig.Retries = 0, 0
+		watchClient, err := keysync.NewHTTPClient(watchConfig)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, u := range watched {
+			err := keysync.WatchKV(ctx, u, watchClient, requestSync)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
 	}
 
-	authorizedKeysFile, err := os.OpenFile(authorizedKeysFilePath, os.O_RDWR, 0644)
-	if err != nil {
-		return errors.Wrap(err, "could not open authorized keys file")
+	if len(dumpStateSignals) != 0 {
+		dump := make(chan os.Signal, 1)
+		signal.Notify(dump, dumpStateSignals...)
+		go func() {
+			for range dump {
+				logState(syncers)
+			}
+		}()
 	}
-	defer authorizedKeysFile.Close()
 
-	outputBuffer := bytes.NewBuffer(nil)
-	err = ensureKeysetUpToDate(publicKeys, outputBuffer, authorizedKeysFile)
-	if err != nil {
-		return errors.Wrap(err, "could not update authorized keys file")
+	// hold syncing while a sync is in flight, so shutdown can wait for it to
+	// finish rather than leave a half written temporary file behind
+	var syncing sync.Mutex
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-stop
+		slog.Info("shutting down", "signal", sig.String())
+		notifySystemd("STOPPING=1")
+		if !lockWithin(&syncing, cfg.ShutdownTimeout) {
+			slog.Warn("sync did not finish in time, cancelling it", "timeout", cfg.ShutdownTimeout)
+			cancel()
+			lockWithin(&syncing, cancelTimeout)
+			releasePIDFiles(pidFiles)
+			os.Exit(1)
+		}
+		releasePIDFiles(pidFiles)
+		os.Exit(0)
+	}()
+
+	// ping systemd's watchdog, if enabled, unless a sync has hung for longer
+	// than the watchdog allows, so systemd restarts the daemon
+	clock := &syncClock{}
+	if interval := systemdWatchdogInterval(); interval != 0 {
+		go func() {
+			for range time.Tick(interval / 2) {
+				if clock.running() < interval {
+					notifySystemd("WATCHDOG=1")
+				}
+			}
+		}()
 	}
 
-	_, err = authorizedKeysFile.Seek(0, 0)
-	if err != nil {
-		return errors.Wrap(err, "could not seek authorized keys file")
+	ready := false
+	runSync := func() bool {
+		syncing.Lock()
+		defer syncing.Unlock()
+		if paused(cfg.PauseFile) {
+			notifySystemd("WATCHDOG=1\nSTATUS=paused by " + cfg.PauseFile)
+			return false
+		}
+		clock.start()
+		ok := syncAll(ctx, syncers, files, pushing)
+		clock.stop()
+		writeTextfile(cfg.TextfilePath)
+
+		state := "WATCHDOG=1\nSTATUS=" + systemdStatus(syncers)
+		if ok && !ready {
+			// systemd considers the service started once keys are in place
+			state = "READY=1\n" + state
+			ready = true
+		}
+		notifySystemd(state)
+		return ok
 	}
 
-	n, err := io.Copy(authorizedKeysFile, outputBuffer)
-	if err != nil {
-		return errors.Wrap(err, "could not copy new contents to authorized keys file")
+	if cfg.ControlSocket != "" {
+		err := serveControl(cfg.ControlSocket, &controlServer{syncers: syncers, sync: runSync})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
-	err = authorizedKeysFile.Truncate(n)
+	for range doSync {
+		runSync()
+	}
+}
+
+// healthHandler responds 200 if every syncer's last sync succeeded within
+// maxAge, and 503 otherwise, listing the syncers that are unhealthy
+func healthHandler(syncers map[string]*keysync.Syncer, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problems := []string{}
+		for name, syncer := range syncers {
+			status := syncer.Status()
+			switch {
+			case status.LastError != nil:
+				problems = append(problems, fmt.Sprintf("%v: last sync failed: %v", name, status.LastError))
+			case status.LastSuccess.IsZero():
+				problems = append(problems, fmt.Sprintf("%v: no successful sync yet", name))
+			case time.Since(status.LastSuccess) > maxAge:
+				problems = append(problems, fmt.Sprintf("%v: last synced %v ago", name, time.Since(status.LastSuccess).Round(time.Second)))
+			}
+		}
+		sort.Strings(problems)
+
+		if len(problems) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// serveHTTP serves the handler on addr in the background, failing if addr
+// can't be listened on
+func serveHTTP(addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return errors.Wrap(err, "could not truncate authorized keys file")
+		return errors.Wrapf(err, "could not listen on %v", addr)
 	}
-	
+
+	go func() {
+		err := http.Serve(listener, handler)
+		slog.Error("http server failed", "addr", addr, "error", err)
+	}()
 	return nil
 }
 
-func ensureKeysetUpToDate(newKeyset []string,  output io.Writer, input io.Reader) error {
-	newKeysetHashed := map[string]struct{}{}
-	for _, key := range newKeyset {
-		newKeysetHashed[key] = struct{}{}
+// lockWithin locks the mutex, giving up if it can't be locked within the
+// timeout. It returns whether it was locked.
+func lockWithin(mu *sync.Mutex, timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// randomDuration returns a random duration between 0 and max
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// jitter randomly varies the interval by up to the fraction of it either way
+func jitter(interval time.Duration, fraction float64) time.Duration {
+	spread := time.Duration(float64(interval) * fraction)
+	return interval - spread + randomDuration(2*spread)
+}
+
+// logState logs the state of every syncer, and of each user it syncs, as
+// logfmt lines for live debugging
+func logState(syncers map[string]*keysync.Syncer) {
+	names := []string{}
+	for name := range syncers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	bufferedInput := bufio.NewReader(input)
-	for i := 1; ; i++ {
-		line, err := bufferedInput.ReadString('\n')
-		if err == io.EOF {
-			break
+	for _, name := range names {
+		status := syncers[name].Status()
+		lastError := ""
+		if status.LastError != nil {
+			lastError = status.LastError.Error()
 		}
-		if err != nil {
-			return errors.Wrap(err, "could not read authorized keys file")
+		slog.Info("state", "target", name, "users", strings.Join(status.Usernames, ","),
+			"last_sync", formatTime(status.LastSync), "last_success", formatTime(status.LastSuccess),
+			"last_error", lastError, "managed_keys", status.ManagedKeys)
+
+		for _, username := range status.Usernames {
+			slog.Info("state", "target", name, "user", username,
+				"last_fetched", formatTime(status.UserLastFetched[username]))
 		}
-		if len(line) != 0 && line[len(line) - 1] == '\n' {
-			line = line[:len(line)-1]
+	}
+}
+
+// formatTime formats the time for logState, or never if it's zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// claimPIDFiles writes the pid to -pid-file, or to a pid file alongside each
+// syncer's authorized keys file, failing if another process is syncing any of
+// them
+func claimPIDFiles(cfg *config, syncers map[string]*keysync.Syncer) ([]*keysync.PIDFile, error) {
+	if cfg.PIDFile != "" {
+		pidFile, err := keysync.ClaimPIDFile(cfg.PIDFile)
+		if err != nil {
+			return nil, err
 		}
+		return []*keysync.PIDFile{pidFile}, nil
+	}
 
-		// the last component of the lines in an authorized keys file must be
-		// stripped off before comparison with the github provided keys
-		parts := strings.SplitN(line, " ", 3)
-		if len(parts) < 2 {
-			return errors.Errorf("line %v in authorized keys file malformed", i)
+	paths := []string{}
+	for path := range syncers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	pidFiles := []*keysync.PIDFile{}
+	for _, path := range paths {
+		target, ok := syncers[path].Target.(*keysync.FileTarget)
+		if !ok {
+			continue
 		}
+		pidFile, err := target.ClaimPIDFile()
+		if err != nil {
+			releasePIDFiles(pidFiles)
+			return nil, err
+		}
+		pidFiles = append(pidFiles, pidFile)
+	}
+	return pidFiles, nil
+}
 
-		key := parts[0] + " " + parts[1]
+// releasePIDFiles removes the pid files
+func releasePIDFiles(pidFiles []*keysync.PIDFile) {
+	for _, pidFile := range pidFiles {
+		pidFile.Release()
+	}
+}
 
-		// Check to see if the key was created by us
-		if len(parts) > 3 && parts[2] == keyMagicComment {
-			// if it's still in the set of keys, then write it out again
-			if _, ok := newKeysetHashed[key]; !ok {
-				_, err := fmt.Fprintf(output, "%v %v\n", key, keyMagicComment)
-				if err != nil {
-					return errors.Wrap(err, "could not write out existing synced key")
-				}
-			} else {
-				log.Printf("removing key: %v", key)
-			}
-		} else {
-			_, err := fmt.Fprintln(output, line)
+// paused checks if the pause file exists, logging that syncing is paused,
+// along with the reason given in the file
+func paused(path string) bool {
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		slog.Warn("could not check pause file, skipping sync", "path", path, "error", err)
+		return true
+	}
+
+	reason, err := ioutil.ReadFile(path)
+	if err != nil {
+		slog.Warn("could not read pause file", "path", path, "error", err)
+	}
+	slog.Warn("pause file exists, skipping sync", "path", path, "since", info.ModTime().Format(time.RFC3339), "reason", strings.TrimSpace(string(reason)))
+	return true
+}
+
+// writeTextfile writes the sync metrics to path, if set, logging any failure
+func writeTextfile(path string) {
+	if path == "" {
+		return
+	}
+	err := keysync.WriteTextfile(path)
+	if err != nil {
+		slog.Error("could not write metrics", "path", path, "error", err)
+	}
+}
+
+// fileSyncer keeps a file other than an authorized_keys file in sync with
+// the users' keys, such as a gpg keyring
+type fileSyncer interface {
+	Sync(ctx context.Context) error
+}
+
+// syncAll runs every syncer, and then syncs the other files, logging any
+// failures, and returns true if they all succeeded. Syncers and files are
+// keyed by a name to identify them in logs. When pushing to a fleet, the
+// syncers run concurrently.
+func syncAll(ctx context.Context, syncers map[string]*keysync.Syncer, files map[string]fileSyncer, pushing *fleet) bool {
+	ok := true
+	if pushing != nil {
+		ok = pushing.push(ctx, syncers)
+	} else {
+		for name, syncer := range syncers {
+			err := syncer.Sync(ctx)
 			if err != nil {
-				return errors.Wrap(err, "could not write out existing unsynced key")
+				slog.Error("sync failed", "target", name, "error", err)
+				ok = false
 			}
 		}
+	}
+	for name, file := range files {
+		err := file.Sync(ctx)
+		if err != nil {
+			slog.Error("sync failed", "target", name, "error", err)
+			ok = false
+		}
+	}
+	return ok
+}
 
-		delete(newKeysetHashed, key)
+// diffAll writes a diff of the changes each syncer would make to w, logging
+// any failures. It returns whether there are any changes, and true if every
+// syncer succeeded.
+func diffAll(ctx context.Context, syncers map[string]*keysync.Syncer, w io.Writer) (bool, bool) {
+	changed, ok := false, true
+	for name, syncer := range syncers {
+		syncerChanged, err := syncer.Diff(ctx, w, name)
+		if err != nil {
+			slog.Error("diff failed", "target", name, "error", err)
+			ok = false
+		}
+		changed = changed || syncerChanged
 	}
+	return changed, ok
+}
 
-	for key := range newKeysetHashed {
-		log.Printf("adding key: %v", key)
-		_, err := fmt.Fprintf(output, "%v %v\n", key, keyMagicComment)
+// removeAll removes the synced keys of the usernames, or every synced key if
+// none are given, from each syncer's target, logging any failures, and returns
+// true if they all succeeded
+func removeAll(ctx context.Context, syncers map[string]*keysync.Syncer, usernames []string) bool {
+	ok := true
+	for name, syncer := range syncers {
+		removed, err := syncer.Remove(ctx, usernames)
 		if err != nil {
-			return errors.Wrap(err, "could not write out new key")
+			slog.Error("remove failed", "target", name, "error", err)
+			ok = false
+			continue
 		}
+		slog.Info("removed synced keys", "target", name, "removed", removed)
 	}
+	return ok
+}
 
-	return nil
+// repairAll repairs every syncer's target, logging what was fixed, and returns
+// whether they all succeeded
+func repairAll(ctx context.Context, syncers map[string]*keysync.Syncer) bool {
+	ok := true
+	for name, syncer := range syncers {
+		report, err := syncer.Repair(ctx)
+		if err != nil {
+			slog.Error("repair failed", "target", name, "error", err)
+			ok = false
+			continue
+		}
+		if !report.Changed() {
+			slog.Info("nothing to repair", "target", name)
+			continue
+		}
+		slog.Info("repaired authorized keys file", "target", name,
+			"duplicates", report.Duplicates, "orphans", report.Orphans, "normalized", report.Normalized)
+	}
+	return ok
 }
 
-func getSSHKeys(githubUsername string) ([]string, error) {
-	url := fmt.Sprintf("https://github.com/%v.keys", githubUsername)
-	request, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not construct request")
+// newSyncer returns a syncer configured by cfg. The target may be nil for
+// syncers that only fetch keys.
+func newSyncer(cfg *config, name string, source keysync.Source, target keysync.Target, usernames []string) *keysync.Syncer {
+	return &keysync.Syncer{
+		Name:            name,
+		Source:          source,
+		SourceName:      sourceName(cfg.Source),
+		Sources:         otherSources(cfg.Source),
+		Target:          target,
+		Usernames:       usernames,
+		ExtraKeysFile:   cfg.ExtraKeysFile,
+		MinKeys:         cfg.MinKeys,
+		NoPrune:         cfg.NoPrune,
+		AllowEmpty:      cfg.AllowEmpty,
+		FailTTL:         cfg.FailTTL,
+		FailClosed:      cfg.FailPolicy == failClosed,
+		Exclusive:       cfg.Exclusive,
+		RemovalWindow:   cfg.removalWindow(),
+		KeyOptions:      cfg.KeyOptions,
+		UserKeyOptions:  cfg.UserKeyOptions,
+		KeyTTL:          cfg.KeyTTL,
+		Marker:          cfg.Marker,
+		PreviousMarkers: cfg.PreviousMarkers,
+		AllowedKeyTypes: cfg.AllowedKeyTypes,
+		MinRSABits:      cfg.MinRSABits,
+
+		AllowedFingerprintsFile: cfg.AllowedFingerprints,
+		DeniedFingerprintsFile:  cfg.DeniedFingerprints,
+		MaxFetchInterval:        cfg.MaxFetchInterval,
+		Concurrency:             cfg.FetchConcurrency,
 	}
+}
 
-	resp, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not make request")
+// notifiers returns the notifiers configured to be sent key changes
+func notifiers(cfg *config, client *http.Client) []keysync.Notifier {
+	notifiers := []keysync.Notifier{}
+	if cfg.SlackWebhookURL != "" {
+		notifiers = append(notifiers, &keysync.SlackNotifier{URL: cfg.SlackWebhookURL, Client: client})
+	}
+	if cfg.DiscordWebhookURL != "" {
+		notifiers = append(notifiers, &keysync.DiscordNotifier{URL: cfg.DiscordWebhookURL, Client: client})
+	}
+	if cfg.MatrixHomeserver != "" {
+		notifiers = append(notifiers, &keysync.MatrixNotifier{
+			HomeserverURL: cfg.MatrixHomeserver,
+			RoomID:        cfg.MatrixRoom,
+			AccessToken:   cfg.MatrixToken,
+			Client:        client,
+		})
 	}
-	defer resp.Body.Close()
+	if cfg.SMTPAddr != "" {
+		notifiers = append(notifiers, &keysync.EmailNotifier{
+			Addr:     cfg.SMTPAddr,
+			From:     cfg.EmailFrom,
+			To:       cfg.EmailTo,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		})
+	}
+	return notifiers
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, errors.Errorf("invalid status code: %v", resp.StatusCode)
+// userMapSyncers returns a syncer for each local user in the user map, which
+// syncs keys into the user's ~/.ssh/authorized_keys, or wherever -sshd-config
+// says sshd reads it from, or -authorized-keys-path if it has tokens to expand
+// for the user, keyed by the file's path
+func userMapSyncers(cfg *config, source keysync.Source) (map[string]*keysync.Syncer, error) {
+	if os.Geteuid() != 0 {
+		return nil, errors.New("a user map requires running as root")
 	}
 
-	publicKeys := []string{}
-	buf := bufio.NewReader(resp.Body)
-	for {
-		publicKey, err := buf.ReadString('\n')
-		if err == io.EOF {
-			break
+	mappings, err := cfg.userMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	syncers := map[string]*keysync.Syncer{}
+	for _, mapping := range mappings {
+		localUser, err := user.Lookup(mapping.localUser)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not look up local user %v", mapping.localUser)
+		}
+
+		path := filepath.Join(localUser.HomeDir, ".ssh", "authorized_keys")
+		if cfg.SshdConfig != "" {
+			path, err = userAuthorizedKeysPath(cfg.SshdConfig, localUser)
+			if err != nil {
+				return nil, err
+			}
+		} else if hasPathTokens(cfg.AuthorizedKeysPath) {
+			path = keysync.ExpandPathTokens(cfg.AuthorizedKeysPath, localUser)
 		}
+		syncers[path] = newSyncer(cfg, path, source, &keysync.FileTarget{
+			Path:    path,
+			Owner:   localUser,
+			Create:  cfg.Create,
+			Backups: cfg.Backups,
+		}, mapping.usernames)
+	}
+	return syncers, nil
+}
+
+// resolveAuthorizedKeysPaths finds the authorized keys file sshd reads the
+// keys of -owner, or the user running, from in -sshd-config, or otherwise
+// expands the tokens in -authorized-keys-path for them, along with those in
+// the extra paths
+func resolveAuthorizedKeysPaths(cfg *config) error {
+	needsUser := cfg.SshdConfig != "" || hasPathTokens(cfg.AuthorizedKeysPath)
+	for _, path := range cfg.ExtraPaths {
+		needsUser = needsUser || hasPathTokens(path)
+	}
+	if !needsUser {
+		return nil
+	}
+
+	var u *user.User
+	var err error
+	if cfg.Owner != "" {
+		u, err = user.Lookup(cfg.Owner)
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not look up the user to find the authorized keys file of")
+	}
+
+	if cfg.SshdConfig != "" {
+		cfg.AuthorizedKeysPath, err = userAuthorizedKeysPath(cfg.SshdConfig, u)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to read response body")
+			return err
 		}
+	} else {
+		cfg.AuthorizedKeysPath = keysync.ExpandPathTokens(cfg.AuthorizedKeysPath, u)
+	}
+	for i, path := range cfg.ExtraPaths {
+		cfg.ExtraPaths[i] = keysync.ExpandPathTokens(path, u)
+	}
+	return nil
+}
+
+// hasPathTokens checks if the path has any tokens to expand
+func hasPathTokens(path string) bool {
+	return strings.Contains(path, "%")
+}
 
-		publicKeys = append(publicKeys, publicKey[:len(publicKey)-1])
+// userAuthorizedKeysPath returns the first authorized keys file sshd reads
+// the user's keys from, according to the sshd config
+func userAuthorizedKeysPath(sshdConfig string, u *user.User) (string, error) {
+	paths, err := keysync.SshdAuthorizedKeysFiles(sshdConfig, u)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", errors.Errorf("sshd doesn't read authorized keys files for %v, AuthorizedKeysFile is none", u.Username)
+	}
+	slog.Debug("found authorized keys file in sshd config", "user", u.Username, "path", paths[0])
+	return paths[0], nil
+}
+
+// authorizedKeysOwner returns the user that should own the authorized keys
+// file. When root syncs another user's keys, the file must belong to that user
+// for sshd to accept it, so if no owner is configured it is assumed to be the
+// owner of the file's directory. Otherwise the file's ownership is left alone.
+func authorizedKeysOwner(cfg *config, path string) (*user.User, error) {
+	if cfg.Owner != "" {
+		owner, err := user.Lookup(cfg.Owner)
+		return owner, errors.Wrapf(err, "could not look up owner %v", cfg.Owner)
 	}
 
-	return publicKeys, nil
-}
\ No newline at end of file
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+
+	owner, err := keysync.DirectoryOwner(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not determine owner of authorized keys file, set -owner")
+	}
+	if owner.Uid == "0" {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+// mappedUsernames returns the usernames the local users given are mapped to
+// in the user map
+func mappedUsernames(cfg *config, localUsers []string) ([]string, error) {
+	mappings, err := cfg.userMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := []string{}
+	for _, mapping := range mappings {
+		for _, localUser := range localUsers {
+			if mapping.localUser == localUser {
+				usernames = append(usernames, mapping.usernames...)
+			}
+		}
+	}
+	return usernames, nil
+}
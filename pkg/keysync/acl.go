@@ -0,0 +1,18 @@
+package keysync
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// AdministratorsAuthorizedKeysFile is the name of the file OpenSSH for
+// windows reads the keys of members of the Administrators group from, in
+// %ProgramData%\ssh, rather than their own authorized_keys files
+const AdministratorsAuthorizedKeysFile = "administrators_authorized_keys"
+
+// needsACL checks if the file at path is one sshd requires an ACL on. It's
+// decided by the path the file ends up at, as it's written under a temporary
+// name first.
+func needsACL(path string) bool {
+	return strings.EqualFold(filepath.Base(path), AdministratorsAuthorizedKeysFile)
+}
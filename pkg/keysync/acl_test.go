@@ -0,0 +1,52 @@
+package keysync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNeedsACL(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join("ProgramData", "ssh", "administrators_authorized_keys"), true},
+		{filepath.Join("ProgramData", "ssh", "Administrators_Authorized_Keys"), true},
+		{filepath.Join("Users", "alice", ".ssh", "authorized_keys"), false},
+		{filepath.Join("ProgramData", "ssh", "administrators_authorized_keys.bak.20240501T120000.000Z"), false},
+		{filepath.Join("ProgramData", "ssh", ".administrators_authorized_keys.tmp-123456"), false},
+	}
+
+	for _, test := range tests {
+		if got := needsACL(test.path); got != test.want {
+			t.Errorf("needsACL(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+// TestNeedsACLTemporaryFile checks the temporary file written in place of
+// administrators_authorized_keys doesn't need an ACL by its own name, so
+// replace has to decide by the path it's renamed to
+func TestNeedsACLTemporaryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, AdministratorsAuthorizedKeysFile)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+
+	if needsACL(tmp.Name()) {
+		t.Errorf("needsACL(%q) = true, want false", tmp.Name())
+	}
+	if !needsACL(path) {
+		t.Errorf("needsACL(%q) = false, want true", path)
+	}
+}
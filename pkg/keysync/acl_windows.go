@@ -0,0 +1,34 @@
+package keysync
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// administratorsSDDL grants only SYSTEM and the Administrators group access,
+// without inheriting anything from the directory, as sshd refuses to read
+// administrators_authorized_keys otherwise
+const administratorsSDDL = "D:P(A;;FA;;;SY)(A;;FA;;;BA)"
+
+// secureFile sets the ACL sshd requires on administrators_authorized_keys on
+// the file, which is, or is about to be renamed to, the file at path. Other
+// authorized_keys files inherit their ACL from the user's profile, which only
+// they, SYSTEM and Administrators can write to.
+func secureFile(file, path string) error {
+	if !needsACL(path) {
+		return nil
+	}
+
+	sd, err := windows.SecurityDescriptorFromString(administratorsSDDL)
+	if err != nil {
+		return errors.Wrap(err, "could not build authorized keys file ACL")
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return errors.Wrap(err, "could not build authorized keys file ACL")
+	}
+	err = windows.SetNamedSecurityInfo(file, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		nil, nil, dacl, nil)
+	return errors.Wrap(err, "could not set ACL of authorized keys file")
+}
@@ -0,0 +1,40 @@
+package keysync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+// TestFileTargetSecuresAdministratorsFile checks the ACL is set on the file
+// that ends up at administrators_authorized_keys, both when it's created and
+// when it's replaced
+func TestFileTargetSecuresAdministratorsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := &FileTarget{Path: filepath.Join(dir, AdministratorsAuthorizedKeysFile), Create: true}
+
+	for _, contents := range []string{"ssh-ed25519 " + testEd25519Blob + "\r\n", ""} {
+		err := target.Update(context.Background(), func([]byte) ([]byte, error) {
+			return []byte(contents), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sd, err := windows.GetNamedSecurityInfo(target.Path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sd.String(); got != administratorsSDDL {
+			t.Errorf("ACL of %v = %v, want %v", target.Path, got, administratorsSDDL)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package keysync
+
+import (
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// userPoll tracks how often a user's keys change, so they can be fetched less
+// often while they don't
+type userPoll struct {
+	keys    []PublicKey
+	fetched time.Time
+	// backoff is how long to wait after fetched before fetching again
+	backoff time.Duration
+}
+
+// stableKeys returns the keys last fetched for the user, if they have been
+// unchanged for long enough that they needn't be fetched again yet
+func (s *Syncer) stableKeys(username string, now time.Time) ([]PublicKey, bool) {
+	if s.MaxFetchInterval == 0 {
+		return nil, false
+	}
+	poll, ok := s.polls[username]
+	if !ok || now.Before(poll.fetched) || now.Sub(poll.fetched) >= poll.backoff {
+		return nil, false
+	}
+	slog.Debug("keys stable, not fetching", "user", username, "next_fetch", poll.fetched.Add(poll.backoff))
+	return poll.keys, true
+}
+
+// recordKeys records the keys fetched for the user. If they are unchanged
+// since they were last fetched, the time until they're fetched again is
+// doubled, up to MaxFetchInterval, and if they changed they're fetched on
+// every sync again.
+func (s *Syncer) recordKeys(username string, keys []PublicKey, now time.Time) {
+	if s.MaxFetchInterval == 0 {
+		return
+	}
+	if s.polls == nil {
+		s.polls = map[string]*userPoll{}
+	}
+
+	poll, ok := s.polls[username]
+	if !ok {
+		s.polls[username] = &userPoll{keys: keys, fetched: now}
+		return
+	}
+	if !reflect.DeepEqual(poll.keys, keys) {
+		*poll = userPoll{keys: keys, fetched: now}
+		return
+	}
+
+	if poll.backoff == 0 {
+		// start from however long syncs are apart
+		poll.backoff = now.Sub(poll.fetched)
+	} else {
+		poll.backoff *= 2
+	}
+	if poll.backoff > s.MaxFetchInterval {
+		poll.backoff = s.MaxFetchInterval
+	}
+	poll.fetched = now
+}
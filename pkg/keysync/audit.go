@@ -0,0 +1,146 @@
+package keysync
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeyChange is a key added to or removed from a target
+type KeyChange struct {
+	Time time.Time `json:"time"`
+	// Action is add or remove
+	Action string `json:"action"`
+	// File is the Name of the syncer that changed the target
+	File        string `json:"file"`
+	Fingerprint string `json:"fingerprint"`
+	Key         string `json:"key"`
+	// Source and Username are those the key was synced from and for, and
+	// are empty for keys that weren't synced by us
+	Source   string `json:"source"`
+	Username string `json:"username"`
+}
+
+// keyChanges returns the keys added and removed between the target's
+// contents before and after it was updated
+func (s *Syncer) keyChanges(before, after []byte) []KeyChange {
+	now := time.Now().UTC()
+	beforeKeys, afterKeys := s.changeKeys(before), s.changeKeys(after)
+
+	changes := []KeyChange{}
+	for key, change := range beforeKeys {
+		if _, ok := afterKeys[key]; !ok {
+			change.Time, change.Action, change.File = now, "remove", s.Name
+			changes = append(changes, change)
+		}
+	}
+	for key, change := range afterKeys {
+		if _, ok := beforeKeys[key]; !ok {
+			change.Time, change.Action, change.File = now, "add", s.Name
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Action != changes[j].Action {
+			return changes[i].Action > changes[j].Action
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// changeKeys returns the keys in the authorized keys file, with who they
+// were synced for
+func (s *Syncer) changeKeys(contents []byte) map[string]KeyChange {
+	keys := map[string]KeyChange{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		parsed, ok := parseAuthorizedKeysLine(strings.TrimSuffix(line, "\r"))
+		if !ok {
+			continue
+		}
+		if _, ok := keys[parsed.key()]; ok {
+			continue
+		}
+		change := KeyChange{Key: parsed.key(), Fingerprint: fingerprint(parsed.key())}
+		if comment, ok := s.parseSyncComment(parsed.comment); ok {
+			change.Source = comment.source
+			if comment.username != "" {
+				_, change.Username = s.splitUsername(comment.username)
+			}
+		}
+		keys[parsed.key()] = change
+	}
+	return keys
+}
+
+// AuditLog records every key added or removed to a file in JSON Lines
+// format, one KeyChange per line, separately from the operational logs
+type AuditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewAuditLog returns an audit log appending to the file at path, which is
+// created if it doesn't exist
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// record appends the changes, if there is an audit log. The file is opened
+// for each write, so it can be rotated.
+func (a *AuditLog) record(changes []KeyChange) error {
+	if a == nil || len(changes) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lines := []byte{}
+	for _, change := range changes {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return errors.Wrap(err, "could not encode audit record")
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open audit log")
+	}
+	_, err = f.Write(lines)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not write to audit log")
+	}
+	return errors.Wrap(f.Close(), "could not close audit log")
+}
+
+// audit records the keys added and removed by an update of the target from
+// before to after in the audit log, and sends them to the event webhook and
+// notifiers. The target has already changed, so failures are logged rather
+// than failing the update.
+func (s *Syncer) audit(before, after []byte) {
+	if s.Audit == nil && s.Events == nil && len(s.Notifiers) == 0 {
+		return
+	}
+	changes := s.keyChanges(before, after)
+	if len(changes) == 0 {
+		return
+	}
+	err := s.Audit.record(changes)
+	if err != nil {
+		slog.Error("could not record key changes in audit log", "target", s.Name, "error", err)
+	}
+	s.Events.send(Event{Type: EventKeysChanged, File: s.Name, Changes: changes})
+	s.notify(changesMessage(changes))
+}
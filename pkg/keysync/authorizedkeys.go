@@ -0,0 +1,138 @@
+package keysync
+
+import (
+	"strings"
+	"unicode"
+)
+
+// authorizedKeysLine is a key parsed from a line of an authorized_keys file
+type authorizedKeysLine struct {
+	// options is the unparsed options field, e.g. from="10.0.0.0/8",no-pty
+	options string
+	keyType string
+	blob    string
+	comment string
+}
+
+// key returns the key type and blob, which keys are compared by
+func (l authorizedKeysLine) key() string {
+	return l.keyType + " " + l.blob
+}
+
+// certificateSuffix ends the key types of openssh certificates, e.g.
+// ssh-ed25519-cert-v01@openssh.com
+const certificateSuffix = "-cert-v01@openssh.com"
+
+// forCertificates checks if the line holds a certificate, or trusts the key as
+// a certificate authority, rather than authorizing a key to log in with. The
+// key of such a line may be the same as a user's key, but isn't that key.
+func (l authorizedKeysLine) forCertificates() bool {
+	return strings.HasSuffix(l.keyType, certificateSuffix) || l.hasOption("cert-authority")
+}
+
+// hasOption checks if the options field has the named option, which like
+// sshd is matched case insensitively
+func (l authorizedKeysLine) hasOption(name string) bool {
+	options := l.options
+	for options != "" {
+		end := optionEnd(options)
+		option := options[:end]
+		if i := strings.IndexByte(option, '='); i != -1 {
+			option = option[:i]
+		}
+		if strings.EqualFold(option, name) {
+			return true
+		}
+		options = strings.TrimPrefix(options[end:], ",")
+	}
+	return false
+}
+
+// optionEnd returns the index of the comma ending the first option in the
+// options field, or its length if it's the last
+func optionEnd(options string) int {
+	quoted := false
+	for i := 0; i < len(options); i++ {
+		switch {
+		case options[i] == '\\' && quoted:
+			// skip the escaped character
+			i++
+		case options[i] == '"':
+			quoted = !quoted
+		case options[i] == ',' && !quoted:
+			return i
+		}
+	}
+	return len(options)
+}
+
+// parseAuthorizedKeysLine parses a line in the format described in sshd(8).
+// Blank lines and comments are legal but hold no key, so they aren't parsed,
+// along with malformed lines.
+func parseAuthorizedKeysLine(line string) (authorizedKeysLine, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return authorizedKeysLine{}, false
+	}
+
+	parsed := authorizedKeysLine{}
+	if !isKeyType(nextField(line)) {
+		parsed.options, line = splitOptions(line)
+	}
+
+	parsed.keyType = nextField(line)
+	line = strings.TrimLeftFunc(line[len(parsed.keyType):], unicode.IsSpace)
+	parsed.blob = nextField(line)
+	parsed.comment = strings.TrimSpace(line[len(parsed.blob):])
+	if !isKeyType(parsed.keyType) || parsed.blob == "" {
+		return authorizedKeysLine{}, false
+	}
+	return parsed, true
+}
+
+// nextField returns the text up to the first whitespace
+func nextField(s string) string {
+	if i := strings.IndexFunc(s, unicode.IsSpace); i != -1 {
+		return s[:i]
+	}
+	return s
+}
+
+// ValidKeyOptions checks that options can be used as the options field of an
+// authorized keys line, i.e. has no whitespace outside of closed quotes
+func ValidKeyOptions(options string) bool {
+	end, closed := optionsEnd(options)
+	return end == len(options) && closed
+}
+
+// splitOptions splits the options field from the start of the line. Options
+// are separated by commas, and may contain whitespace within double quotes,
+// e.g. command="echo hello",no-pty
+func splitOptions(line string) (string, string) {
+	end, _ := optionsEnd(line)
+	return line[:end], strings.TrimLeftFunc(line[end:], unicode.IsSpace)
+}
+
+// optionsEnd returns the index of the end of the options field at the start
+// of the line, and whether all its quotes were closed
+func optionsEnd(line string) (int, bool) {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && quoted:
+			// skip the escaped character
+			i++
+		case line[i] == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(rune(line[i])):
+			return i, true
+		}
+	}
+	return len(line), !quoted
+}
+
+func isKeyType(field string) bool {
+	return strings.HasPrefix(field, "ssh-") ||
+		strings.HasPrefix(field, "ecdsa-sha2-") ||
+		strings.HasPrefix(field, "sk-")
+}
@@ -0,0 +1,219 @@
+package keysync
+
+import "testing"
+
+const (
+	testEd25519Blob = "AAAAC3NzaC1lZDI1NTE5AAAAIPjH7tkMpliV3VzI4FDPgy1dOryc5njMejejWwOFV1AA"
+	testSKBlob      = "AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIPjH7tkMpliV3VzI4FDPgy1dOryc5njMejejWwOFV1AAAAAABHNzaDo="
+)
+
+func TestParseAuthorizedKeysLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+		want authorizedKeysLine
+	}{
+		{
+			name: "key",
+			line: "ssh-ed25519 " + testEd25519Blob,
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ssh-ed25519", blob: testEd25519Blob},
+		},
+		{
+			name: "key with comment",
+			line: "ssh-ed25519 " + testEd25519Blob + " alice@laptop work key",
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ssh-ed25519", blob: testEd25519Blob, comment: "alice@laptop work key"},
+		},
+		{
+			name: "surrounding whitespace",
+			line: "  \tssh-ed25519   " + testEd25519Blob + "\t alice  ",
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ssh-ed25519", blob: testEd25519Blob, comment: "alice"},
+		},
+		{
+			name: "crlf line ending",
+			line: "ssh-ed25519 " + testEd25519Blob + " alice\r\n",
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ssh-ed25519", blob: testEd25519Blob, comment: "alice"},
+		},
+		{
+			name: "crlf line ending without comment",
+			line: "ssh-ed25519 " + testEd25519Blob + "\r",
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ssh-ed25519", blob: testEd25519Blob},
+		},
+		{
+			name: "options",
+			line: "no-pty,no-agent-forwarding ssh-ed25519 " + testEd25519Blob + " alice",
+			ok:   true,
+			want: authorizedKeysLine{options: "no-pty,no-agent-forwarding", keyType: "ssh-ed25519", blob: testEd25519Blob, comment: "alice"},
+		},
+		{
+			name: "quoted option with spaces and commas",
+			line: `command="echo hello, world",from="10.0.0.0/8,192.168.0.0/16" ssh-ed25519 ` + testEd25519Blob + " alice",
+			ok:   true,
+			want: authorizedKeysLine{options: `command="echo hello, world",from="10.0.0.0/8,192.168.0.0/16"`, keyType: "ssh-ed25519", blob: testEd25519Blob, comment: "alice"},
+		},
+		{
+			name: "escaped quote in option",
+			line: `command="echo \"hi there\"",no-pty ssh-ed25519 ` + testEd25519Blob,
+			ok:   true,
+			want: authorizedKeysLine{options: `command="echo \"hi there\"",no-pty`, keyType: "ssh-ed25519", blob: testEd25519Blob},
+		},
+		{
+			name: "key type in quoted option",
+			line: `command="ssh-ed25519 x" ssh-ed25519 ` + testEd25519Blob,
+			ok:   true,
+			want: authorizedKeysLine{options: `command="ssh-ed25519 x"`, keyType: "ssh-ed25519", blob: testEd25519Blob},
+		},
+		{
+			name: "cert-authority",
+			line: `cert-authority,principals="alice" ssh-ed25519 ` + testEd25519Blob + " ca",
+			ok:   true,
+			want: authorizedKeysLine{options: `cert-authority,principals="alice"`, keyType: "ssh-ed25519", blob: testEd25519Blob, comment: "ca"},
+		},
+		{
+			name: "certificate",
+			line: "ssh-ed25519-cert-v01@openssh.com " + testEd25519Blob + " alice-cert",
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ssh-ed25519-cert-v01@openssh.com", blob: testEd25519Blob, comment: "alice-cert"},
+		},
+		{
+			name: "sk key",
+			line: "sk-ssh-ed25519@openssh.com " + testSKBlob + " alice@yubikey",
+			ok:   true,
+			want: authorizedKeysLine{keyType: "sk-ssh-ed25519@openssh.com", blob: testSKBlob, comment: "alice@yubikey"},
+		},
+		{
+			name: "sk key with options",
+			line: "no-touch-required sk-ecdsa-sha2-nistp256@openssh.com " + testSKBlob,
+			ok:   true,
+			want: authorizedKeysLine{options: "no-touch-required", keyType: "sk-ecdsa-sha2-nistp256@openssh.com", blob: testSKBlob},
+		},
+		{
+			name: "ecdsa key",
+			line: "ecdsa-sha2-nistp256 " + testEd25519Blob,
+			ok:   true,
+			want: authorizedKeysLine{keyType: "ecdsa-sha2-nistp256", blob: testEd25519Blob},
+		},
+		{name: "empty line", line: "", ok: false},
+		{name: "blank line", line: " \t ", ok: false},
+		{name: "crlf blank line", line: "\r\n", ok: false},
+		{name: "comment", line: "# ssh-ed25519 " + testEd25519Blob, ok: false},
+		{name: "indented comment", line: "   # managed by hand", ok: false},
+		{name: "unterminated quote", line: `command="echo hi ssh-ed25519 ` + testEd25519Blob + " alice", ok: false},
+		{name: "unterminated quote ending in escape", line: `command="echo \" ssh-ed25519 ` + testEd25519Blob, ok: false},
+		{name: "missing blob", line: "ssh-ed25519", ok: false},
+		{name: "options without key", line: "no-pty,no-agent-forwarding", ok: false},
+		{name: "unknown key type", line: "pgp-key " + testEd25519Blob, ok: false},
+		{name: "options before unknown key type", line: "no-pty pgp-key " + testEd25519Blob, ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseAuthorizedKeysLine(test.line)
+			if ok != test.ok {
+				t.Fatalf("parseAuthorizedKeysLine(%q) ok = %v, want %v", test.line, ok, test.ok)
+			}
+			if got != test.want {
+				t.Errorf("parseAuthorizedKeysLine(%q) = %+v, want %+v", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestForCertificates(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"ssh-ed25519 " + testEd25519Blob, false},
+		{"no-pty ssh-ed25519 " + testEd25519Blob, false},
+		{"cert-authority ssh-ed25519 " + testEd25519Blob, true},
+		{"no-pty,cert-authority ssh-ed25519 " + testEd25519Blob, true},
+		{`Cert-Authority,principals="a,b" ssh-ed25519 ` + testEd25519Blob, true},
+		// the option's name only appears within another option's value
+		{`command="cert-authority" ssh-ed25519 ` + testEd25519Blob, false},
+		{`environment="X=a,cert-authority" ssh-ed25519 ` + testEd25519Blob, false},
+		{"ssh-ed25519-cert-v01@openssh.com " + testEd25519Blob, true},
+		{"ssh-rsa-cert-v01@openssh.com " + testEd25519Blob, true},
+		{"sk-ssh-ed25519-cert-v01@openssh.com " + testSKBlob, true},
+		{"sk-ssh-ed25519@openssh.com " + testSKBlob, false},
+	}
+
+	for _, test := range tests {
+		parsed, ok := parseAuthorizedKeysLine(test.line)
+		if !ok {
+			t.Errorf("parseAuthorizedKeysLine(%q) failed", test.line)
+			continue
+		}
+		if got := parsed.forCertificates(); got != test.want {
+			t.Errorf("forCertificates() of %q = %v, want %v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestOptionEnd(t *testing.T) {
+	tests := []struct {
+		options string
+		want    int
+	}{
+		{"", 0},
+		{"no-pty", 6},
+		{"no-pty,no-agent-forwarding", 6},
+		{`command="a,b",no-pty`, 13},
+		{`command="say \"a,b\"",no-pty`, 21},
+		{`command="unterminated,no-pty`, 28},
+	}
+
+	for _, test := range tests {
+		if got := optionEnd(test.options); got != test.want {
+			t.Errorf("optionEnd(%q) = %v, want %v", test.options, got, test.want)
+		}
+	}
+}
+
+func TestOptionsEnd(t *testing.T) {
+	tests := []struct {
+		line   string
+		end    int
+		closed bool
+	}{
+		{"no-pty ssh-ed25519", 6, true},
+		{`command="a b" ssh-ed25519`, 13, true},
+		{`command="say \"a b\"" ssh-ed25519`, 21, true},
+		{"no-pty\tssh-ed25519", 6, true},
+		{`command="a b ssh-ed25519`, 24, false},
+		{"no-pty", 6, true},
+	}
+
+	for _, test := range tests {
+		end, closed := optionsEnd(test.line)
+		if end != test.end || closed != test.closed {
+			t.Errorf("optionsEnd(%q) = %v, %v, want %v, %v", test.line, end, closed, test.end, test.closed)
+		}
+	}
+}
+
+func TestValidKeyOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    bool
+	}{
+		{"", true},
+		{"no-pty", true},
+		{`from="10.0.0.0/8",no-agent-forwarding`, true},
+		{`command="echo hello world"`, true},
+		{`command="echo \"hi\""`, true},
+		{"no-pty no-x11-forwarding", false},
+		{`command="echo hello`, false},
+	}
+
+	for _, test := range tests {
+		if got := ValidKeyOptions(test.options); got != test.want {
+			t.Errorf("ValidKeyOptions(%q) = %v, want %v", test.options, got, test.want)
+		}
+	}
+}
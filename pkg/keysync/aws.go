@@ -0,0 +1,241 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultIMDSURL is the EC2 instance metadata service, which the credentials
+// of the instance's role are fetched from when none are in the environment
+const defaultIMDSURL = "http://169.254.169.254"
+
+// imdsClient talks to the instance metadata service, which is link local, so
+// is never reached through a proxy
+var imdsClient = &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{}}
+
+// awsCredentials authenticate requests to AWS APIs
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string `json:"Token"`
+	// Expiration is when temporary credentials stop working, or zero if
+	// they don't
+	Expiration time.Time
+}
+
+// expiring checks if the credentials need fetching again
+func (c *awsCredentials) expiring() bool {
+	return !c.Expiration.IsZero() && time.Until(c.Expiration) < 5*time.Minute
+}
+
+// loadAWSCredentials reads the credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or failing that fetches those
+// of the instance's role from the instance metadata service, as the AWS SDKs
+// do
+func loadAWSCredentials(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if secret == "" {
+			return nil, errors.New("AWS_ACCESS_KEY_ID is set without AWS_SECRET_ACCESS_KEY")
+		}
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	role, err := getInstanceMetadata(ctx, "iam/security-credentials/")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get aws credentials from the environment or the instance's role")
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	if role == "" {
+		return nil, errors.New("could not get aws credentials from the environment or the instance's role: the instance has no role")
+	}
+	encoded, err := getInstanceMetadata(ctx, "iam/security-credentials/"+role)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get the credentials of the instance's role")
+	}
+	credentials := &awsCredentials{}
+	err = json.Unmarshal([]byte(encoded), credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode the credentials of the instance's role")
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, errors.New("the instance metadata service returned no credentials for the instance's role")
+	}
+	return credentials, nil
+}
+
+// awsRegion returns the region from AWS_REGION or AWS_DEFAULT_REGION, or
+// failing that, the region of the instance running
+func awsRegion(ctx context.Context) (string, error) {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region, nil
+		}
+	}
+	region, err := getInstanceMetadata(ctx, "placement/region")
+	if err != nil {
+		return "", errors.Wrap(err, "could not get the aws region from the environment or the instance metadata service")
+	}
+	return strings.TrimSpace(region), nil
+}
+
+// getInstanceMetadata gets an item under meta-data from the instance metadata
+// service, with an IMDSv2 session token. AWS_EC2_METADATA_SERVICE_ENDPOINT
+// overrides where the service is, as for the AWS SDKs.
+func getInstanceMetadata(ctx context.Context, item string) (string, error) {
+	base := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if base == "" {
+		base = defaultIMDSURL
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, base+"/latest/api/token", nil)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid instance metadata service url")
+	}
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := readIMDSResponse(request)
+	if err != nil {
+		return "", errors.Wrap(err, "could not get instance metadata token")
+	}
+
+	request, err = http.NewRequestWithContext(ctx, http.MethodGet, base+"/latest/meta-data/"+item, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid instance metadata service url")
+	}
+	request.Header.Set("X-aws-ec2-metadata-token", token)
+	return readIMDSResponse(request)
+}
+
+func readIMDSResponse(request *http.Request) (string, error) {
+	resp, err := imdsClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read instance metadata")
+	}
+	return string(body), nil
+}
+
+// awsError is the body of an error response from an AWS JSON API
+type awsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+	// some services capitalise it
+	MessageUpper string `json:"Message"`
+}
+
+// callAWSJSON calls target on an AWS API using the JSON 1.1 protocol, signing
+// the request with signature version 4, and decodes the response into v
+func callAWSJSON(ctx context.Context, client *http.Client, credentials *awsCredentials, endpoint, service, region, target string, body, v interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "could not encode request")
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", target)
+	signAWSRequest(request, encoded, credentials, service, region, time.Now())
+
+	resp, err := clientOrDefault(client).Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		failure := awsError{}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		// the type is prefixed with the service's namespace
+		kind := failure.Type[strings.LastIndex(failure.Type, "#")+1:]
+		message := failure.Message
+		if message == "" {
+			message = failure.MessageUpper
+		}
+		if kind == "" && message == "" {
+			return &statusError{resp.StatusCode}
+		}
+		return errors.Errorf("%v: %v", kind, message)
+	}
+	return decodeJSONResponse(resp, v)
+}
+
+// signAWSRequest adds the headers signing the request with AWS signature
+// version 4, as described in
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func signAWSRequest(request *http.Request, body []byte, credentials *awsCredentials, service, region string, now time.Time) {
+	now = now.UTC()
+	timestamp := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", timestamp)
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	// every header set is signed, along with the host
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+credentials.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,181 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CachedSource wraps a Source, keeping the last keys successfully fetched for
+// each user in a file in Dir, and falling back to them when fetching fails,
+// e.g. because the network is down. If the source reports that the user no
+// longer exists, their cached keys are forgotten.
+type CachedSource struct {
+	Source Source
+	Dir    string
+	// MaxAge, if set, stops cached keys older than it from being used, so
+	// users' keys aren't kept forever while the source is unreachable
+	MaxAge time.Duration
+
+	warnOnce sync.Once
+}
+
+func (s *CachedSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	keys, err := s.Source.GetKeys(ctx, username)
+	if err == nil {
+		cacheErr := s.store(username, keys)
+		if cacheErr != nil {
+			// the cache is usually unwritable for the whole run, so there's
+			// no need to repeat this for every user and sync
+			s.warnOnce.Do(func() {
+				slog.Warn("could not cache public keys, further failures won't be logged", "user", username, "error", cacheErr)
+			})
+		}
+		return keys, nil
+	}
+
+	if isNotFound(err) {
+		removeErr := os.Remove(s.path(username))
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			slog.Warn("could not remove cached public keys", "user", username, "error", removeErr)
+		}
+		return nil, err
+	}
+
+	if last := s.LastFetched(username); s.MaxAge != 0 && !last.IsZero() && time.Since(last) > s.MaxAge {
+		return nil, errors.Wrapf(err, "cached keys are older than %v", s.MaxAge)
+	}
+	cached, cacheErr := s.load(username)
+	if cacheErr != nil {
+		slog.Warn("could not load cached public keys", "user", username, "error", cacheErr)
+		return nil, err
+	}
+	slog.Warn("using cached public keys", "user", username, "error", err)
+	return cached, nil
+}
+
+// path returns the cache file for the user. Usernames may be urls or paths
+// for some sources, so are escaped.
+func (s *CachedSource) path(username string) string {
+	return filepath.Join(s.Dir, url.PathEscape(username)+".keys")
+}
+
+func (s *CachedSource) store(username string, keys []PublicKey) error {
+	err := os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "could not create cache directory")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, key := range keys {
+		if key.Options != "" {
+			fmt.Fprint(buf, key.Options+" ")
+		}
+		fmt.Fprintln(buf, key.Key)
+	}
+
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "could not create cache file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not write cache file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), s.path(username)), "could not rename cache file")
+}
+
+func (s *CachedSource) load(username string) ([]PublicKey, error) {
+	document, err := ioutil.ReadFile(s.path(username))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeysDocument(document), nil
+}
+
+// LastFetched returns when the user's keys were last fetched, going by when
+// their cached keys were written, or the zero time if they aren't cached
+func (s *CachedSource) LastFetched(username string) time.Time {
+	info, err := os.Stat(s.path(username))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// LastConfirmed returns when the key was last fetched for the user, going by
+// when their cached keys were written, or the zero time if it isn't among
+// them
+func (s *CachedSource) LastConfirmed(username, key string) time.Time {
+	info, err := os.Stat(s.path(username))
+	if err != nil {
+		return time.Time{}
+	}
+	cached, err := s.load(username)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, cachedKey := range cached {
+		if cachedKey.Key == key {
+			return info.ModTime()
+		}
+	}
+	return time.Time{}
+}
+
+// WithTimeout returns a Source that fails if source takes longer than timeout
+// to fetch a user's keys
+func WithTimeout(source Source, timeout time.Duration) Source {
+	return &timeoutSource{source: source, timeout: timeout}
+}
+
+type timeoutSource struct {
+	source  Source
+	timeout time.Duration
+}
+
+type getKeysResult struct {
+	keys []PublicKey
+	err  error
+}
+
+func (s *timeoutSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// not every source can be cancelled, e.g. reading stdin, so the fetch is
+	// left to finish in the background if we give up on it. The buffer lets
+	// it do so.
+	result := make(chan getKeysResult, 1)
+	go func() {
+		keys, err := s.source.GetKeys(ctx, username)
+		result <- getKeysResult{keys, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.keys, r.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.Errorf("timed out after %v", s.timeout)
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,195 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateClockSkew is how long before being issued certificates are valid
+// from, so hosts with clocks a little behind accept them straight away
+const certificateClockSkew = 5 * time.Minute
+
+// certificateUsernameRe matches the usernames that can be used as the name of
+// the directory their certificates are written to
+var certificateUsernameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._:-]*$`)
+
+// CertIssuer signs the users' keys with a CA key, writing a short lived user
+// certificate for each key to Dir/<username>/<fingerprint>-cert.pub, which
+// the users can fetch to log in to hosts that trust the CA. Certificates have
+// the username as their principal, as AuthorizedPrincipals expects, and are
+// reissued once half their validity has passed. Those of keys that are no
+// longer synced are removed.
+type CertIssuer struct {
+	Dir string
+	// Keys fetches and checks the users' keys, as when syncing them into an
+	// authorized_keys file
+	Keys *Syncer
+	CA   ssh.Signer
+	// Validity is how long certificates are valid for
+	Validity time.Duration
+}
+
+// ParseCAKey parses an unencrypted private key, in OpenSSH or PEM format, to
+// sign certificates with
+func ParseCAKey(encoded []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse CA key")
+	}
+	return signer, nil
+}
+
+// Sync fetches the keys of every user and issues certificates for those that
+// don't have a current one. The certificates of users whose keys couldn't be
+// fetched are kept until they expire, and an error is returned.
+func (c *CertIssuer) Sync(ctx context.Context) error {
+	result, err := c.Keys.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	wanted := map[string]bool{}
+	issued := 0
+	for _, key := range result.publicKeys {
+		// keys from local files, such as break-glass keys, belong to no
+		// one to issue certificates to
+		if IsLocalSource(key.username) || !certificateUsernameRe.MatchString(key.username) {
+			continue
+		}
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+		if err != nil {
+			slog.Warn("could not parse key to certify", "user", key.username, "key", keyID(key.Key), "error", err)
+			continue
+		}
+		if _, ok := publicKey.(*ssh.Certificate); ok {
+			continue
+		}
+		// a certificate wouldn't carry the options restricting the key
+		if key.Options != "" {
+			slog.Warn("not certifying key with options", "user", key.username, "fingerprint", fingerprint(key.Key))
+			continue
+		}
+
+		name := filepath.Join(key.username, certificateFileName(publicKey))
+		wanted[name] = true
+		path := filepath.Join(c.Dir, name)
+		if c.current(path, publicKey, now) {
+			continue
+		}
+
+		certificate, err := c.sign(publicKey, key.username, now)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return errors.Wrap(err, "could not create certificate directory")
+		}
+		err = replaceFile(path, ssh.MarshalAuthorizedKey(certificate), 0644)
+		if err != nil {
+			return err
+		}
+		slog.Info("issued certificate", "user", key.username, "fingerprint", fingerprint(key.Key), "serial", certificate.Serial, "valid_before", time.Unix(int64(certificate.ValidBefore), 0).UTC())
+		issued++
+	}
+
+	// the certificates of users whose keys couldn't be fetched expire on
+	// their own
+	kept := c.Keys.keptUsernames(result)
+	paths, err := filepath.Glob(filepath.Join(c.Dir, "*", "*-cert.pub"))
+	if err != nil {
+		return errors.Wrap(err, "could not list certificates")
+	}
+	for _, path := range paths {
+		username := filepath.Base(filepath.Dir(path))
+		if wanted[filepath.Join(username, filepath.Base(path))] || kept[username] {
+			continue
+		}
+		slog.Info("removing certificate of key no longer synced", "user", username, "path", path)
+		err := os.Remove(path)
+		if err != nil {
+			return errors.Wrap(err, "could not remove certificate")
+		}
+		// the directory is only removed once it's empty
+		os.Remove(filepath.Dir(path))
+	}
+
+	slog.Debug("certificates up to date", "dir", c.Dir, "issued", issued)
+	return partialFailure(result.usernames, result.failedUsernames)
+}
+
+// current checks if the certificate at path is for the key, was signed by the
+// CA, and has at least half its validity left
+func (c *CertIssuer) current(path string, key ssh.PublicKey, now time.Time) bool {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return false
+	}
+	certificate, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return false
+	}
+
+	validBefore := time.Unix(int64(certificate.ValidBefore), 0)
+	return bytes.Equal(certificate.Key.Marshal(), key.Marshal()) &&
+		bytes.Equal(certificate.SignatureKey.Marshal(), c.CA.PublicKey().Marshal()) &&
+		validBefore.Sub(now) > c.Validity/2 &&
+		!validBefore.After(now.Add(c.Validity))
+}
+
+// sign issues a user certificate for the key with the username as its
+// principal
+func (c *CertIssuer) sign(key ssh.PublicKey, username string, now time.Time) (*ssh.Certificate, error) {
+	serial := make([]byte, 8)
+	_, err := rand.Read(serial)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate serial")
+	}
+
+	certificate := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           username + ":" + ssh.FingerprintSHA256(key),
+		ValidPrincipals: []string{username},
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(c.Validity).Unix()),
+		// the same as ssh-keygen grants by default
+		Permissions: ssh.Permissions{Extensions: map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		}},
+	}
+	err = certificate.SignCert(rand.Reader, c.CA)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not sign certificate")
+	}
+	return certificate, nil
+}
+
+// certificateFileName returns the name of the file the certificate of the key
+// is written to, from its fingerprint made safe for file names
+func certificateFileName(key ssh.PublicKey) string {
+	fingerprint := strings.TrimPrefix(ssh.FingerprintSHA256(key), "SHA256:")
+	return strings.NewReplacer("+", "-", "/", "_").Replace(fingerprint) + "-cert.pub"
+}
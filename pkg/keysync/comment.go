@@ -0,0 +1,133 @@
+package keysync
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMarker starts the comment marking a synced key, which is
+	// followed by the source, username, the date the key was first synced
+	// and its fingerprint, e.g.
+	// sgsk:github:alice:2024-05-01:SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s
+	DefaultMarker = "sgsk"
+	// legacyComment marked synced keys before the structured comment, with
+	// the username optionally appended after a colon
+	legacyComment = "synced from github"
+
+	syncedOnFormat = "2006-01-02"
+)
+
+// syncComment is the information recorded in the comment of a synced key
+type syncComment struct {
+	source   string
+	username string
+	// syncedOn is the date the key was first synced for the user
+	syncedOn string
+}
+
+// comment returns the authorized keys comment used to mark the key as synced
+func (s *Syncer) comment(key syncedKey) string {
+	syncedOn := key.syncedOn
+	if syncedOn == "" {
+		syncedOn = time.Now().UTC().Format(syncedOnFormat)
+	}
+
+	source, username := s.splitUsername(key.username)
+	comment := s.marker() + ":" + source + ":" + username + ":" + syncedOn
+	if fingerprint := fingerprint(key.Key); fingerprint != "" {
+		comment += ":" + fingerprint
+	}
+	return comment
+}
+
+func (s *Syncer) marker() string {
+	if s.Marker == "" {
+		return DefaultMarker
+	}
+	return s.Marker
+}
+
+func (s *Syncer) sourceName() string {
+	if s.SourceName == "" {
+		return "github"
+	}
+	return s.SourceName
+}
+
+// parseSyncComment checks if the comment of an authorized keys line marks it
+// as synced by us, with the current or a previous marker, and if so what it
+// records. Keys synced before usernames were tracked have an empty username,
+// and those synced from sources other than the default one have it qualified
+// with the source, as they're fetched.
+func (s *Syncer) parseSyncComment(comment string) (syncComment, bool) {
+	if comment == legacyComment {
+		return syncComment{}, true
+	}
+	if strings.HasPrefix(comment, legacyComment+":") {
+		return syncComment{username: strings.TrimPrefix(comment, legacyComment+":")}, true
+	}
+
+	for _, marker := range append([]string{s.marker()}, s.PreviousMarkers...) {
+		if strings.HasPrefix(comment, marker+":") {
+			parsed, ok := parseMarkedComment(strings.TrimPrefix(comment, marker+":"))
+			if ok && parsed.username != "" {
+				parsed.username = s.qualifyUsername(parsed.source, parsed.username)
+			}
+			return parsed, ok
+		}
+	}
+	return syncComment{}, false
+}
+
+// parseMarkedComment parses the fields of a comment following its marker
+func parseMarkedComment(rest string) (syncComment, bool) {
+	// usernames can contain colons, e.g. file:// sources, so the username is
+	// whatever is left once the other fields are removed from either end
+	i := strings.Index(rest, ":")
+	if i == -1 {
+		return syncComment{}, false
+	}
+	parsed := syncComment{source: rest[:i]}
+	rest = rest[i+1:]
+	if i := strings.Index(rest, ":SHA256:"); i != -1 {
+		rest = rest[:i]
+	}
+	i = strings.LastIndex(rest, ":")
+	if i == -1 {
+		return syncComment{}, false
+	}
+	parsed.username, parsed.syncedOn = rest[:i], rest[i+1:]
+	return parsed, true
+}
+
+// ValidMarker checks that the marker can be used to mark synced keys
+func ValidMarker(marker string) bool {
+	return marker != "" && !strings.ContainsAny(marker, ": \t\r\n")
+}
+
+// fingerprint returns the SHA256 fingerprint of the key, in the format
+// ssh-keygen -l prints, or nothing if the key can't be decoded
+func fingerprint(key string) string {
+	parts := strings.Fields(key)
+	if len(parts) < 2 {
+		return ""
+	}
+	blob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// keyID returns the fingerprint of the key to identify it in logs, or the key
+// itself if it can't be decoded
+func keyID(key string) string {
+	if fingerprint := fingerprint(key); fingerprint != "" {
+		return fingerprint
+	}
+	return key
+}
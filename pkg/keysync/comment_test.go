@@ -0,0 +1,164 @@
+package keysync
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEd25519Key = "ssh-ed25519 " + testEd25519Blob
+
+func TestSyncCommentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		syncer *Syncer
+		key    syncedKey
+		want   syncComment
+	}{
+		{
+			name:   "default source",
+			syncer: &Syncer{},
+			key:    syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "alice", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "github", username: "alice", syncedOn: "2024-05-01"},
+		},
+		{
+			name:   "named source",
+			syncer: &Syncer{SourceName: "gitlab"},
+			key:    syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "alice", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "gitlab", username: "alice", syncedOn: "2024-05-01"},
+		},
+		{
+			name:   "qualified username",
+			syncer: &Syncer{Sources: []string{"gitlab", "url"}},
+			key:    syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "gitlab:bob", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "gitlab", username: "gitlab:bob", syncedOn: "2024-05-01"},
+		},
+		{
+			name:   "username with colons",
+			syncer: &Syncer{Sources: []string{"url"}},
+			key:    syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "url:https://keys.example.com:8443/team.keys", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "url", username: "url:https://keys.example.com:8443/team.keys", syncedOn: "2024-05-01"},
+		},
+		{
+			name:   "local file",
+			syncer: &Syncer{},
+			key:    syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "file:///etc/ssh/break-glass.keys", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "github", username: "file:///etc/ssh/break-glass.keys", syncedOn: "2024-05-01"},
+		},
+		{
+			name:   "key without a fingerprint",
+			syncer: &Syncer{},
+			key:    syncedKey{PublicKey: PublicKey{Key: "ssh-ed25519 not-base64!"}, username: "alice", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "github", username: "alice", syncedOn: "2024-05-01"},
+		},
+		{
+			name:   "custom marker",
+			syncer: &Syncer{Marker: "corp"},
+			key:    syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "alice", syncedOn: "2024-05-01"},
+			want:   syncComment{source: "github", username: "alice", syncedOn: "2024-05-01"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			comment := test.syncer.comment(test.key)
+			if !strings.HasPrefix(comment, test.syncer.marker()+":") {
+				t.Errorf("comment() = %q, want it to start with marker %q", comment, test.syncer.marker())
+			}
+			if strings.ContainsAny(comment, " \t") {
+				t.Errorf("comment() = %q, which contains whitespace", comment)
+			}
+			got, ok := test.syncer.parseSyncComment(comment)
+			if !ok {
+				t.Fatalf("parseSyncComment(%q) didn't parse", comment)
+			}
+			if got != test.want {
+				t.Errorf("parseSyncComment(%q) = %+v, want %+v", comment, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSyncCommentFingerprint(t *testing.T) {
+	syncer := &Syncer{}
+	comment := syncer.comment(syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "alice", syncedOn: "2024-05-01"})
+	want := "sgsk:github:alice:2024-05-01:" + fingerprint(testEd25519Key)
+	if comment != want {
+		t.Errorf("comment() = %q, want %q", comment, want)
+	}
+}
+
+func TestSyncCommentDefaultsToToday(t *testing.T) {
+	syncer := &Syncer{}
+	comment := syncer.comment(syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "alice"})
+	parsed, ok := syncer.parseSyncComment(comment)
+	if !ok {
+		t.Fatalf("parseSyncComment(%q) didn't parse", comment)
+	}
+	// the date may have changed since the comment was made
+	today, earlier := time.Now().UTC(), time.Now().UTC().Add(-time.Minute)
+	if parsed.syncedOn != today.Format(syncedOnFormat) && parsed.syncedOn != earlier.Format(syncedOnFormat) {
+		t.Errorf("syncedOn = %q, want today, %v", parsed.syncedOn, today.Format(syncedOnFormat))
+	}
+}
+
+func TestParseSyncCommentPreviousMarkers(t *testing.T) {
+	old := &Syncer{}
+	comment := old.comment(syncedKey{PublicKey: PublicKey{Key: testEd25519Key}, username: "alice", syncedOn: "2024-05-01"})
+
+	remarked := &Syncer{Marker: "corp", PreviousMarkers: []string{"legacy", DefaultMarker}}
+	got, ok := remarked.parseSyncComment(comment)
+	want := syncComment{source: "github", username: "alice", syncedOn: "2024-05-01"}
+	if !ok || got != want {
+		t.Errorf("parseSyncComment(%q) with previous markers = %+v, %v, want %+v, true", comment, got, ok, want)
+	}
+
+	// keys marked with a marker that's been dropped aren't ours any more
+	other := &Syncer{Marker: "corp"}
+	if got, ok := other.parseSyncComment(comment); ok {
+		t.Errorf("parseSyncComment(%q) without previous markers = %+v, want it to not parse", comment, got)
+	}
+}
+
+func TestParseSyncCommentLegacy(t *testing.T) {
+	syncer := &Syncer{}
+	tests := []struct {
+		comment string
+		want    syncComment
+	}{
+		{"synced from github", syncComment{}},
+		{"synced from github:alice", syncComment{username: "alice"}},
+	}
+
+	for _, test := range tests {
+		got, ok := syncer.parseSyncComment(test.comment)
+		if !ok || got != test.want {
+			t.Errorf("parseSyncComment(%q) = %+v, %v, want %+v, true", test.comment, got, ok, test.want)
+		}
+	}
+}
+
+func TestParseSyncCommentOtherTools(t *testing.T) {
+	syncer := &Syncer{}
+	comments := []string{
+		"",
+		"alice@laptop",
+		"alice@laptop:work",
+		"sgsk",
+		"sgsk:",
+		"sgsk:github",
+		"sgsk:github:alice",
+		"sgskx:github:alice:2024-05-01",
+		"SGSK:github:alice:2024-05-01",
+		"xsgsk:github:alice:2024-05-01",
+		"managed by terraform",
+		"synced from gitlab:alice",
+		"synced from github alice",
+	}
+
+	for _, comment := range comments {
+		if got, ok := syncer.parseSyncComment(comment); ok {
+			t.Errorf("parseSyncComment(%q) = %+v, want it to not parse", comment, got)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ConsulKV is a consul agent or server's key-value store. Requests are
+// authenticated with the token in CONSUL_HTTP_TOKEN, if it's set, as for the
+// consul cli.
+type ConsulKV struct {
+	// URL is the base url of the consul HTTP API, e.g.
+	// http://127.0.0.1:8500
+	URL    string
+	Client *http.Client
+}
+
+// consulKVPair is an entry of the response to reading a key
+type consulKVPair struct {
+	ModifyIndex uint64
+	// Value is base64 encoded, which encoding/json decodes, and null if
+	// the value is empty
+	Value []byte
+}
+
+// String names the store as its keys' urls do, e.g.
+// consul+https://consul.example.com:8500
+func (c *ConsulKV) String() string {
+	if strings.HasPrefix(c.URL, "https://") {
+		return "consul+https://" + strings.TrimPrefix(c.URL, "https://")
+	}
+	return "consul://" + strings.TrimPrefix(c.URL, "http://")
+}
+
+func (c *ConsulKV) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	resp, err := c.request(ctx, http.MethodGet, key, url.Values{}, nil)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "could not read %v/%v", c, key)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, nil
+	}
+	pairs := []consulKVPair{}
+	err = decodeJSONResponse(resp, &pairs)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "could not read %v/%v", c, key)
+	}
+	if len(pairs) == 0 {
+		return nil, 0, nil
+	}
+	value := pairs[0].Value
+	if value == nil {
+		value = []byte{}
+	}
+	return value, pairs[0].ModifyIndex, nil
+}
+
+func (c *ConsulKV) Put(ctx context.Context, key string, value []byte, revision uint64) error {
+	// a cas of 0 only sets the key if it doesn't exist
+	query := url.Values{"cas": {strconv.FormatUint(revision, 10)}}
+	resp, err := c.request(ctx, http.MethodPut, key, query, value)
+	if err != nil {
+		return errors.Wrapf(err, "could not write %v/%v", c, key)
+	}
+	set := false
+	err = decodeJSONResponse(resp, &set)
+	if err != nil {
+		return errors.Wrapf(err, "could not write %v/%v", c, key)
+	}
+	if !set {
+		return errKVConflict
+	}
+	return nil
+}
+
+// Watch makes a blocking query, which returns once the index of the key is
+// past the one given, or after kvWatchWait
+func (c *ConsulKV) Watch(ctx context.Context, key string, index uint64) (uint64, error) {
+	query := url.Values{}
+	if index != 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", kvWatchWait.String())
+	}
+	resp, err := c.request(ctx, http.MethodGet, key, query, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not watch %v/%v", c, key)
+	}
+	// the index is in a header, whether or not the key exists
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || next == 0 {
+		return 0, errors.Errorf("could not watch %v/%v: invalid X-Consul-Index %q", c, key, resp.Header.Get("X-Consul-Index"))
+	}
+	return next, nil
+}
+
+// request makes a request to the key's endpoint. Unsuccessful responses other
+// than a missing key are returned as a statusError, wrapped with the error
+// message consul responds with.
+func (c *ConsulKV) request(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := strings.TrimSuffix(c.URL, "/") + "/v1/kv/" + (&url.URL{Path: key}).EscapedPath()
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		request.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := clientOrDefault(c.Client).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		if len(bytes.TrimSpace(message)) == 0 {
+			return nil, &statusError{resp.StatusCode}
+		}
+		return nil, errors.Wrap(&statusError{resp.StatusCode}, string(bytes.TrimSpace(message)))
+	}
+	return resp, nil
+}
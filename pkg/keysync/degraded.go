@@ -0,0 +1,125 @@
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	consecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "consecutive_failures",
+		Help:      "How many syncs of the target in a row have failed.",
+	}, []string{"target"})
+	degraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "degraded",
+		Help:      "Whether syncs of the target have failed enough times in a row to be considered degraded.",
+	}, []string{"target"})
+)
+
+func init() {
+	prometheus.MustRegister(consecutiveFailures, degraded)
+	registry.MustRegister(consecutiveFailures, degraded)
+}
+
+// DefaultPagerURL is the PagerDuty Events API v2 endpoint
+const DefaultPagerURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Pager triggers and resolves alerts through an Events API v2 compatible
+// endpoint, such as PagerDuty's, to page someone when syncing is degraded
+type Pager struct {
+	// URL defaults to DefaultPagerURL
+	URL string
+	// RoutingKey is the integration key of the service to alert
+	RoutingKey string
+	Client     *http.Client
+}
+
+type pagerEvent struct {
+	RoutingKey  string        `json:"routing_key"`
+	EventAction string        `json:"event_action"`
+	DedupKey    string        `json:"dedup_key"`
+	Payload     *pagerPayload `json:"payload,omitempty"`
+}
+
+type pagerPayload struct {
+	Summary  string `json:"summary"`
+	Source   string `json:"source"`
+	Severity string `json:"severity"`
+}
+
+// trigger opens an alert, or updates the open one with the same dedup key
+func (p *Pager) trigger(dedupKey, summary string) error {
+	return p.send(pagerEvent{
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+		Payload:     &pagerPayload{Summary: summary, Source: hostname(), Severity: "critical"},
+	})
+}
+
+// resolve closes the alert with the dedup key
+func (p *Pager) resolve(dedupKey string) error {
+	return p.send(pagerEvent{EventAction: "resolve", DedupKey: dedupKey})
+}
+
+func (p *Pager) send(event pagerEvent) error {
+	u := p.URL
+	if u == "" {
+		u = DefaultPagerURL
+	}
+	event.RoutingKey = p.RoutingKey
+	// the sync has finished, so the alert isn't tied to its context
+	return postJSON(context.Background(), p.Client, http.MethodPost, u, nil, event)
+}
+
+// escalate records how many syncs in a row have failed, and once DegradedAfter
+// have, considers syncing degraded, as key revocations have stopped reaching
+// the host. The notifiers are told and the pager triggered when it becomes
+// degraded, and again when a sync succeeds.
+func (s *Syncer) escalate(failures int, err error) {
+	if err == nil {
+		consecutiveFailures.WithLabelValues(s.Name).Set(0)
+	} else {
+		consecutiveFailures.WithLabelValues(s.Name).Set(float64(failures))
+	}
+	if s.DegradedAfter <= 0 {
+		return
+	}
+
+	dedupKey := fmt.Sprintf("sync-github-ssh-keys:%v:%v", hostname(), s.Name)
+	switch {
+	case err != nil && failures >= s.DegradedAfter:
+		degraded.WithLabelValues(s.Name).Set(1)
+		if failures != s.DegradedAfter {
+			return
+		}
+		slog.Error("sync degraded", "target", s.Name, "failures", failures, "error", err)
+		s.Statsd.count("syncs.degraded", 1)
+		message := fmt.Sprintf("sync degraded: syncing keys on host %v into %v has failed %v times in a row, so key changes aren't reaching it: %v", hostname(), s.Name, failures, err)
+		s.notify(message)
+		if s.Pager != nil {
+			if err := s.Pager.trigger(dedupKey, message); err != nil {
+				slog.Error("could not page", "target", s.Name, "error", err)
+			}
+		}
+	case err == nil:
+		degraded.WithLabelValues(s.Name).Set(0)
+		if failures < s.DegradedAfter {
+			return
+		}
+		slog.Info("sync recovered", "target", s.Name, "failures", failures)
+		s.notify(fmt.Sprintf("sync recovered: syncing keys on host %v into %v succeeded again, after failing %v times in a row", hostname(), s.Name, failures))
+		if s.Pager != nil {
+			if err := s.Pager.resolve(dedupKey); err != nil {
+				slog.Error("could not resolve page", "target", s.Name, "error", err)
+			}
+		}
+	default:
+		degraded.WithLabelValues(s.Name).Set(0)
+	}
+}
@@ -0,0 +1,148 @@
+package keysync
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffOp is a line of a diff, with the index of the line in each file it
+// occurs at
+type diffOp struct {
+	kind byte
+	line string
+	a, b int
+}
+
+// writeUnifiedDiff writes a unified diff from one document to another to w.
+// Nothing is written if they are the same.
+func writeUnifiedDiff(w io.Writer, fromName, toName string, from, to []byte) error {
+	ops := diffLines(splitLines(from), splitLines(to))
+
+	wroteHeader := false
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+
+		// changes separated by less than twice the context share a hunk
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for m := k + 1; m < len(ops) && m <= end+2*diffContext; m++ {
+			if ops[m].kind != ' ' {
+				end = m
+			}
+		}
+		stop := end + diffContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		if !wroteHeader {
+			_, err := fmt.Fprintf(w, "--- %v\n+++ %v\n", fromName, toName)
+			if err != nil {
+				return errors.Wrap(err, "could not write diff")
+			}
+			wroteHeader = true
+		}
+		err := writeHunk(w, ops[start:stop])
+		if err != nil {
+			return err
+		}
+		k = stop
+	}
+	return nil
+}
+
+func writeHunk(w io.Writer, ops []diffOp) error {
+	aLen, bLen := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			aLen++
+		}
+		if op.kind != '-' {
+			bLen++
+		}
+	}
+	// empty ranges start at the line before them
+	aStart, bStart := ops[0].a, ops[0].b
+	if aLen != 0 {
+		aStart++
+	}
+	if bLen != 0 {
+		bStart++
+	}
+
+	_, err := fmt.Fprintf(w, "@@ -%v,%v +%v,%v @@\n", aStart, aLen, bStart, bLen)
+	if err != nil {
+		return errors.Wrap(err, "could not write diff")
+	}
+	for _, op := range ops {
+		line := op.line
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n\\ No newline at end of file\n"
+		}
+		_, err := fmt.Fprintf(w, "%c%v", op.kind, line)
+		if err != nil {
+			return errors.Wrap(err, "could not write diff")
+		}
+	}
+	return nil
+}
+
+// splitLines splits the document into lines, keeping their line endings
+func splitLines(doc []byte) []string {
+	lines := strings.SplitAfter(string(doc), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the edits turning a into b, found from their longest
+// common subsequence. authorized_keys files are small, so the quadratic
+// table is fine.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return ops
+}
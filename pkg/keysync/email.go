@@ -0,0 +1,113 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// smtpTimeout bounds how long sending an email can take, as the smtp package
+// has no timeouts of its own
+const smtpTimeout = time.Minute
+
+// EmailNotifier emails messages through an SMTP server, for environments
+// without chat webhooks. STARTTLS is used if the server supports it, and is
+// required to authenticate unless the server is on localhost.
+type EmailNotifier struct {
+	// Addr is the server's host and port, e.g. smtp.example.com:587
+	Addr string
+	From string
+	To   []string
+	// Username and Password, if set, are used to authenticate with PLAIN
+	Username string
+	Password string
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, message string) error {
+	host, _, err := net.SplitHostPort(n.Addr)
+	if err != nil {
+		return errors.Wrap(err, "invalid smtp address")
+	}
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return errors.Wrap(err, "could not connect to smtp server")
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "could not connect to smtp server")
+	}
+	defer client.Close()
+	err = n.send(client, host, message)
+	if err != nil {
+		return errors.Wrap(err, "could not send email")
+	}
+	return client.Quit()
+}
+
+func (n *EmailNotifier) send(client *smtp.Client, host, message string) error {
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err := client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err := client.Mail(n.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		err := client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(n.email(message))
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// email formats the message as an email, with its first line as the subject
+func (n *EmailNotifier) email(message string) []byte {
+	lines := strings.Split(message, "\n")
+	subject := lines[0]
+	if len(lines) > 1 {
+		subject += fmt.Sprintf(" and %v more", len(lines)-1)
+	}
+
+	email := bytes.NewBuffer(nil)
+	fmt.Fprintf(email, "From: %v\r\n", n.From)
+	fmt.Fprintf(email, "To: %v\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(email, "Subject: %v\r\n", subject)
+	fmt.Fprintf(email, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(email, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, line := range lines {
+		email.WriteString(line + "\r\n")
+	}
+	return email.Bytes()
+}
@@ -0,0 +1,237 @@
+package keysync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EtcdKV is an etcd cluster's key-value store, used through the JSON gateway
+// to its v3 API. If ETCDCTL_USER is set, as user:password as for etcdctl,
+// requests are authenticated as that user.
+type EtcdKV struct {
+	// URL is the base url of an etcd member, e.g. http://127.0.0.1:2379
+	URL    string
+	Client *http.Client
+}
+
+// etcdHeader is the header of every response, where int64s are strings
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdKeyValue struct {
+	// Key and Value are base64 encoded, which encoding/json decodes
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	KVs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// etcdWatchResponse is each message streamed in response to a watch
+type etcdWatchResponse struct {
+	Result struct {
+		Header          etcdHeader `json:"header"`
+		Canceled        bool       `json:"canceled"`
+		CompactRevision string     `json:"compact_revision"`
+		CancelReason    string     `json:"cancel_reason"`
+		Events          []struct {
+			KV etcdKeyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *etcdError `json:"error"`
+}
+
+// etcdError is the body of an error response from the gateway
+type etcdError struct {
+	Message string `json:"message"`
+}
+
+// String names the store as its keys' urls do, e.g.
+// etcd+https://etcd.example.com:2379
+func (e *EtcdKV) String() string {
+	if strings.HasPrefix(e.URL, "https://") {
+		return "etcd+https://" + strings.TrimPrefix(e.URL, "https://")
+	}
+	return "etcd://" + strings.TrimPrefix(e.URL, "http://")
+}
+
+func (e *EtcdKV) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	response := etcdRangeResponse{}
+	err := e.request(ctx, "/v3/kv/range", map[string]interface{}{"key": []byte(key)}, &response)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "could not read %v/%v", e, key)
+	}
+	if len(response.KVs) == 0 {
+		return nil, 0, nil
+	}
+	revision, err := strconv.ParseUint(response.KVs[0].ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "could not read %v/%v: invalid revision", e, key)
+	}
+	value := response.KVs[0].Value
+	if value == nil {
+		value = []byte{}
+	}
+	return value, revision, nil
+}
+
+// Put sets the key in a transaction comparing its revision, which is 0 if
+// the key doesn't exist
+func (e *EtcdKV) Put(ctx context.Context, key string, value []byte, revision uint64) error {
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":          []byte(key),
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": strconv.FormatUint(revision, 10),
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]interface{}{"key": []byte(key), "value": value},
+		}},
+	}
+	response := etcdTxnResponse{}
+	err := e.request(ctx, "/v3/kv/txn", txn, &response)
+	if err != nil {
+		return errors.Wrapf(err, "could not write %v/%v", e, key)
+	}
+	if !response.Succeeded {
+		return errKVConflict
+	}
+	return nil
+}
+
+// Watch watches the key from the revision after the index, returning the
+// revision of the first change, or the index if there's none within
+// kvWatchWait
+func (e *EtcdKV) Watch(ctx context.Context, key string, index uint64) (uint64, error) {
+	if index == 0 {
+		response := etcdRangeResponse{}
+		err := e.request(ctx, "/v3/kv/range", map[string]interface{}{"key": []byte(key), "count_only": true}, &response)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not watch %v/%v", e, key)
+		}
+		return strconv.ParseUint(response.Header.Revision, 10, 64)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kvWatchWait)
+	defer cancel()
+	watch := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(key),
+			"start_revision": strconv.FormatUint(index+1, 10),
+		},
+	}
+	resp, err := e.post(ctx, "/v3/watch", watch)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not watch %v/%v", e, key)
+	}
+	defer resp.Body.Close()
+
+	// responses are streamed as a JSON object per line, the first
+	// confirming the watch was created
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		response := etcdWatchResponse{}
+		err := json.Unmarshal(scanner.Bytes(), &response)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not watch %v/%v: could not decode response", e, key)
+		}
+		result := response.Result
+		switch {
+		case response.Error != nil:
+			return 0, errors.Errorf("could not watch %v/%v: %v", e, key, response.Error.Message)
+		case result.CompactRevision != "" && result.CompactRevision != "0":
+			// the revisions since the index were compacted, so the key
+			// may have changed since, and is watched from now on
+			return strconv.ParseUint(result.Header.Revision, 10, 64)
+		case result.Canceled:
+			return 0, errors.Errorf("could not watch %v/%v: watch was cancelled: %v", e, key, result.CancelReason)
+		case len(result.Events) != 0:
+			return strconv.ParseUint(result.Events[len(result.Events)-1].KV.ModRevision, 10, 64)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return index, nil
+	}
+	if scanner.Err() != nil {
+		return 0, errors.Wrapf(scanner.Err(), "could not watch %v/%v", e, key)
+	}
+	return 0, errors.Errorf("could not watch %v/%v: watch ended", e, key)
+}
+
+// request makes a request to an endpoint of the gateway, and decodes the
+// response into v
+func (e *EtcdKV) request(ctx context.Context, endpoint string, body, v interface{}) error {
+	resp, err := e.post(ctx, endpoint, body)
+	if err != nil {
+		return err
+	}
+	return decodeJSONResponse(resp, v)
+}
+
+// post makes a request to an endpoint of the gateway, authenticating first if
+// ETCDCTL_USER is set. Unsuccessful responses are returned as a statusError,
+// wrapped with the error message.
+func (e *EtcdKV) post(ctx context.Context, endpoint string, body interface{}) (*http.Response, error) {
+	token := ""
+	if user := os.Getenv("ETCDCTL_USER"); user != "" && endpoint != "/v3/auth/authenticate" {
+		parts := strings.SplitN(user, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("ETCDCTL_USER must be user:password")
+		}
+		// tokens expire after a few minutes, so one is fetched for each
+		// request rather than kept
+		auth := struct {
+			Token string `json:"token"`
+		}{}
+		err := e.request(ctx, "/v3/auth/authenticate", map[string]string{"name": parts[0], "password": parts[1]}, &auth)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not authenticate")
+		}
+		token = auth.Token
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode request")
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.URL, "/")+endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+	resp, err := clientOrDefault(e.Client).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		failure := etcdError{}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if failure.Message == "" {
+			return nil, &statusError{resp.StatusCode}
+		}
+		return nil, errors.Wrap(&statusError{resp.StatusCode}, failure.Message)
+	}
+	return resp, nil
+}
@@ -0,0 +1,116 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Event types sent to an EventWebhook
+const (
+	EventKeysChanged   = "keys_changed"
+	EventSyncFailing   = "sync_failing"
+	EventSyncRecovered = "sync_recovered"
+)
+
+// Event is the JSON body POSTed to an EventWebhook
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// File is the Name of the syncer the event is for
+	File string `json:"file"`
+	// Changes are the keys added and removed, for keys_changed events
+	Changes []KeyChange `json:"changes,omitempty"`
+	// Failures is how many syncs in a row have failed, and Error why the
+	// last one did, for sync_failing and sync_recovered events
+	Failures int    `json:"failures,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// EventWebhook POSTs an Event to a url whenever keys change, and when syncs
+// start and stop failing repeatedly, for SIEMs to ingest. Each request is
+// signed with an HMAC-SHA256 of its body keyed by the secret, sent in the
+// X-Signature-256 header as sha256=<hex>, as github signs its webhooks.
+type EventWebhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+	// Failures is how many syncs in a row must fail before a sync_failing
+	// event is sent
+	Failures int
+
+	host string
+}
+
+// NewEventWebhook returns a webhook that POSTs events to url
+func NewEventWebhook(url, secret string, failures int, client *http.Client) *EventWebhook {
+	return &EventWebhook{URL: url, Secret: secret, Failures: failures, Client: client, host: hostname()}
+}
+
+// send POSTs the event, if there is a webhook. Events are sent after the
+// fact, so failures are only logged.
+func (w *EventWebhook) send(event Event) {
+	if w == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Host = w.host
+	err := w.post(event)
+	if err != nil {
+		slog.Error("could not send event", "type", event.Type, "target", event.File, "error", err)
+	}
+}
+
+func (w *EventWebhook) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "could not encode event")
+	}
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+
+	// the sync has finished, so the event isn't tied to its context
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid event webhook url")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := clientOrDefault(w.Client).Do(request)
+	if err != nil {
+		return errors.Wrap(err, "could not post event")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("event webhook responded with %v", resp.Status)
+	}
+	return nil
+}
+
+// sendFailureEvents sends a sync_failing event when the sync that just
+// finished is the Failures'th in a row to fail, and a sync_recovered event
+// when a sync succeeds after one was sent
+func (s *Syncer) sendFailureEvents(failures int, err error) {
+	if s.Events == nil || s.Events.Failures <= 0 {
+		return
+	}
+	if err != nil && failures == s.Events.Failures {
+		s.Events.send(Event{Type: EventSyncFailing, File: s.Name, Failures: failures, Error: err.Error()})
+	}
+	if err == nil && failures >= s.Events.Failures {
+		s.Events.send(Event{Type: EventSyncRecovered, File: s.Name, Failures: failures})
+	}
+}
@@ -0,0 +1,41 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// ExecSource fetches keys by running an external command with the username
+// appended to its arguments. The command should print either a JSON array of
+// keys (objects with at least a "key" field), or keys in authorized_keys
+// format, one per line. A non zero exit status is treated as a failure.
+type ExecSource struct {
+	Command []string
+}
+
+func (c *ExecSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	args := append(append([]string{}, c.Command[1:]...), username)
+	cmd := exec.CommandContext(ctx, c.Command[0], args...)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not run %v", c.Command[0])
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(output), []byte("[")) {
+		publicKeys := []PublicKey{}
+		err := json.Unmarshal(output, &publicKeys)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode command output")
+		}
+		return publicKeys, nil
+	}
+
+	return parseKeysDocument(output), nil
+}
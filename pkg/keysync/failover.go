@@ -0,0 +1,43 @@
+package keysync
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+)
+
+// FailoverSource fetches keys from each of Sources in turn until one
+// succeeds, e.g. from an internal caching mirror and then github itself, so
+// keys can be fetched while either is down
+type FailoverSource struct {
+	Sources []Source
+	// Names identify the sources in logs, e.g. by their urls
+	Names []string
+}
+
+func (f *FailoverSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	var err error
+	for i, source := range f.Sources {
+		var keys []PublicKey
+		keys, err = source.GetKeys(ctx, username)
+		if err == nil {
+			return keys, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i != len(f.Sources)-1 {
+			slog.Warn("could not get public keys, failing over to the next source", "user", username, "source", f.name(i), "error", err)
+		}
+	}
+	// the last source is the one of last resort, so its error is the most
+	// telling, e.g. if it doesn't know of the user
+	return nil, err
+}
+
+func (f *FailoverSource) name(i int) string {
+	if i < len(f.Names) {
+		return f.Names[i]
+	}
+	return strconv.Itoa(i)
+}
@@ -0,0 +1,46 @@
+package keysync
+
+import (
+	"log/slog"
+	"time"
+)
+
+// lastFetcher is implemented by sources that remember when they last fetched
+// a user's keys, across restarts
+type lastFetcher interface {
+	LastFetched(username string) time.Time
+}
+
+// expired checks if the user's keys, which just failed to be fetched, haven't
+// been fetched for longer than FailTTL
+func (s *Syncer) expired(username string, now time.Time) bool {
+	if s.FailTTL == 0 {
+		return false
+	}
+	last := s.lastFetched(username)
+	if now.Sub(last) <= s.FailTTL {
+		return false
+	}
+
+	if s.FailClosed {
+		slog.Error("keys not fetched for longer than the fail ttl, removing synced keys to fail closed", "user", username, "last_fetched", last.Format(time.RFC3339))
+	} else {
+		slog.Warn("keys not fetched for longer than the fail ttl, keeping synced keys to fail open", "user", username, "last_fetched", last.Format(time.RFC3339))
+	}
+	return true
+}
+
+// lastFetched returns when the user's keys were last fetched, or if they
+// never have been, when the first sync started
+func (s *Syncer) lastFetched(username string) time.Time {
+	last := s.Status().UserLastFetched[username]
+	if source, ok := s.Source.(lastFetcher); ok {
+		if fetched := source.LastFetched(username); fetched.After(last) {
+			last = fetched
+		}
+	}
+	if last.IsZero() {
+		return s.started
+	}
+	return last
+}
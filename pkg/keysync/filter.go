@@ -0,0 +1,158 @@
+package keysync
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyTypeAliases maps the short names key types can be allowed by to the key
+// types they cover
+var keyTypeAliases = map[string][]string{
+	"rsa":        {"ssh-rsa"},
+	"dsa":        {"ssh-dss"},
+	"ed25519":    {"ssh-ed25519"},
+	"ecdsa":      {"ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521"},
+	"sk-ed25519": {"sk-ssh-ed25519@openssh.com"},
+	"sk-ecdsa":   {"sk-ecdsa-sha2-nistp256@openssh.com"},
+}
+
+// keyFilter holds the fingerprint lists keys are checked against, which are
+// read on each sync so changes take effect without restarting
+type keyFilter struct {
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+func (s *Syncer) loadKeyFilter() (*keyFilter, error) {
+	filter := &keyFilter{}
+	var err error
+	if s.AllowedFingerprintsFile != "" {
+		filter.allowed, err = readFingerprints(s.AllowedFingerprintsFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read allowed fingerprints")
+		}
+	}
+	if s.DeniedFingerprintsFile != "" {
+		filter.denied, err = readFingerprints(s.DeniedFingerprintsFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read denied fingerprints")
+		}
+	}
+	return filter, nil
+}
+
+// readFingerprints reads a file listing SHA256 fingerprints, one per line.
+// Anything else on a line is ignored, so the output of ssh-keygen -l can be
+// used as is, along with # comments. Lines can also be public keys, as in
+// authorized_keys or a .pub file, which stand for their fingerprints.
+func readFingerprints(path string) (map[string]bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := map[string]bool{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if parsed, ok := parseAuthorizedKeysLine(line); ok {
+			if fingerprint := fingerprint(parsed.key()); fingerprint != "" {
+				fingerprints[fingerprint] = true
+				continue
+			}
+		}
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "SHA256:") {
+				fingerprints[field] = true
+				break
+			}
+		}
+	}
+	return fingerprints, nil
+}
+
+// checkKey parses the key, returning it without any comment, or an error
+// explaining why it can't be synced if it's malformed or isn't allowed
+func (s *Syncer) checkKey(key string, filter *keyFilter) (string, error) {
+	// anything that isn't a single plain key could smuggle options or extra
+	// keys into the authorized keys file
+	publicKey, _, options, rest, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", errors.Wrap(err, "malformed key")
+	}
+	if len(options) != 0 {
+		return "", errors.New("key has options")
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return "", errors.New("key spans more than one line")
+	}
+	keyType := publicKey.Type()
+
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+	if filter.denied[fingerprint] {
+		return "", errors.New("fingerprint is denied")
+	}
+	if filter.allowed != nil && !filter.allowed[fingerprint] {
+		return "", errors.New("fingerprint is not allowed")
+	}
+
+	if len(s.AllowedKeyTypes) != 0 && !keyTypeAllowed(keyType, s.AllowedKeyTypes) {
+		return "", errors.Errorf("key type %v is not allowed", keyType)
+	}
+
+	if cryptoKey, ok := publicKey.(ssh.CryptoPublicKey); ok && s.MinRSABits != 0 {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < s.MinRSABits {
+			return "", errors.Errorf("%v bit rsa key is shorter than the minimum of %v bits", rsaKey.N.BitLen(), s.MinRSABits)
+		}
+	}
+
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(publicKey))), nil
+}
+
+// removeDenied removes the lines of keys with denied fingerprints from the
+// authorized keys file, whether or not they were synced
+func removeDenied(contents []byte, denied map[string]bool) []byte {
+	if len(denied) == 0 {
+		return contents
+	}
+	output := bytes.NewBuffer(nil)
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		if parsed, ok := parseAuthorizedKeysLine(strings.TrimRight(line, "\r\n")); ok {
+			if fingerprint := fingerprint(parsed.key()); denied[fingerprint] {
+				slog.Warn("removing denied key", "action", "remove", "fingerprint", fingerprint, "key", parsed.key())
+				continue
+			}
+		}
+		output.WriteString(line)
+	}
+	return output.Bytes()
+}
+
+func keyTypeAllowed(keyType string, allowed []string) bool {
+	for _, name := range allowed {
+		if name == keyType {
+			return true
+		}
+		for _, aliased := range keyTypeAliases[name] {
+			if aliased == keyType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidKeyType checks that the name is a key type or a short name for key
+// types that can be allowed, e.g. ed25519
+func ValidKeyType(name string) bool {
+	_, ok := keyTypeAliases[name]
+	return ok || isKeyType(name)
+}
@@ -0,0 +1,237 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultGCPComputeURL is the base url of the GCP compute API
+	DefaultGCPComputeURL = "https://compute.googleapis.com/compute/v1"
+	// defaultGCEMetadataHost is the GCE metadata server, which the token of
+	// the instance's service account is fetched from when no service account
+	// key is given
+	defaultGCEMetadataHost = "metadata.google.internal"
+	// gcpComputeScope is the OAuth scope requested for service account keys
+	gcpComputeScope = "https://www.googleapis.com/auth/compute"
+)
+
+// gcpCredentials fetches and renews the access tokens authenticating requests
+// to GCP APIs, with the service account key in GOOGLE_APPLICATION_CREDENTIALS,
+// or failing that as the service account of the instance running, as the
+// google client libraries do
+type gcpCredentials struct {
+	Client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcpServiceAccountKey is the subset of a service account key file needed
+type gcpServiceAccountKey struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// accessToken returns a token valid for at least a few more minutes
+func (c *gcpCredentials) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expires) > 5*time.Minute {
+		return c.token, nil
+	}
+
+	token := gcpToken{}
+	key, err := readGCPServiceAccountKey()
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		err = c.exchangeServiceAccountKey(ctx, key, &token)
+	} else {
+		var encoded string
+		encoded, err = getGCEMetadata(ctx, "instance/service-accounts/default/token")
+		if err == nil {
+			err = json.Unmarshal([]byte(encoded), &token)
+		}
+		err = errors.Wrap(err, "could not get a token for the instance's service account, and GOOGLE_APPLICATION_CREDENTIALS isn't set")
+	}
+	if err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no gcp access token was returned")
+	}
+	c.token, c.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return c.token, nil
+}
+
+// exchangeServiceAccountKey gets a token for the service account by signing a
+// JWT with its key
+func (c *gcpCredentials) exchangeServiceAccountKey(ctx context.Context, key *gcpServiceAccountKey, token *gcpToken) error {
+	privateKey, err := parseRSAPrivateKey([]byte(key.PrivateKey))
+	if err != nil {
+		return errors.Wrap(err, "could not parse service account key")
+	}
+	tokenURI := key.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	now := time.Now()
+	assertion, err := signJWT(privateKey, map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": gcpComputeScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "invalid token uri")
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := clientOrDefault(c.Client).Do(request)
+	if err != nil {
+		return errors.Wrap(err, "could not get a token for the service account")
+	}
+	return errors.Wrap(decodeJSONResponse(resp, token), "could not get a token for the service account")
+}
+
+// readGCPServiceAccountKey reads the service account key file in
+// GOOGLE_APPLICATION_CREDENTIALS, returning nil if it isn't set
+func readGCPServiceAccountKey() (*gcpServiceAccountKey, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return nil, nil
+	}
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	key := &gcpServiceAccountKey{}
+	err = json.Unmarshal(encoded, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if key.Type != "service_account" {
+		return nil, errors.Errorf("GOOGLE_APPLICATION_CREDENTIALS is a %v, rather than a service account key", key.Type)
+	}
+	return key, nil
+}
+
+// GCPProject returns the project of the service account key in
+// GOOGLE_APPLICATION_CREDENTIALS, or failing that the project of the instance
+// running
+func GCPProject(ctx context.Context) (string, error) {
+	key, err := readGCPServiceAccountKey()
+	if err != nil {
+		return "", err
+	}
+	if key != nil && key.ProjectID != "" {
+		return key.ProjectID, nil
+	}
+	project, err := getGCEMetadata(ctx, "project/project-id")
+	if err != nil {
+		return "", errors.Wrap(err, "could not get the gcp project from GOOGLE_APPLICATION_CREDENTIALS or the metadata server")
+	}
+	return strings.TrimSpace(project), nil
+}
+
+// getGCEMetadata gets an item from the GCE metadata server. GCE_METADATA_HOST
+// overrides where the server is, as for the google client libraries.
+func getGCEMetadata(ctx context.Context, item string) (string, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/"+item, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid metadata server url")
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+	resp, err := imdsClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read metadata")
+	}
+	return string(body), nil
+}
+
+// gcpErrorResponse is the body of an error response from a GCP API
+type gcpErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// gcpRequest makes an authenticated request to a GCP API, encoding body as
+// JSON if it isn't nil, and decodes the response into v. Unsuccessful
+// responses are returned as a statusError, wrapped with the error message.
+func gcpRequest(ctx context.Context, client *http.Client, credentials *gcpCredentials, method, u string, body, v interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "could not encode request")
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(encoded))
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	token, err := credentials.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := clientOrDefault(client).Do(request)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		failure := gcpErrorResponse{}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if failure.Error.Message == "" {
+			return &statusError{resp.StatusCode}
+		}
+		return errors.Wrap(&statusError{resp.StatusCode}, failure.Error.Message)
+	}
+	return decodeJSONResponse(resp, v)
+}
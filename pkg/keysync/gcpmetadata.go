@@ -0,0 +1,244 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// gcpSSHKeysKey is the metadata entry GCE's guest environment reads ssh keys
+// from, as username:key lines
+const gcpSSHKeysKey = "ssh-keys"
+
+// GCPMetadataTarget is the ssh-keys entry of a GCP project's metadata, or of an
+// instance's, which GCE's guest environment writes into the authorized_keys
+// files of the users on the project's instances, creating them if needed.
+// Synced keys are the entry's lines for OSUser, while the lines of other
+// users are left as they are. Metadata is replaced as a whole with the
+// compute API, and the update is abandoned if it changed since it was read.
+type GCPMetadataTarget struct {
+	// Project defaults to the project of the service account key in
+	// GOOGLE_APPLICATION_CREDENTIALS, or of the instance running
+	Project string
+	// Zone and Instance are the instance whose metadata is synced, if set,
+	// rather than the project's
+	Zone     string
+	Instance string
+	// OSUser is the user on the instances the keys let the users log in as
+	OSUser string
+	// URL is the base url of the compute API, defaulting to
+	// DefaultGCPComputeURL
+	URL    string
+	Client *http.Client
+
+	mu          sync.Mutex
+	credentials *gcpCredentials
+}
+
+// gcpMetadata is the metadata of a project or instance
+type gcpMetadata struct {
+	Fingerprint string            `json:"fingerprint"`
+	Items       []gcpMetadataItem `json:"items,omitempty"`
+}
+
+type gcpMetadataItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// gcpResource is the subset of a project or instance needed
+type gcpResource struct {
+	CommonInstanceMetadata *gcpMetadata `json:"commonInstanceMetadata"`
+	Metadata               *gcpMetadata `json:"metadata"`
+}
+
+// gcpOperation is a long running operation started by a change to a resource
+type gcpOperation struct {
+	Status   string `json:"status"`
+	SelfLink string `json:"selfLink"`
+	Error    *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// String names the target in logs, e.g. gcp:projects/example/metadata/ssh-keys,
+// leaving out the project until it's found if it isn't set
+func (t *GCPMetadataTarget) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name := "gcp:"
+	if t.Project != "" {
+		name += "projects/" + t.Project + "/"
+	}
+	if t.Instance != "" {
+		name += "zones/" + t.Zone + "/instances/" + t.Instance + "/"
+	}
+	return name + "metadata/" + gcpSSHKeysKey
+}
+
+func (t *GCPMetadataTarget) Update(ctx context.Context, update func(current []byte) ([]byte, error)) error {
+	metadata, err := t.read(ctx)
+	if err != nil {
+		return err
+	}
+	lines, others := t.split(metadata)
+	current := []byte(strings.Join(lines, ""))
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(current, updated) {
+		slog.Debug("metadata ssh keys are up to date", "target", t.String())
+		return nil
+	}
+
+	value := others
+	for _, line := range strings.SplitAfter(string(updated), "\n") {
+		if strings.TrimSpace(line) != "" {
+			value = append(value, t.OSUser+":"+strings.TrimRight(line, "\r\n"))
+		}
+	}
+	items := []gcpMetadataItem{}
+	for _, item := range metadata.Items {
+		if item.Key != gcpSSHKeysKey {
+			items = append(items, item)
+		}
+	}
+	if len(value) != 0 {
+		items = append(items, gcpMetadataItem{Key: gcpSSHKeysKey, Value: strings.Join(value, "\n")})
+	}
+
+	err = t.write(ctx, &gcpMetadata{Fingerprint: metadata.Fingerprint, Items: items})
+	if statusErr, ok := errors.Cause(err).(*statusError); ok && statusErr.code == http.StatusPreconditionFailed {
+		return errors.Errorf("%v changed while syncing, try again", t)
+	}
+	return err
+}
+
+// Read returns the lines of OSUser in the ssh-keys entry, in authorized_keys
+// format
+func (t *GCPMetadataTarget) Read() ([]byte, error) {
+	metadata, err := t.read(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	lines, _ := t.split(metadata)
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// split returns the lines of OSUser in the ssh-keys entry, without the
+// username and with a newline after each, and the other lines as they are
+func (t *GCPMetadataTarget) split(metadata *gcpMetadata) ([]string, []string) {
+	lines, others := []string{}, []string{}
+	for _, item := range metadata.Items {
+		if item.Key != gcpSSHKeysKey {
+			continue
+		}
+		for _, line := range strings.Split(item.Value, "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if strings.HasPrefix(line, t.OSUser+":") {
+				lines = append(lines, strings.TrimPrefix(line, t.OSUser+":")+"\n")
+			} else {
+				others = append(others, line)
+			}
+		}
+	}
+	return lines, others
+}
+
+// read fetches the metadata of the project or instance
+func (t *GCPMetadataTarget) read(ctx context.Context) (*gcpMetadata, error) {
+	u, err := t.resourceURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resource := gcpResource{}
+	err = gcpRequest(ctx, t.Client, t.credentials, http.MethodGet, u, nil, &resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get metadata of %v", t)
+	}
+	metadata := resource.CommonInstanceMetadata
+	if t.Instance != "" {
+		metadata = resource.Metadata
+	}
+	if metadata == nil {
+		// a project that's never had metadata set has none
+		metadata = &gcpMetadata{}
+	}
+	return metadata, nil
+}
+
+// write replaces the metadata of the project or instance, and waits for the
+// change to be applied
+func (t *GCPMetadataTarget) write(ctx context.Context, metadata *gcpMetadata) error {
+	u, err := t.resourceURL(ctx)
+	if err != nil {
+		return err
+	}
+	if t.Instance != "" {
+		u += "/setMetadata"
+	} else {
+		u += "/setCommonInstanceMetadata"
+	}
+	operation := gcpOperation{}
+	err = gcpRequest(ctx, t.Client, t.credentials, http.MethodPost, u, metadata, &operation)
+	if err != nil {
+		return errors.Wrapf(err, "could not set metadata of %v", t)
+	}
+
+	// waiting returns once the operation is done, or after a couple of
+	// minutes if it isn't yet
+	for operation.Status != "DONE" {
+		if operation.SelfLink == "" {
+			return errors.Errorf("could not set metadata of %v: operation has no link to wait for it with", t)
+		}
+		err = gcpRequest(ctx, t.Client, t.credentials, http.MethodPost, operation.SelfLink+"/wait", nil, &operation)
+		if err != nil {
+			return errors.Wrapf(err, "could not wait for metadata of %v to be set", t)
+		}
+	}
+	if operation.Error != nil && len(operation.Error.Errors) != 0 {
+		failure := operation.Error.Errors[0]
+		return errors.Errorf("could not set metadata of %v: %v: %v", t, failure.Code, failure.Message)
+	}
+	return nil
+}
+
+// resourceURL returns the url of the project or instance, finding the project
+// the first time if it isn't set
+func (t *GCPMetadataTarget) resourceURL(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.credentials == nil {
+		t.credentials = &gcpCredentials{Client: t.Client}
+	}
+	if t.Project == "" {
+		project, err := GCPProject(ctx)
+		if err != nil {
+			return "", err
+		}
+		t.Project = project
+	}
+
+	base := t.URL
+	if base == "" {
+		base = DefaultGCPComputeURL
+	}
+	u := strings.TrimSuffix(base, "/") + "/projects/" + url.PathEscape(t.Project)
+	if t.Instance != "" {
+		u += "/zones/" + url.PathEscape(t.Zone) + "/instances/" + url.PathEscape(t.Instance)
+	}
+	return u, nil
+}
@@ -0,0 +1,80 @@
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGiteaBaseURL is the base url of codeberg.org
+const DefaultGiteaBaseURL = "https://codeberg.org"
+
+const giteaPageSize = 50
+
+// GiteaSource fetches public keys from a gitea compatible instance, such as
+// codeberg.org or a self hosted forgejo. If Token is set, keys are fetched
+// from the API, otherwise the unauthenticated .keys endpoint is used.
+type GiteaSource struct {
+	BaseURL string
+	Token   string
+	// Client makes requests to gitea, defaulting to http.DefaultClient
+	Client *http.Client
+}
+
+func (c *GiteaSource) webURL() string {
+	if c.BaseURL == "" {
+		return DefaultGiteaBaseURL
+	}
+	return strings.TrimSuffix(c.BaseURL, "/")
+}
+
+func (c *GiteaSource) GetKeys(ctx context.Context, giteaUsername string) ([]PublicKey, error) {
+	if c.Token != "" {
+		return c.getSSHKeysFromAPI(ctx, giteaUsername)
+	}
+
+	url := fmt.Sprintf("%v/%v.keys", c.webURL(), giteaUsername)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not construct request")
+	}
+
+	return getKeysFile(clientOrDefault(c.Client), request)
+}
+
+// getSSHKeysFromAPI lists the user's keys from the gitea API. Unlike github,
+// gitea paginates by page number and expects the token in a "token"
+// authorization header.
+func (c *GiteaSource) getSSHKeysFromAPI(ctx context.Context, giteaUsername string) ([]PublicKey, error) {
+	publicKeys := []PublicKey{}
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%v/api/v1/users/%v/keys?limit=%v&page=%v", c.webURL(), giteaUsername, giteaPageSize, page)
+		request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not construct request")
+		}
+		request.Header.Set("Accept", "application/json")
+		request.Header.Set("Authorization", "token "+c.Token)
+
+		resp, err := clientOrDefault(c.Client).Do(request)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not make request")
+		}
+
+		keys := []PublicKey{}
+		err = decodeJSONResponse(resp, &keys)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, keys...)
+
+		if len(keys) < giteaPageSize {
+			break
+		}
+	}
+
+	return publicKeys, nil
+}
@@ -0,0 +1,210 @@
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGithubBaseURL is the base url of github.com
+const DefaultGithubBaseURL = "https://github.com"
+
+// GithubSource fetches public keys from github. If UseAPI is set, keys are
+// fetched from the REST API, authenticated with Token if it is non empty, or
+// as App.
+// Otherwise the unauthenticated .keys endpoint is used.
+type GithubSource struct {
+	// BaseURL is the web url of the github instance, e.g.
+	// https://github.com or https://ghe.example.com for GitHub Enterprise
+	BaseURL string
+	Token   string
+	UseAPI  bool
+	// UseGraphQL lists org and team members with the GraphQL API, which
+	// requires Token, fetching their keys in the same requests rather than
+	// one request per member
+	UseGraphQL bool
+	// App, if set, authenticates as an installation of a GitHub App rather
+	// than with Token
+	App *GithubApp
+	// Client makes requests to github, defaulting to http.DefaultClient
+	Client *http.Client
+
+	mu      sync.Mutex
+	batched map[string][]PublicKey
+}
+
+func (c *GithubSource) webURL() string {
+	if c.BaseURL == "" {
+		return DefaultGithubBaseURL
+	}
+	return strings.TrimSuffix(c.BaseURL, "/")
+}
+
+// hostname returns the hostname of the instance, e.g. github.com
+func (c *GithubSource) hostname() string {
+	u, err := url.Parse(c.webURL())
+	if err != nil || u.Hostname() == "" {
+		return "github.com"
+	}
+	return u.Hostname()
+}
+
+// apiURL returns the root of the REST API. github.com serves the API from a
+// separate host, while GitHub Enterprise serves it under /api/v3.
+func (c *GithubSource) apiURL() string {
+	if c.webURL() == DefaultGithubBaseURL {
+		return "https://api.github.com"
+	}
+	return c.webURL() + "/api/v3"
+}
+
+func (c *GithubSource) GetKeys(ctx context.Context, githubUsername string) ([]PublicKey, error) {
+	if keys, ok := c.batchedKeys(githubUsername); ok {
+		return keys, nil
+	}
+	if c.UseAPI {
+		return c.getSSHKeysFromAPI(ctx, githubUsername)
+	}
+	return c.getSSHKeysFromKeysEndpoint(ctx, githubUsername)
+}
+
+func (c *GithubSource) getSSHKeysFromKeysEndpoint(ctx context.Context, githubUsername string) ([]PublicKey, error) {
+	url := fmt.Sprintf("%v/%v.keys", c.webURL(), githubUsername)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not construct request")
+	}
+
+	return getKeysFile(clientOrDefault(c.Client), request)
+}
+
+// githubNextPageRe extracts the next page url from a Link header
+var githubNextPageRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+func (c *GithubSource) getSSHKeysFromAPI(ctx context.Context, githubUsername string) ([]PublicKey, error) {
+	url := fmt.Sprintf("%v/users/%v/keys?per_page=100", c.apiURL(), githubUsername)
+
+	publicKeys := []PublicKey{}
+	err := c.getAllPages(ctx, url, func(resp *http.Response) error {
+		page := []PublicKey{}
+		err := decodeJSONResponse(resp, &page)
+		publicKeys = append(publicKeys, page...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKeys, nil
+}
+
+// githubUsernameRe matches github usernames, rather than the usernames of
+// other sources or local files
+var githubUsernameRe = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// githubUsernames returns the github usernames among the usernames and the
+// current members, if members is set, without duplicates
+func githubUsernames(ctx context.Context, usernames []string, members func(ctx context.Context) ([]string, error)) ([]string, error) {
+	all := append([]string{}, usernames...)
+	if members != nil {
+		listed, err := members(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not list members")
+		}
+		all = append(all, listed...)
+	}
+
+	githubUsernames := []string{}
+	seen := map[string]bool{}
+	for _, username := range all {
+		if githubUsernameRe.MatchString(username) && !seen[strings.ToLower(username)] {
+			seen[strings.ToLower(username)] = true
+			githubUsernames = append(githubUsernames, username)
+		}
+	}
+	return githubUsernames, nil
+}
+
+// githubUser is the subset of a github API user object we care about
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+// OrgMembers lists the usernames of the members of a github organisation
+func (c *GithubSource) OrgMembers(ctx context.Context, org string) ([]string, error) {
+	if c.UseGraphQL {
+		return c.getMembersWithGraphQL(ctx, org, "")
+	}
+	url := fmt.Sprintf("%v/orgs/%v/members?per_page=100", c.apiURL(), org)
+	return c.getUsers(ctx, url)
+}
+
+// TeamMembers lists the usernames of the members of a team within a github
+// organisation
+func (c *GithubSource) TeamMembers(ctx context.Context, org, team string) ([]string, error) {
+	if c.UseGraphQL {
+		return c.getMembersWithGraphQL(ctx, org, team)
+	}
+	url := fmt.Sprintf("%v/orgs/%v/teams/%v/members?per_page=100", c.apiURL(), org, team)
+	return c.getUsers(ctx, url)
+}
+
+func (c *GithubSource) getUsers(ctx context.Context, url string) ([]string, error) {
+	usernames := []string{}
+	err := c.getAllPages(ctx, url, func(resp *http.Response) error {
+		page := []githubUser{}
+		err := decodeJSONResponse(resp, &page)
+		for _, user := range page {
+			usernames = append(usernames, user.Login)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usernames, nil
+}
+
+// getAllPages makes a GET request to the API, calling handlePage with each
+// response and following the Link header until the last page is reached.
+// handlePage is responsible for closing the response body.
+func (c *GithubSource) getAllPages(ctx context.Context, url string, handlePage func(*http.Response) error) error {
+	for url != "" {
+		request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return errors.Wrap(err, "could not construct request")
+		}
+		request.Header.Set("Accept", "application/vnd.github+json")
+		token, err := c.token(ctx)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := clientOrDefault(c.Client).Do(request)
+		if err != nil {
+			return errors.Wrap(err, "could not make request")
+		}
+
+		err = handlePage(resp)
+		if err != nil {
+			return err
+		}
+
+		url = ""
+		if match := githubNextPageRe.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			url = match[1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package keysync
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GithubApp authenticates to github as an installation of a GitHub App,
+// rather than with a personal access token tied to someone's account.
+// Installation tokens are requested with a JWT signed by the app's private
+// key, and renewed shortly before they expire.
+type GithubApp struct {
+	AppID      int64
+	PrivateKey *rsa.PrivateKey
+	// InstallationID is the installation to authenticate as. If unset, the
+	// installation on Org is looked up.
+	InstallationID int64
+	Org            string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// githubAppTokenMargin is how long before an installation token expires it
+// is renewed, so it doesn't expire part way through a sync
+const githubAppTokenMargin = 5 * time.Minute
+
+// ParseGithubAppKey parses the PEM encoded private key github generates for
+// an app
+func ParseGithubAppKey(encoded []byte) (*rsa.PrivateKey, error) {
+	return parseRSAPrivateKey(encoded)
+}
+
+// parseRSAPrivateKey parses a PEM encoded RSA private key, in PKCS #1 or
+// PKCS #8 form
+func parseRSAPrivateKey(encoded []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse private key")
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// token returns the token to authenticate requests to the API with, which
+// is an installation token if App is set
+func (c *GithubSource) token(ctx context.Context) (string, error) {
+	if c.App == nil {
+		return c.Token, nil
+	}
+
+	c.App.mu.Lock()
+	defer c.App.mu.Unlock()
+	if c.App.token != "" && time.Until(c.App.expires) > githubAppTokenMargin {
+		return c.App.token, nil
+	}
+
+	jwt, err := c.App.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	if c.App.InstallationID == 0 {
+		installation := struct {
+			ID int64 `json:"id"`
+		}{}
+		url := fmt.Sprintf("%v/orgs/%v/installation", c.apiURL(), c.App.Org)
+		err := c.appRequest(ctx, "GET", url, jwt, &installation)
+		if err != nil {
+			return "", errors.Wrap(err, "could not find the app's installation")
+		}
+		c.App.InstallationID = installation.ID
+	}
+
+	token := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	url := fmt.Sprintf("%v/app/installations/%v/access_tokens", c.apiURL(), c.App.InstallationID)
+	err = c.appRequest(ctx, "POST", url, jwt, &token)
+	if err != nil {
+		return "", errors.Wrap(err, "could not get installation token")
+	}
+	c.App.token, c.App.expires = token.Token, token.ExpiresAt
+	return c.App.token, nil
+}
+
+// appRequest makes a request to the API authenticated as the app itself
+func (c *GithubSource) appRequest(ctx context.Context, method, url, jwt string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not construct request")
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	request.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := clientOrDefault(c.Client).Do(request)
+	if err != nil {
+		return errors.Wrap(err, "could not make request")
+	}
+	return decodeJSONResponse(resp, v)
+}
+
+// jwt returns a JWT authenticating as the app, signed with its private key
+func (a *GithubApp) jwt(now time.Time) (string, error) {
+	// backdated to allow for clock drift, as github recommends
+	return signJWT(a.PrivateKey, map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.AppID, 10),
+	})
+}
+
+// signJWT returns a JWT of the claims signed with RS256
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode JWT header")
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode JWT claims")
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign JWT")
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
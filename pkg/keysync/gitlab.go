@@ -0,0 +1,36 @@
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGitlabBaseURL is the base url of gitlab.com
+const DefaultGitlabBaseURL = "https://gitlab.com"
+
+// GitlabSource fetches public keys from the .keys endpoint of gitlab.com or
+// a self hosted gitlab instance
+type GitlabSource struct {
+	BaseURL string
+	// Client makes requests to gitlab, defaulting to http.DefaultClient
+	Client *http.Client
+}
+
+func (c *GitlabSource) GetKeys(ctx context.Context, gitlabUsername string) ([]PublicKey, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultGitlabBaseURL
+	}
+
+	url := fmt.Sprintf("%v/%v.keys", strings.TrimSuffix(baseURL, "/"), gitlabUsername)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not construct request")
+	}
+
+	return getKeysFile(clientOrDefault(c.Client), request)
+}
@@ -0,0 +1,167 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GPGKeyring keeps a GnuPG keyring file in sync with the GPG keys users have
+// published on github, for hosts that verify commits or packages signed by
+// the same users. The keyring is rebuilt from the published keys on each
+// sync, so keys that are no longer published, or have been revoked, are
+// removed from it, and it shouldn't hold keys from anywhere else.
+type GPGKeyring struct {
+	Path string
+	// BaseURL is the web url of the github instance, as for GithubSource
+	BaseURL string
+	// Client makes requests to github, defaulting to http.DefaultClient
+	Client    *http.Client
+	Usernames []string
+	// Members, if set, is called on each sync to list additional usernames
+	Members func(ctx context.Context) ([]string, error)
+	// GPG is the gpg binary to build the keyring with, defaulting to gpg on
+	// the PATH
+	GPG string
+}
+
+// Sync fetches every user's published keys and replaces the keyring with
+// them. If any user's keys can't be fetched, the keyring is left as it is,
+// rather than losing their keys.
+func (g *GPGKeyring) Sync(ctx context.Context) error {
+	usernames, err := githubUsernames(ctx, g.Usernames, g.Members)
+	if err != nil {
+		return err
+	}
+
+	armored := bytes.NewBuffer(nil)
+	for _, username := range usernames {
+		keys, err := g.getKeys(ctx, username)
+		if err != nil {
+			return errors.Wrapf(err, "could not get gpg keys of %v", username)
+		}
+		armored.Write(keys)
+	}
+
+	// gpg needs a home for the keys it's importing, which mustn't be the
+	// user's own
+	home, err := ioutil.TempDir("", "sync-github-ssh-keys-gnupg-")
+	if err != nil {
+		return errors.Wrap(err, "could not create gpg home directory")
+	}
+	defer os.RemoveAll(home)
+
+	keyring := []byte{}
+	if armored.Len() != 0 {
+		_, err = g.gpg(ctx, home, armored, "--import")
+		if err != nil {
+			return errors.Wrap(err, "could not import gpg keys")
+		}
+		listing, err := g.gpg(ctx, home, nil, "--with-colons", "--list-keys")
+		if err != nil {
+			return errors.Wrap(err, "could not list gpg keys")
+		}
+		fingerprints := unrevokedFingerprints(listing)
+		if len(fingerprints) != 0 {
+			keyring, err = g.gpg(ctx, home, nil, append([]string{"--export"}, fingerprints...)...)
+			if err != nil {
+				return errors.Wrap(err, "could not export gpg keys")
+			}
+		}
+	}
+
+	current, err := ioutil.ReadFile(g.Path)
+	if err == nil && bytes.Equal(current, keyring) {
+		slog.Debug("gpg keyring is up to date", "path", g.Path)
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read gpg keyring")
+	}
+
+	slog.Info("updating gpg keyring", "path", g.Path, "users", len(usernames))
+	return replaceFile(g.Path, keyring, 0644)
+}
+
+// getKeys fetches the armored keys the user has published, or nothing if
+// they haven't published any
+func (g *GPGKeyring) getKeys(ctx context.Context, username string) ([]byte, error) {
+	source := &GithubSource{BaseURL: g.BaseURL}
+	url := fmt.Sprintf("%v/%v.gpg", source.webURL(), username)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not construct request")
+	}
+
+	resp, err := clientOrDefault(g.Client).Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not make request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &statusError{resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	// users without keys get a message saying so instead
+	if !bytes.Contains(body, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		return nil, nil
+	}
+	return append(body, '\n'), nil
+}
+
+// gpg runs gpg with the home directory and arguments, returning its output
+func (g *GPGKeyring) gpg(ctx context.Context, home string, stdin *bytes.Buffer, args ...string) ([]byte, error) {
+	binary := g.GPG
+	if binary == "" {
+		binary = "gpg"
+	}
+	args = append([]string{"--homedir", home, "--batch", "--quiet", "--no-tty"}, args...)
+	cmd := exec.CommandContext(ctx, binary, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "gpg failed: %v", strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// unrevokedFingerprints returns the fingerprints of the primary keys in
+// gpg's --with-colons listing that haven't been revoked
+func unrevokedFingerprints(listing []byte) []string {
+	fingerprints := []string{}
+	primary, revoked := false, false
+	for _, line := range strings.Split(string(listing), "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "pub":
+			primary = true
+			revoked = len(fields) > 1 && fields[1] == "r"
+		// the first fingerprint after a pub line is the primary key's, and
+		// the rest are subkeys'
+		case fields[0] == "fpr" && primary && len(fields) > 9:
+			primary = false
+			if revoked {
+				slog.Debug("dropping revoked gpg key", "fingerprint", fields[9])
+				continue
+			}
+			fingerprints = append(fingerprints, fields[9])
+		}
+	}
+	return fingerprints
+}
@@ -0,0 +1,169 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	graphqlMembersFields = `pageInfo { hasNextPage endCursor }
+nodes { login publicKeys(first: 100) { pageInfo { hasNextPage } nodes { key } } }`
+	graphqlOrgMembersQuery = `query($org: String!, $cursor: String) {
+organization(login: $org) { membersWithRole(first: 100, after: $cursor) { ` + graphqlMembersFields + ` } }
+}`
+	graphqlTeamMembersQuery = `query($org: String!, $team: String!, $cursor: String) {
+organization(login: $org) { team(slug: $team) { members(first: 100, after: $cursor) { ` + graphqlMembersFields + ` } } }
+}`
+)
+
+type graphqlRequest struct {
+	Query     string            `json:"query"`
+	Variables map[string]string `json:"variables"`
+}
+
+type graphqlResponse struct {
+	Data struct {
+		Organization *struct {
+			MembersWithRole *graphqlMembers `json:"membersWithRole"`
+			Team            *struct {
+				Members graphqlMembers `json:"members"`
+			} `json:"team"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// graphqlMembers is a page of users along with their keys
+type graphqlMembers struct {
+	PageInfo graphqlPageInfo `json:"pageInfo"`
+	Nodes    []struct {
+		Login      string `json:"login"`
+		PublicKeys struct {
+			PageInfo graphqlPageInfo `json:"pageInfo"`
+			Nodes    []struct {
+				Key string `json:"key"`
+			} `json:"nodes"`
+		} `json:"publicKeys"`
+	} `json:"nodes"`
+}
+
+type graphqlPageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+// graphqlURL returns the GraphQL API endpoint, which GitHub Enterprise serves
+// under /api/graphql
+func (c *GithubSource) graphqlURL() string {
+	if c.webURL() == DefaultGithubBaseURL {
+		return "https://api.github.com/graphql"
+	}
+	return c.webURL() + "/api/graphql"
+}
+
+// getMembersWithGraphQL lists the members of an org, or a team within it if
+// team is set, fetching their keys in the same requests. The keys are kept
+// for GetKeys, replacing those of the last listing, so a sync of hundreds of
+// members takes a handful of requests rather than one per member.
+func (c *GithubSource) getMembersWithGraphQL(ctx context.Context, org, team string) ([]string, error) {
+	variables := map[string]string{"org": org}
+	query := graphqlOrgMembersQuery
+	if team != "" {
+		variables["team"] = team
+		query = graphqlTeamMembersQuery
+	}
+
+	usernames := []string{}
+	batched := map[string][]PublicKey{}
+	for {
+		response := graphqlResponse{}
+		err := c.postGraphQL(ctx, graphqlRequest{Query: query, Variables: variables}, &response)
+		if err != nil {
+			return nil, err
+		}
+
+		organization := response.Data.Organization
+		if organization == nil {
+			return nil, errors.Errorf("organisation %v not found", org)
+		}
+		members := organization.MembersWithRole
+		if team != "" {
+			if organization.Team == nil {
+				return nil, errors.Errorf("team %v not found in %v", team, org)
+			}
+			members = &organization.Team.Members
+		}
+		if members == nil {
+			return nil, errors.New("response has no members")
+		}
+
+		for _, member := range members.Nodes {
+			usernames = append(usernames, member.Login)
+			// the few users with more keys than fit in a page have them
+			// fetched separately
+			if member.PublicKeys.PageInfo.HasNextPage {
+				continue
+			}
+			keys := []PublicKey{}
+			for _, key := range member.PublicKeys.Nodes {
+				keys = append(keys, PublicKey{Key: key.Key})
+			}
+			batched[strings.ToLower(member.Login)] = keys
+		}
+		if !members.PageInfo.HasNextPage {
+			break
+		}
+		variables["cursor"] = members.PageInfo.EndCursor
+	}
+
+	c.mu.Lock()
+	c.batched = batched
+	c.mu.Unlock()
+	return usernames, nil
+}
+
+// batchedKeys returns the keys of the user fetched along with the last
+// listing of members, if they were
+func (c *GithubSource) batchedKeys(username string) ([]PublicKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys, ok := c.batched[strings.ToLower(username)]
+	return keys, ok
+}
+
+func (c *GithubSource) postGraphQL(ctx context.Context, body graphqlRequest, response *graphqlResponse) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "could not encode query")
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", c.graphqlURL(), bytes.NewReader(encoded))
+	if err != nil {
+		return errors.Wrap(err, "could not construct request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	token, err := c.token(ctx)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := clientOrDefault(c.Client).Do(request)
+	if err != nil {
+		return errors.Wrap(err, "could not make request")
+	}
+	err = decodeJSONResponse(resp, response)
+	if err != nil {
+		return err
+	}
+	if len(response.Errors) != 0 {
+		return errors.Errorf("graphql query failed: %v", response.Errors[0].Message)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPConfig configures the client sources make requests with
+type HTTPConfig struct {
+	// ConnectTimeout is how long to wait to connect to a server
+	ConnectTimeout time.Duration
+	// Timeout is how long to wait for each attempt at a request, including
+	// reading the response
+	Timeout time.Duration
+	// Retries is how many times to retry requests that fail with network
+	// errors or server errors, waiting RetryBackoff before the first retry
+	// and doubling the wait before each subsequent one
+	Retries      int
+	RetryBackoff time.Duration
+	// Proxy is the url of a proxy to make requests through, e.g.
+	// http://proxy.example.com:3128 or socks5://localhost:1080, which is
+	// used in place of any proxy set in the environment. NO_PROXY is still
+	// honoured.
+	Proxy string
+	// CAFile is a file of PEM encoded certificates to trust as well as the
+	// system's, for servers signed by a private CA
+	CAFile string
+	// PinnedSPKI are base64 encoded SHA256 hashes of public keys, one of
+	// which must be in the chain of any server connected to over tls
+	PinnedSPKI []string
+	// ClientCertFile and ClientKeyFile are a PEM encoded certificate and key
+	// to present to servers that require tls client authentication
+	ClientCertFile string
+	ClientKeyFile  string
+	// UserAgent is sent with every request, defaulting to DefaultUserAgent
+	UserAgent string
+	// Concurrency is how many requests are made at once, e.g. the
+	// Concurrency of syncers, so that many connections to each server are
+	// kept open to be reused
+	Concurrency int
+}
+
+// DefaultUserAgent identifies requests made by clients from NewHTTPClient
+const DefaultUserAgent = "sync-github-ssh-keys"
+
+// NewHTTPClient returns a client for sources to make requests with
+func NewHTTPClient(config HTTPConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := tlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.Proxy != "" {
+		proxyConfig := httpproxy.FromEnvironment()
+		proxyConfig.HTTPProxy = config.Proxy
+		proxyConfig.HTTPSProxy = config.Proxy
+		proxyFunc := proxyConfig.ProxyFunc()
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			return proxyFunc(request.URL)
+		}
+	}
+	transport.DialContext = (&net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = config.ConnectTimeout
+	if config.Concurrency > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = config.Concurrency
+	}
+
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+
+	return &http.Client{
+		Transport: &userAgentTransport{
+			base: &etagTransport{
+				base: &rateLimitTransport{
+					base: &retryTransport{
+						base:    &metricsTransport{base: transport},
+						timeout: config.Timeout,
+						retries: config.Retries,
+						backoff: config.RetryBackoff,
+					},
+					limitedUntil: map[string]time.Time{},
+				},
+				cache: map[string]*cachedResponse{},
+			},
+			userAgent: userAgent,
+		},
+	}, nil
+}
+
+// userAgentTransport sets the User-Agent of requests that don't have one
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get("User-Agent") == "" {
+		// round trippers mustn't modify the request they're given
+		request = request.Clone(request.Context())
+		request.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(request)
+}
+
+// clientOrDefault returns the client, or the default client if it's nil
+func clientOrDefault(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+// retryTransport retries requests that fail transiently, with exponential
+// backoff and jitter so a fleet doesn't retry in lockstep
+type retryTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// requests with bodies that can't be replayed can't be retried
+	retries := t.retries
+	if request.Body != nil && request.GetBody == nil {
+		retries = 0
+	}
+
+	delay := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.attempt(request)
+		if attempt >= retries || !retryable(resp, err) || request.Context().Err() != nil {
+			return resp, err
+		}
+
+		if err == nil {
+			err = &statusError{resp.StatusCode}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// wait somewhere between half and all of the delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		slog.Warn("request failed, retrying", "url", request.URL.Redacted(), "wait", wait.Round(time.Millisecond), "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		}
+		delay *= 2
+
+		if request.Body != nil {
+			request.Body, err = request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// attempt makes the request once, giving up after the timeout
+func (t *retryTransport) attempt(request *http.Request) (*http.Response, error) {
+	if t.timeout == 0 {
+		return t.base.RoundTrip(request)
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the timeout covers reading the body too, so is only cancelled once
+	// the body is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// retryable checks if a request failed in a way that might not happen again,
+// i.e. with a network error or a server error. Client errors such as 404s
+// won't change on retrying.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500
+}
+
+// etagTransport remembers the ETag and body of each response, and sends the
+// ETag with the next request for the same url. If the server replies that
+// nothing has changed, the remembered body is returned, saving bandwidth and
+// rate limit, as github doesn't count these requests against it.
+type etagTransport struct {
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	cache map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+func (t *etagTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method != http.MethodGet {
+		return t.base.RoundTrip(request)
+	}
+
+	key := request.URL.String()
+	t.mu.Lock()
+	cached := t.cache[key]
+	t.mu.Unlock()
+
+	if cached != nil {
+		// the request must not be modified, so send a copy
+		request = request.Clone(request.Context())
+		request.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := t.base.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		slog.Debug("not modified", "url", request.URL.Redacted())
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header = cached.header.Clone()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(cached.body))
+		resp.ContentLength = int64(len(cached.body))
+		return resp, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	t.cache[key] = &cachedResponse{etag: etag, header: resp.Header.Clone(), body: body}
+	t.mu.Unlock()
+	return resp, nil
+}
+
+// rateLimitTransport stops making requests to a host once it reports that
+// we've hit its rate limit, until the limit resets, rather than hammering it
+// on every sync
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	mu           sync.Mutex
+	limitedUntil map[string]time.Time
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	host := request.URL.Host
+
+	t.mu.Lock()
+	until := t.limitedUntil[host]
+	t.mu.Unlock()
+	if time.Now().Before(until) {
+		return nil, &rateLimitedError{host: host, until: until}
+	}
+
+	resp, err := t.base.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if until, limited := rateLimitReset(resp); limited {
+		slog.Warn("rate limited, not making requests until it resets", "host", host, "until", until.Format(time.RFC3339))
+		t.mu.Lock()
+		t.limitedUntil[host] = until
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// rateLimitedError is returned instead of making requests to a host that has
+// rate limited us
+type rateLimitedError struct {
+	host  string
+	until time.Time
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by %v until %v", e.host, e.until.Format(time.RFC3339))
+}
+
+// rateLimitReset checks if the response reports that we've hit a rate limit,
+// and if so when it resets. github reports its limits with X-RateLimit
+// headers, while other services send Retry-After.
+func rateLimitReset(resp *http.Response) (time.Time, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return time.Time{}, false
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Now().Add(time.Duration(seconds) * time.Second), true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return date, true
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err == nil {
+			return time.Unix(reset, 0), true
+		}
+	}
+
+	// a 429 without any hint of when to try again
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return time.Now().Add(time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
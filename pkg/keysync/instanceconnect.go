@@ -0,0 +1,181 @@
+package keysync
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// InstanceConnectTTL is how long keys pushed with EC2 Instance Connect can be
+// used to log in for
+const InstanceConnectTTL = 60 * time.Second
+
+// instanceConnectKeyTypes are the key types EC2 Instance Connect accepts
+var instanceConnectKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:     true,
+	ssh.KeyAlgoED25519: true,
+}
+
+// InstanceConnect pushes the users' keys to EC2 instances with the EC2
+// Instance Connect SendSSHPublicKey API, rather than writing them into an
+// authorized_keys file. Pushed keys can only be used to log in for
+// InstanceConnectTTL, so access lasts only as long as keys keep being pushed.
+// Requests are authenticated with the credentials in the environment, or
+// those of the instance's role.
+type InstanceConnect struct {
+	Instances []string
+	// OSUser is the user on the instances the keys let the users log in as
+	OSUser string
+	// Region defaults to AWS_REGION, or the region of the instance running
+	Region string
+	// URL is the EC2 Instance Connect endpoint, e.g. a VPC endpoint,
+	// defaulting to the region's public one
+	URL string
+	// Keys fetches and checks the users' keys, as when syncing them into an
+	// authorized_keys file
+	Keys   *Syncer
+	Client *http.Client
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+// sendSSHPublicKeyRequest is the request body of SendSSHPublicKey
+type sendSSHPublicKeyRequest struct {
+	InstanceID     string `json:"InstanceId"`
+	InstanceOSUser string
+	SSHPublicKey   string
+}
+
+type sendSSHPublicKeyResponse struct {
+	RequestID string `json:"RequestId"`
+	Success   bool
+}
+
+// Sync fetches the keys of every user and pushes them to every instance. An
+// error is returned if they couldn't be pushed to any instance, or if some
+// users' keys couldn't be fetched, in which case the rest are still pushed.
+func (c *InstanceConnect) Sync(ctx context.Context) error {
+	result, err := c.Keys.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, key := range result.publicKeys {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+		if err != nil {
+			slog.Warn("could not parse key to push", "user", key.username, "key", keyID(key.Key), "error", err)
+			continue
+		}
+		// the options restricting the key can't be pushed with it
+		if key.Options != "" {
+			slog.Warn("skipping key with options EC2 Instance Connect can't push", "user", key.username, "fingerprint", fingerprint(key.Key))
+			continue
+		}
+		if !instanceConnectKeyTypes[publicKey.Type()] {
+			slog.Debug("skipping key of a type EC2 Instance Connect doesn't accept", "user", key.username, "fingerprint", fingerprint(key.Key), "type", publicKey.Type())
+			continue
+		}
+		// options and comments aren't accepted, so only the key itself is
+		// pushed
+		encoded := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+		if !seen[encoded] {
+			seen[encoded] = true
+			keys = append(keys, encoded)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys to push with EC2 Instance Connect")
+	}
+
+	endpoint, credentials, err := c.endpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	failedInstances, failedKeys := 0, 0
+	for _, instance := range c.Instances {
+		failed := c.push(ctx, endpoint, credentials, instance, keys)
+		if failed != 0 {
+			failedInstances++
+			failedKeys += failed
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	slog.Info("pushed keys with EC2 Instance Connect", "instances", len(c.Instances), "failed", failedInstances, "keys", len(keys), "failed_keys", failedKeys, "os_user", c.OSUser, "valid_until", time.Now().Add(InstanceConnectTTL).UTC().Format(time.RFC3339))
+	if failedInstances != 0 {
+		return errors.Errorf("could not push %v of %v keys, to %v of %v instances", failedKeys, len(keys)*len(c.Instances), failedInstances, len(c.Instances))
+	}
+	return partialFailure(result.usernames, result.failedUsernames)
+}
+
+// push sends each key to the instance, logging those that couldn't be pushed
+// and returning how many, carrying on past them so one rejected key doesn't
+// lock every other user out of the instance
+func (c *InstanceConnect) push(ctx context.Context, endpoint string, credentials *awsCredentials, instance string, keys []string) int {
+	failed := 0
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return failed
+		}
+		err := c.pushKey(ctx, endpoint, credentials, instance, key)
+		if err != nil {
+			slog.Error("could not push key with EC2 Instance Connect", "instance", instance, "fingerprint", fingerprint(key), "error", err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// pushKey sends a key to the instance
+func (c *InstanceConnect) pushKey(ctx context.Context, endpoint string, credentials *awsCredentials, instance, key string) error {
+	request := sendSSHPublicKeyRequest{InstanceID: instance, InstanceOSUser: c.OSUser, SSHPublicKey: key}
+	response := sendSSHPublicKeyResponse{}
+	err := callAWSJSON(ctx, c.Client, credentials, endpoint, "ec2-instance-connect", c.Region, "AWSEC2InstanceConnectService.SendSSHPublicKey", request, &response)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return errors.Errorf("request %v was unsuccessful", response.RequestID)
+	}
+	return nil
+}
+
+// endpoint returns the url to send requests to, and the credentials to sign
+// them with, finding the region and fetching the credentials of the
+// instance's role the first time, and again before they expire
+func (c *InstanceConnect) endpoint(ctx context.Context) (string, *awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Region == "" {
+		region, err := awsRegion(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		c.Region = region
+	}
+	if c.credentials == nil || c.credentials.expiring() {
+		credentials, err := loadAWSCredentials(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		c.credentials = credentials
+	}
+
+	endpoint := c.URL
+	if endpoint == "" {
+		endpoint = "https://ec2-instance-connect." + c.Region + ".amazonaws.com/"
+	}
+	return endpoint, c.credentials, nil
+}
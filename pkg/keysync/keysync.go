@@ -0,0 +1,755 @@
+// Package keysync syncs ssh public keys registered with github and similar
+// services into authorized_keys files.
+package keysync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// syncedKey is a public key fetched from the key source, along with the
+// username it was fetched for
+type syncedKey struct {
+	PublicKey
+	username string
+	// syncedOn is the date the key was first synced, if it has been before
+	syncedOn string
+}
+
+// Syncer syncs the keys of a set of users from a Source into a Target.
+// Synced keys are marked with a comment recording the user they were synced
+// for, so they can be removed once that user no longer has them, while keys
+// that were added to the target by other means are left untouched.
+type Syncer struct {
+	// Name identifies the syncer in metrics, e.g. by the path of the file it
+	// syncs
+	Name   string
+	Source Source
+	// SourceName is recorded in the comment of synced keys, defaulting to
+	// github
+	SourceName string
+	// Sources are the names of the other sources usernames can be qualified
+	// with, e.g. gitlab for gitlab:alice, which Source fetches them from,
+	// such as with a MultiSource. Synced keys record the source they came
+	// from, so they're only removed once that source drops them.
+	Sources   []string
+	Target    Target
+	Usernames []string
+	// Members, if set, is called on each sync to list additional usernames,
+	// e.g. the current members of a github team
+	Members func(ctx context.Context) ([]string, error)
+	// ExtraKeysFile, if set, is a file of keys in authorized_keys format,
+	// e.g. break-glass keys, that are synced along with every user's, as
+	// if it had been given as a file:// username
+	ExtraKeysFile string
+	// MinKeys, if set, aborts any update that would leave the target with
+	// fewer keys, e.g. when the source mistakenly returns no keys
+	MinKeys int
+	// NoPrune stops synced keys from being removed once users no longer have
+	// them, so keys are only ever added
+	NoPrune bool
+	// AllowEmpty lets the synced keys of users the source returns no keys
+	// for be removed. Otherwise they're kept, as no keys at all usually
+	// means a problem with the user's account rather than every key being
+	// deliberately removed.
+	AllowEmpty bool
+	// FailTTL, if set, is how long a user's keys can go without being
+	// fetched before the source is considered unreachable for them. Their
+	// synced keys are then removed if FailClosed is set, and otherwise kept,
+	// failing open, as they are before then.
+	FailTTL    time.Duration
+	FailClosed bool
+	// Exclusive treats every key in the target as synced, so keys that were
+	// added by other means are removed too
+	Exclusive bool
+	// RemovalWindow, if set, is called with the time of each sync, and keys
+	// are only removed if it returns true, e.g. during business hours. Keys
+	// are added whatever it returns.
+	RemovalWindow func(time.Time) bool
+	// KeyOptions are prepended to every synced key, e.g. to restrict where
+	// they can be used from, unless overridden for the user in UserKeyOptions
+	KeyOptions     string
+	UserKeyOptions map[string]string
+	// KeyTTL, if set, adds an expiry-time option to synced keys, so they stop
+	// working unless they are synced again before the TTL passes
+	KeyTTL time.Duration
+	// Marker starts the comment of synced keys, defaulting to DefaultMarker.
+	// Keys marked with any of PreviousMarkers are also treated as synced,
+	// and are remarked with Marker as they are synced again.
+	Marker          string
+	PreviousMarkers []string
+	// AllowedKeyTypes, if set, restricts the keys synced to these types,
+	// which can be given by their short names, e.g. ed25519 or ecdsa
+	AllowedKeyTypes []string
+	// MinRSABits, if set, stops rsa keys shorter than it from being synced
+	MinRSABits int
+	// AllowedFingerprintsFile and DeniedFingerprintsFile list the SHA256
+	// fingerprints of keys that are allowed or denied. If an allow list is
+	// given, only the keys in it are synced.
+	AllowedFingerprintsFile string
+	DeniedFingerprintsFile  string
+	// Statsd, if set, is sent sync durations, key churn and errors, as well
+	// as them being exported to prometheus
+	Statsd *StatsdClient
+	// MaxFetchInterval, if set, fetches the keys of users whose keys haven't
+	// changed less often, doubling the time between fetches each time they
+	// are found unchanged, up to this long. Once a user's keys change, they
+	// are fetched on every sync again.
+	MaxFetchInterval time.Duration
+	// Concurrency is how many users' keys are fetched at once, defaulting
+	// to one at a time. The source must be safe to use concurrently, as
+	// those in this package are.
+	Concurrency int
+	// Audit, if set, records every key added or removed
+	Audit *AuditLog
+	// Events, if set, is sent the keys added and removed, and told when
+	// syncs start and stop failing repeatedly
+	Events *EventWebhook
+	// Notifiers, if set, are sent a message describing the keys added and
+	// removed, e.g. to post it in a chat channel
+	Notifiers []Notifier
+	// NotifyFailingAfter, if set, tells the notifiers when syncs have been
+	// failing for this long, and when they succeed again
+	NotifyFailingAfter time.Duration
+	// DegradedAfter, if set, is how many syncs in a row must fail for
+	// syncing to be considered degraded, telling the notifiers and
+	// triggering Pager, if set, until a sync succeeds
+	DegradedAfter int
+	Pager         *Pager
+
+	// last is the result of the last sync, to skip merging if nothing has
+	// changed since
+	last *lastSync
+
+	// notifiedFailing is when the failures the notifiers were last told of
+	// started, or zero if they haven't been told of the current ones
+	notifiedFailing time.Time
+
+	// started is when the first sync started, for FailTTL to count from for
+	// users whose keys have never been fetched
+	started time.Time
+
+	// polls tracks how often each user's keys change, for MaxFetchInterval
+	polls map[string]*userPoll
+
+	statusMu sync.Mutex
+	status   Status
+}
+
+type lastSync struct {
+	publicKeys      []syncedKey
+	failedUsernames map[string]bool
+	denied          map[string]bool
+	removing        bool
+	updated         []byte
+}
+
+// line returns the authorized keys line for the synced key, with the options
+// it was published with followed by any configured ones
+func (s *Syncer) line(key syncedKey) string {
+	options := s.KeyOptions
+	if userOptions, ok := s.UserKeyOptions[key.username]; ok {
+		options = userOptions
+	}
+	options = joinOptions(key.Options, options)
+	if s.KeyTTL != 0 {
+		// sshd interprets the expiry time in the system time zone
+		options = joinOptions(options, `expiry-time="`+time.Now().Add(s.KeyTTL).Format("200601021504")+`"`)
+	}
+	if options == "" {
+		return key.Key + " " + s.comment(key)
+	}
+	return options + " " + key.Key + " " + s.comment(key)
+}
+
+// joinOptions joins two options fields. An option given in both, such as two
+// command options, makes sshd refuse the key rather than pick one.
+func joinOptions(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "," + b
+}
+
+// usernames returns the usernames to sync keys for, including the current
+// members if configured
+func (s *Syncer) usernames(ctx context.Context) ([]string, error) {
+	members := []string{}
+	if s.Members != nil {
+		var err error
+		members, err = s.Members(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not list members")
+		}
+	}
+	if s.ExtraKeysFile != "" {
+		members = append(members, fileSourcePrefix+s.ExtraKeysFile)
+	}
+
+	usernames := []string{}
+	seen := map[string]bool{}
+	for _, username := range append(append([]string{}, s.Usernames...), members...) {
+		username = s.normalizeUsername(username)
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+// fetchResult is the keys fetched for every user
+type fetchResult struct {
+	publicKeys []syncedKey
+	// usernames are the users keys were fetched for
+	usernames []string
+	// failedUsernames are the users whose keys couldn't be fetched, of which
+	// expiredUsernames are those whose keys haven't been fetched for longer
+	// than FailTTL
+	failedUsernames  map[string]bool
+	expiredUsernames map[string]bool
+	// emptyUsernames are the users the source returned no keys for
+	emptyUsernames map[string]bool
+	// denied are the fingerprints of keys that must be removed from the
+	// target wherever they came from
+	denied map[string]bool
+}
+
+// fetch gets the keys of every user. An error is only returned if no keys
+// could be fetched at all, and keeping every synced key is the only option.
+func (s *Syncer) fetch(ctx context.Context) (*fetchResult, error) {
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	usernames, err := s.usernames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := s.loadKeyFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &fetchResult{
+		publicKeys:       []syncedKey{},
+		usernames:        usernames,
+		failedUsernames:  map[string]bool{},
+		expiredUsernames: map[string]bool{},
+		emptyUsernames:   map[string]bool{},
+		denied:           filter.denied,
+	}
+	now := time.Now()
+	stable := map[string][]PublicKey{}
+	unstable := []string{}
+	for _, username := range usernames {
+		if keys, ok := s.stableKeys(username, now); ok {
+			stable[username] = keys
+		} else {
+			unstable = append(unstable, username)
+		}
+	}
+	fetched := s.getKeys(ctx, unstable)
+
+	skippedUsernames := map[string]bool{}
+	for _, username := range usernames {
+		// don't mistake every remaining user failing for them having no
+		// keys
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		keys, ok := stable[username]
+		if ok {
+			skippedUsernames[username] = true
+		} else {
+			keys = fetched[username].keys
+			err := fetched[username].err
+			if err != nil {
+				fetchErrors.WithLabelValues(fetchErrorType(err)).Inc()
+				s.Statsd.count("fetch_errors."+fetchErrorType(err), 1)
+				slog.Warn("could not get public keys", "user", username, "error", err)
+				result.failedUsernames[username] = true
+				if s.expired(username, now) {
+					result.expiredUsernames[username] = true
+				}
+				continue
+			}
+			s.recordKeys(username, keys, now)
+		}
+		// an empty local file is deliberate, rather than an account problem
+		if len(keys) == 0 && !IsLocalSource(username) {
+			if s.AllowEmpty {
+				slog.Warn("source returned no keys for user, removing any synced keys", "user", username)
+			} else {
+				slog.Error("source returned no keys for user, which usually means a problem with their account, keeping any synced keys", "user", username)
+			}
+			result.emptyUsernames[username] = true
+		}
+		for _, key := range keys {
+			checked, err := s.checkKey(key.Key, filter)
+			if err != nil {
+				slog.Warn("rejecting key", "user", username, "key", keyID(key.Key), "error", err)
+				continue
+			}
+			key.Key = checked
+			result.publicKeys = append(result.publicKeys, syncedKey{PublicKey: key, username: username})
+		}
+	}
+	s.recordFetch(usernames, result.failedUsernames, skippedUsernames)
+	emptyKeysets.WithLabelValues(s.Name).Set(float64(len(result.emptyUsernames)))
+	s.Statsd.count("empty_keysets", len(result.emptyUsernames))
+	// failing closed has to remove keys even if every user failed
+	if len(usernames) != 0 && len(result.failedUsernames) == len(usernames) && (!s.FailClosed || len(result.expiredUsernames) == 0) {
+		return nil, errors.New("could not get public keys for any user")
+	}
+
+	return result, nil
+}
+
+// getKeys fetches the keys of the users from the source, up to Concurrency
+// users at once
+func (s *Syncer) getKeys(ctx context.Context, usernames []string) map[string]getKeysResult {
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]getKeysResult, len(usernames))
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency && i < len(usernames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				keys, err := s.Source.GetKeys(ctx, usernames[i])
+				results[i] = getKeysResult{keys, err}
+			}
+		}()
+	}
+	for i := range usernames {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	fetched := map[string]getKeysResult{}
+	for i, username := range usernames {
+		fetched[username] = results[i]
+	}
+	return fetched
+}
+
+// keptUsernames returns the users whose synced keys mustn't be removed:
+// those whose keys couldn't be fetched, unless they've expired and FailClosed
+// is set, and unless AllowEmpty is set, those the source returned no keys for
+func (s *Syncer) keptUsernames(result *fetchResult) map[string]bool {
+	kept := map[string]bool{}
+	for username := range result.failedUsernames {
+		if !s.FailClosed || !result.expiredUsernames[username] {
+			kept[username] = true
+		}
+	}
+	if !s.AllowEmpty {
+		for username := range result.emptyUsernames {
+			kept[username] = true
+		}
+	}
+	return kept
+}
+
+// Sync fetches the keys of every user and updates the target with them. If
+// fetching keys for some users fails, the target is still updated, leaving
+// those users' keys untouched, and an error is returned. Cancelling ctx
+// abandons the sync, leaving the target as it was.
+func (s *Syncer) Sync(ctx context.Context) (err error) {
+	start := time.Now()
+	var previous, written []byte
+	defer func() {
+		failures := s.recordSync(written, err)
+		s.sendFailureEvents(failures, err)
+		s.notifyFailures(err)
+		s.escalate(failures, err)
+		s.observeSync(time.Since(start), previous, written, err)
+	}()
+
+	result, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	removing := s.removing(start)
+	publicKeys, kept, denied := result.publicKeys, s.keptUsernames(result), result.denied
+
+	err = s.Target.Update(ctx, func(current []byte) ([]byte, error) {
+		previous = current
+		if s.unchanged(current, publicKeys, kept, denied, removing) {
+			slog.Debug("keys unchanged since the last sync, skipping merge")
+			written = current
+			return current, nil
+		}
+
+		updated, err := s.merge(current, publicKeys, kept, denied, removing)
+		if err != nil {
+			return nil, err
+		}
+		s.last = &lastSync{publicKeys: publicKeys, failedUsernames: kept, denied: denied, removing: removing, updated: updated}
+		written = updated
+		return updated, nil
+	})
+	if err != nil {
+		s.last = nil
+		written = nil
+		return err
+	}
+
+	if !bytes.Equal(previous, written) {
+		err = s.verify(previous, written)
+		if err != nil {
+			s.last = nil
+			written = nil
+			return err
+		}
+		s.audit(previous, written)
+	}
+
+	return partialFailure(result.usernames, result.failedUsernames)
+}
+
+// verify re-reads the target after a sync changed it, checking it holds what
+// was written, with no more malformed lines than before and at least MinKeys
+// keys. If it doesn't, the previous contents are put back, so a bug can't
+// leave the host unreachable.
+func (s *Syncer) verify(previous, written []byte) error {
+	err := s.checkWritten(previous, written)
+	if err == nil {
+		return nil
+	}
+
+	slog.Error("authorized keys file failed verification, restoring its previous contents", "error", err)
+	// a cancelled sync mustn't leave the bad contents in place
+	restoreErr := s.Target.Update(context.Background(), func([]byte) ([]byte, error) {
+		return previous, nil
+	})
+	if restoreErr != nil {
+		return errors.Wrapf(restoreErr, "authorized keys file failed verification (%v), and could not be restored", err)
+	}
+	return errors.Wrap(err, "authorized keys file failed verification, and was restored")
+}
+
+// checkWritten checks the target holds what was written, and that it's valid
+func (s *Syncer) checkWritten(previous, written []byte) error {
+	current, err := s.Target.Read()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, written) {
+		return errors.New("its contents differ from what was written")
+	}
+	if n, was := countMalformed(current), countMalformed(previous); n > was {
+		return errors.Errorf("it has %v malformed lines, up from %v", n, was)
+	}
+	if n := countKeys(current); n < s.MinKeys {
+		return errors.Errorf("it has %v keys, fewer than the minimum of %v", n, s.MinKeys)
+	}
+	return nil
+}
+
+// unchanged checks if merging the keys into the target would give the same
+// result as the last sync, as the keys and the target are the same as then.
+// Keys with an expiry time always need merging to push it back, and removals
+// held back outside the removal window need making once it opens.
+func (s *Syncer) unchanged(current []byte, publicKeys []syncedKey, failedUsernames, denied map[string]bool, removing bool) bool {
+	return s.last != nil && s.KeyTTL == 0 &&
+		bytes.Equal(current, s.last.updated) &&
+		reflect.DeepEqual(publicKeys, s.last.publicKeys) &&
+		reflect.DeepEqual(failedUsernames, s.last.failedUsernames) &&
+		reflect.DeepEqual(denied, s.last.denied) &&
+		removing == s.last.removing
+}
+
+// removing checks if keys can be removed by a sync at the time
+func (s *Syncer) removing(now time.Time) bool {
+	return s.RemovalWindow == nil || s.RemovalWindow(now)
+}
+
+// Diff fetches the keys of every user and writes a unified diff of the
+// changes syncing them would make to the target to w, without changing it.
+// name is used to label the diff. It returns whether there are any changes,
+// and fails in the same way as Sync.
+func (s *Syncer) Diff(ctx context.Context, w io.Writer, name string) (bool, error) {
+	result, err := s.fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := s.Target.Read()
+	if err != nil {
+		return false, err
+	}
+	updated, err := s.merge(current, result.publicKeys, s.keptUsernames(result), result.denied, s.removing(time.Now()))
+	if err != nil {
+		return false, err
+	}
+
+	err = writeUnifiedDiff(w, name, name, current, updated)
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(current, updated), partialFailure(result.usernames, result.failedUsernames)
+}
+
+// merge returns the authorized keys file with the synced keys brought up to
+// date, only removing keys if removing is set, other than denied keys, which
+// are always removed
+func (s *Syncer) merge(current []byte, publicKeys []syncedKey, failedUsernames, denied map[string]bool, removing bool) ([]byte, error) {
+	outputBuffer := bytes.NewBuffer(nil)
+	err := s.ensureKeysetUpToDate(publicKeys, failedUsernames, removing, outputBuffer, bytes.NewReader(current))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not update authorized keys file")
+	}
+	outputBuffer = bytes.NewBuffer(removeDenied(outputBuffer.Bytes(), denied))
+
+	if n := countKeys(outputBuffer.Bytes()); n < s.MinKeys {
+		return nil, errors.Errorf("refusing to leave %v keys in authorized keys file, fewer than the minimum of %v", n, s.MinKeys)
+	}
+	// keep the line endings of files written on windows, e.g. by notepad
+	if bytes.Contains(current, []byte("\r\n")) {
+		return bytes.Replace(outputBuffer.Bytes(), []byte("\n"), []byte("\r\n"), -1), nil
+	}
+	return outputBuffer.Bytes(), nil
+}
+
+// countKeys returns the number of keys in the authorized keys file
+func countKeys(contents []byte) int {
+	n := 0
+	for _, line := range strings.Split(string(contents), "\n") {
+		if _, ok := parseAuthorizedKeysLine(line); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// countMalformed returns the number of lines in the authorized keys file that
+// are neither keys, comments nor blank
+func countMalformed(contents []byte) int {
+	n := 0
+	for _, line := range strings.Split(string(contents), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if _, ok := parseAuthorizedKeysLine(line); !ok && trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			n++
+		}
+	}
+	return n
+}
+
+// passthrough checks if the authorized keys line is a certificate or
+// certificate authority that wasn't synced, which is left as it is
+func (s *Syncer) passthrough(parsed authorizedKeysLine) bool {
+	if !parsed.forCertificates() {
+		return false
+	}
+	_, synced := s.parseSyncComment(parsed.comment)
+	return !synced
+}
+
+// partialFailure returns an error if keys couldn't be fetched for some users
+func partialFailure(usernames []string, failedUsernames map[string]bool) error {
+	if len(failedUsernames) != 0 {
+		return errors.Errorf("could not get public keys for %v of %v users", len(failedUsernames), len(usernames))
+	}
+	return nil
+}
+
+// Print fetches the keys of every user and writes them to w in
+// authorized_keys format, without touching the target. This is suitable for
+// use as sshd's AuthorizedKeysCommand. Users whose keys could not be fetched
+// are skipped; an error is only returned if no keys could be fetched at all.
+func (s *Syncer) Print(ctx context.Context, w io.Writer) error {
+	result, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, key := range result.publicKeys {
+		if seen[key.Key] {
+			continue
+		}
+		seen[key.Key] = true
+
+		_, err := fmt.Fprintln(w, s.line(key))
+		if err != nil {
+			return errors.Wrap(err, "could not write out key")
+		}
+	}
+
+	return nil
+}
+
+// Remove removes every synced key from the target, or if usernames are given
+// only the keys synced for them, leaving any other lines as they are. It
+// returns how many keys were removed.
+func (s *Syncer) Remove(ctx context.Context, usernames []string) (int, error) {
+	only := map[string]bool{}
+	for _, username := range usernames {
+		only[s.normalizeUsername(username)] = true
+	}
+
+	removed := 0
+	var previous, updated []byte
+	err := s.Target.Update(ctx, func(current []byte) ([]byte, error) {
+		removed = 0
+		output := bytes.NewBuffer(nil)
+		for _, line := range strings.SplitAfter(string(current), "\n") {
+			if parsed, ok := parseAuthorizedKeysLine(line); ok {
+				synced, ok := s.parseSyncComment(parsed.comment)
+				if ok && (len(only) == 0 || only[synced.username]) {
+					slog.Info("removing key", "action", "remove", "user", synced.username, "fingerprint", fingerprint(parsed.key()), "key", parsed.key())
+					removed++
+					continue
+				}
+			}
+			output.WriteString(line)
+		}
+		previous, updated = current, output.Bytes()
+		return updated, nil
+	})
+	// the next sync has to add back any keys that are still wanted
+	s.last = nil
+	if err == nil {
+		s.audit(previous, updated)
+	}
+	return removed, err
+}
+
+// ensureKeysetUpToDate copies the authorized keys file from input to output,
+// removing synced keys that are no longer present in newKeyset and appending
+// any keys that are missing. Synced keys belonging to a username in
+// failedUsernames are left untouched, as we don't know their current state,
+// and unless removing is set no keys are removed.
+func (s *Syncer) ensureKeysetUpToDate(newKeyset []syncedKey, failedUsernames map[string]bool, removing bool, output io.Writer, input io.Reader) error {
+	// the first username to provide a key takes ownership of it
+	newKeysetHashed := map[string]syncedKey{}
+	newKeysetOrdered := []syncedKey{}
+	for _, key := range newKeyset {
+		if _, ok := newKeysetHashed[key.Key]; ok {
+			continue
+		}
+		newKeysetHashed[key.Key] = key
+		newKeysetOrdered = append(newKeysetOrdered, key)
+	}
+
+	bufferedInput := bufio.NewReader(input)
+	for i := 1; ; i++ {
+		line, err := bufferedInput.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		// the last line may not end in a newline
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "could not read authorized keys file")
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		parsed, ok := parseAuthorizedKeysLine(line)
+		if !ok {
+			// comments, blank lines, and anything else we can't make sense
+			// of aren't ours to touch
+			trimmed := strings.TrimSpace(line)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				slog.Warn("malformed line in authorized keys file, leaving it as is", "line", i)
+			}
+			_, err := fmt.Fprintln(output, line)
+			if err != nil {
+				return errors.Wrap(err, "could not write out existing line")
+			}
+			continue
+		}
+		if s.passthrough(parsed) {
+			// certificates and certificate authorities aren't keys of the
+			// users, so are never added, removed or rewritten
+			_, err := fmt.Fprintln(output, line)
+			if err != nil {
+				return errors.Wrap(err, "could not write out existing certificate line")
+			}
+			continue
+		}
+
+		key := parsed.key()
+		newKey, wanted := newKeysetHashed[key]
+
+		// Check to see if the key was created by us
+		if synced, ok := s.parseSyncComment(parsed.comment); ok {
+			if wanted {
+				// if it's still in the set of keys, then write it out again,
+				// remembering when it was first synced for the user
+				if synced.username == newKey.username {
+					newKey.syncedOn = synced.syncedOn
+				}
+				_, err := fmt.Fprintln(output, s.line(newKey))
+				if err != nil {
+					return errors.Wrap(err, "could not write out existing synced key")
+				}
+			} else if s.NoPrune || failedUsernames[synced.username] || (synced.username == "" && len(failedUsernames) != 0) {
+				// keys from before we tracked usernames could belong to
+				// anyone, so are only removed when every fetch succeeded
+				_, err := fmt.Fprintln(output, line)
+				if err != nil {
+					return errors.Wrap(err, "could not write out existing synced key")
+				}
+			} else if !removing {
+				slog.Info("outside the removal window, keeping key", "user", synced.username, "fingerprint", fingerprint(key))
+				_, err := fmt.Fprintln(output, line)
+				if err != nil {
+					return errors.Wrap(err, "could not write out existing synced key")
+				}
+			} else {
+				slog.Info("removing key", "action", "remove", "user", synced.username, "fingerprint", fingerprint(key), "key", key)
+			}
+		} else if s.Exclusive && !wanted && len(failedUsernames) == 0 && removing {
+			// as with untagged keys, we can't know if an unsynced key belongs
+			// to a user whose fetch failed
+			slog.Info("removing unsynced key", "action", "remove", "fingerprint", fingerprint(key), "key", key)
+		} else {
+			if s.Exclusive && !wanted && len(failedUsernames) == 0 {
+				slog.Info("outside the removal window, keeping unsynced key", "fingerprint", fingerprint(key))
+			}
+			_, err := fmt.Fprintln(output, line)
+			if err != nil {
+				return errors.Wrap(err, "could not write out existing unsynced key")
+			}
+		}
+
+		delete(newKeysetHashed, key)
+	}
+
+	for _, key := range newKeysetOrdered {
+		if _, ok := newKeysetHashed[key.Key]; !ok {
+			continue
+		}
+		attrs := []interface{}{"action", "add", "user", key.username, "fingerprint", fingerprint(key.Key), "key", key.Key}
+		if key.ID != 0 {
+			attrs = append(attrs, "id", key.ID, "title", key.Title, "created_at", key.CreatedAt)
+		}
+		slog.Info("adding key", attrs...)
+		_, err := fmt.Fprintln(output, s.line(key))
+		if err != nil {
+			return errors.Wrap(err, "could not write out new key")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// KnownHosts keeps github's ssh host keys in a known_hosts file up to date
+// with the ones github publishes through its meta API, so that when it
+// rotates them, ssh connections to it keep being trusted without the
+// "remote host identification has changed" error. Lines for other hosts are
+// left as they are.
+type KnownHosts struct {
+	Path string
+	// Github is the instance whose host keys are synced
+	Github *GithubSource
+	// Marker starts the comment marking synced host keys, defaulting to
+	// DefaultMarker
+	Marker string
+}
+
+// githubMeta is the subset of the response of github's meta API needed
+type githubMeta struct {
+	SSHKeys []string `json:"ssh_keys"`
+}
+
+// Sync fetches the published host keys and updates the file with them. If
+// they can't be fetched, the file is left as it is.
+func (k *KnownHosts) Sync(ctx context.Context) error {
+	meta := githubMeta{}
+	err := k.Github.getAllPages(ctx, k.Github.apiURL()+"/meta", func(resp *http.Response) error {
+		return decodeJSONResponse(resp, &meta)
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not get host keys")
+	}
+
+	keys := []string{}
+	for _, key := range meta.SSHKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			slog.Warn("skipping invalid host key", "key", key, "error", err)
+			continue
+		}
+		keys = append(keys, NormalizeKey(key))
+	}
+	// an instance with ssh disabled publishes no keys, but so might a
+	// broken response, which mustn't stop ssh from trusting it
+	if len(keys) == 0 {
+		return errors.New("no host keys were published")
+	}
+
+	current, err := ioutil.ReadFile(k.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read known hosts file")
+	}
+
+	updated := bytes.NewBuffer(nil)
+	for _, line := range strings.SplitAfter(string(current), "\n") {
+		if line != "" && !k.synced(line) {
+			updated.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+		}
+	}
+	for _, key := range keys {
+		updated.WriteString(k.hosts() + " " + key + " " + k.comment() + "\n")
+	}
+
+	if current != nil && bytes.Equal(current, updated.Bytes()) {
+		return nil
+	}
+	slog.Info("updating known hosts file", "path", k.Path, "host", k.Github.hostname(), "keys", len(keys))
+	return replaceFile(k.Path, updated.Bytes(), 0644)
+}
+
+// hosts returns the host patterns the keys are for. github.com also serves
+// ssh on port 443 of ssh.github.com, for networks that block port 22.
+func (k *KnownHosts) hosts() string {
+	if k.Github.webURL() == DefaultGithubBaseURL {
+		return "github.com,[ssh.github.com]:443"
+	}
+	return k.Github.hostname()
+}
+
+func (k *KnownHosts) comment() string {
+	marker := k.Marker
+	if marker == "" {
+		marker = DefaultMarker
+	}
+	return marker + ":host-key"
+}
+
+// synced checks if the known hosts line is one of the synced host keys
+func (k *KnownHosts) synced(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) != 0 && !strings.HasPrefix(fields[0], "#") && fields[len(fields)-1] == k.comment()
+}
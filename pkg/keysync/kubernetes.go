@@ -0,0 +1,373 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// inClusterDir holds the credentials kubernetes mounts into pods for their
+// service account
+const inClusterDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesTimeout bounds each request to the API server
+const kubernetesTimeout = 30 * time.Second
+
+// KubernetesConfig is how to reach and authenticate to a kubernetes API
+// server, from a kubeconfig file or the service account of the pod running
+type KubernetesConfig struct {
+	Server string
+	// Namespace is the namespace of the pod running, or of the kubeconfig's
+	// current context
+	Namespace string
+	Client    *http.Client
+
+	// token authenticates requests, unless tokenFile is set, which is read
+	// for each request as it's rotated, or exec, which is run to get one
+	token     string
+	tokenFile string
+	exec      *kubeconfigExec
+
+	mu          sync.Mutex
+	execToken   string
+	execExpires time.Time
+}
+
+// kubeconfig is the subset of a kubeconfig file needed
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			TLSServerName            string `yaml:"tls-server-name"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string                 `yaml:"token"`
+			TokenFile             string                 `yaml:"tokenFile"`
+			ClientCertificate     string                 `yaml:"client-certificate"`
+			ClientCertificateData string                 `yaml:"client-certificate-data"`
+			ClientKey             string                 `yaml:"client-key"`
+			ClientKeyData         string                 `yaml:"client-key-data"`
+			Exec                  *kubeconfigExec        `yaml:"exec"`
+			AuthProvider          map[string]interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// kubeconfigExec is a credential plugin, run to get a token, as e.g. cloud
+// providers' kubeconfigs use
+type kubeconfigExec struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+	// dir is the kubeconfig's directory, which relative commands are
+	// relative to
+	dir string
+}
+
+// execCredential is what credential plugins print
+type execCredential struct {
+	Status struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// NewKubernetesConfig loads the kubeconfig file at path if it's set. Otherwise
+// it loads the first file in KUBECONFIG, or the pod's service account when
+// running in a cluster, or lastly ~/.kube/config, as kubectl does.
+func NewKubernetesConfig(path string) (*KubernetesConfig, error) {
+	if path == "" {
+		path = strings.Split(os.Getenv("KUBECONFIG"), string(os.PathListSeparator))[0]
+	}
+	if path == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return inClusterKubernetesConfig()
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not find kubeconfig")
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	return loadKubeconfig(path)
+}
+
+// inClusterKubernetesConfig authenticates as the service account of the pod
+// running
+func inClusterKubernetesConfig() (*KubernetesConfig, error) {
+	ca, err := ioutil.ReadFile(filepath.Join(inClusterDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the service account's ca certificate")
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(inClusterDir, "namespace"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the service account's namespace")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in the service account's ca certificate")
+	}
+
+	server := "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	return &KubernetesConfig{
+		Server:    server,
+		Namespace: strings.TrimSpace(string(namespace)),
+		Client:    kubernetesClient(&tls.Config{RootCAs: roots}),
+		tokenFile: filepath.Join(inClusterDir, "token"),
+	}, nil
+}
+
+// loadKubeconfig authenticates as the user of the kubeconfig's current context
+func loadKubeconfig(path string) (*KubernetesConfig, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read kubeconfig")
+	}
+	parsed := kubeconfig{}
+	err = yaml.Unmarshal(encoded, &parsed)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse kubeconfig")
+	}
+	// paths in it are relative to it
+	dir := filepath.Dir(path)
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(dir, file)
+	}
+
+	config := &KubernetesConfig{}
+	found := false
+	for _, current := range parsed.Contexts {
+		if current.Name != parsed.CurrentContext {
+			continue
+		}
+		found = true
+		config.Namespace = current.Context.Namespace
+		tlsConfig := &tls.Config{}
+		for _, cluster := range parsed.Clusters {
+			if cluster.Name != current.Context.Cluster {
+				continue
+			}
+			config.Server = cluster.Cluster.Server
+			tlsConfig.ServerName = cluster.Cluster.TLSServerName
+			tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+			ca, err := kubeconfigData(cluster.Cluster.CertificateAuthorityData, resolve(cluster.Cluster.CertificateAuthority))
+			if err != nil {
+				return nil, errors.Wrap(err, "could not read the kubeconfig's certificate authority")
+			}
+			if ca != nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+				if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+					return nil, errors.New("no certificates found in the kubeconfig's certificate authority")
+				}
+			}
+		}
+		for _, user := range parsed.Users {
+			if user.Name != current.Context.User {
+				continue
+			}
+			if user.User.AuthProvider != nil {
+				return nil, errors.New("kubeconfig auth providers aren't supported; use an exec credential plugin or a token")
+			}
+			config.token, config.tokenFile, config.exec = user.User.Token, resolve(user.User.TokenFile), user.User.Exec
+			if config.exec != nil {
+				config.exec.dir = dir
+			}
+			certificate, err := kubeconfigData(user.User.ClientCertificateData, resolve(user.User.ClientCertificate))
+			if err != nil {
+				return nil, errors.Wrap(err, "could not read the kubeconfig's client certificate")
+			}
+			key, err := kubeconfigData(user.User.ClientKeyData, resolve(user.User.ClientKey))
+			if err != nil {
+				return nil, errors.Wrap(err, "could not read the kubeconfig's client key")
+			}
+			if certificate != nil {
+				pair, err := tls.X509KeyPair(certificate, key)
+				if err != nil {
+					return nil, errors.Wrap(err, "could not load the kubeconfig's client certificate")
+				}
+				tlsConfig.Certificates = []tls.Certificate{pair}
+			}
+		}
+		config.Client = kubernetesClient(tlsConfig)
+	}
+	if !found {
+		return nil, errors.Errorf("kubeconfig has no context %q", parsed.CurrentContext)
+	}
+	if config.Server == "" {
+		return nil, errors.New("kubeconfig's current context has no server")
+	}
+	if config.Namespace == "" {
+		config.Namespace = "default"
+	}
+	return config, nil
+}
+
+// kubeconfigData returns the base64 encoded data if it's set, or else the
+// contents of the file if that's set
+func kubeconfigData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func kubernetesClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: kubernetesTimeout, Transport: transport}
+}
+
+// bearerToken returns the token to authenticate requests with, or nothing if
+// they're authenticated with a client certificate
+func (c *KubernetesConfig) bearerToken(ctx context.Context) (string, error) {
+	switch {
+	case c.exec != nil:
+		return c.runExec(ctx)
+	case c.tokenFile != "":
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "could not read kubernetes token")
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	return c.token, nil
+}
+
+// runExec runs the credential plugin to get a token, reusing it until it
+// expires
+func (c *KubernetesConfig) runExec(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.execToken != "" && (c.execExpires.IsZero() || time.Until(c.execExpires) > time.Minute) {
+		return c.execToken, nil
+	}
+
+	command := c.exec.Command
+	if strings.Contains(command, string(filepath.Separator)) && !filepath.IsAbs(command) {
+		command = filepath.Join(c.exec.dir, command)
+	}
+	cmd := exec.CommandContext(ctx, command, c.exec.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range c.exec.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": c.exec.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode exec credential info")
+	}
+	cmd.Env = append(cmd.Env, "KUBERNETES_EXEC_INFO="+string(info))
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			err = errors.Wrap(err, message)
+		}
+		return "", errors.Wrap(err, "could not run kubeconfig credential plugin")
+	}
+
+	credential := execCredential{}
+	err = json.Unmarshal(output, &credential)
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode kubeconfig credential plugin output")
+	}
+	if credential.Status.Token == "" {
+		return "", errors.New("kubeconfig credential plugin returned no token; only tokens are supported")
+	}
+	c.execToken, c.execExpires = credential.Status.Token, credential.Status.ExpirationTimestamp
+	return c.execToken, nil
+}
+
+// kubernetesStatus is the body of an error response from the API server
+type kubernetesStatus struct {
+	Message string `json:"message"`
+}
+
+// request makes a request to the API server, encoding body as JSON if it
+// isn't nil, and decodes the response into v. Unsuccessful responses are
+// returned as a statusError, wrapped with the error message.
+func (c *KubernetesConfig) request(ctx context.Context, method, path string, body, v interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "could not encode request")
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.Server, "/")+path, bytes.NewReader(encoded))
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	token, err := c.bearerToken(ctx)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := clientOrDefault(c.Client).Do(request)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		status := kubernetesStatus{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		if status.Message == "" {
+			return &statusError{resp.StatusCode}
+		}
+		return errors.Wrap(&statusError{resp.StatusCode}, status.Message)
+	}
+	return decodeJSONResponse(resp, v)
+}
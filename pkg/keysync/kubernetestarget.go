@@ -0,0 +1,149 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KubernetesSecret and KubernetesConfigMap are the kinds of object a
+	// KubernetesTarget can be
+	KubernetesSecret    = "Secret"
+	KubernetesConfigMap = "ConfigMap"
+)
+
+// KubernetesTarget is a key of a kubernetes Secret or ConfigMap, holding an
+// authorized_keys file for pods that run sshd to mount. The rest of the
+// object is left as it is. The object is replaced with the API server's
+// optimistic concurrency, so the update is abandoned if it changed since it
+// was read.
+type KubernetesTarget struct {
+	// Kind is KubernetesSecret or KubernetesConfigMap
+	Kind      string
+	Namespace string
+	Name      string
+	Key       string
+	Config    *KubernetesConfig
+	// Create, if set, creates the object if it doesn't exist
+	Create bool
+}
+
+// String names the target in logs, e.g.
+// kubernetes:configmaps/default/bastion-keys/authorized_keys
+func (t *KubernetesTarget) String() string {
+	return "kubernetes:" + t.resource() + "/" + t.Namespace + "/" + t.Name + "/" + t.Key
+}
+
+// resource is the plural name the API server knows the kind by
+func (t *KubernetesTarget) resource() string {
+	if t.Kind == KubernetesSecret {
+		return "secrets"
+	}
+	return "configmaps"
+}
+
+func (t *KubernetesTarget) path() string {
+	return "/api/v1/namespaces/" + url.PathEscape(t.Namespace) + "/" + t.resource() + "/" + url.PathEscape(t.Name)
+}
+
+func (t *KubernetesTarget) Update(ctx context.Context, update func(current []byte) ([]byte, error)) error {
+	object, err := t.read(ctx)
+	if err != nil {
+		return err
+	}
+	if object == nil && !t.Create {
+		return errors.Errorf("%v does not exist", t)
+	}
+	current, err := t.value(object)
+	if err != nil {
+		return err
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	if object != nil && bytes.Equal(current, updated) {
+		slog.Debug("kubernetes object is up to date", "target", t.String())
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	value := string(updated)
+	if t.Kind == KubernetesSecret {
+		value = base64.StdEncoding.EncodeToString(updated)
+	}
+	if object == nil {
+		slog.Info("creating kubernetes object", "target", t.String())
+		object = map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       t.Kind,
+			"metadata":   map[string]interface{}{"name": t.Name, "namespace": t.Namespace},
+			"data":       map[string]interface{}{t.Key: value},
+		}
+		err = t.Config.request(ctx, http.MethodPost, "/api/v1/namespaces/"+url.PathEscape(t.Namespace)+"/"+t.resource(), object, &object)
+	} else {
+		data, _ := object["data"].(map[string]interface{})
+		if data == nil {
+			data = map[string]interface{}{}
+			object["data"] = data
+		}
+		data[t.Key] = value
+		// the object's resourceVersion is sent back with it, so the write
+		// conflicts if it changed since it was read
+		err = t.Config.request(ctx, http.MethodPut, t.path(), object, &object)
+	}
+	if statusErr, ok := errors.Cause(err).(*statusError); ok && statusErr.code == http.StatusConflict {
+		return errors.Errorf("%v changed while syncing, try again", t)
+	} else if err != nil {
+		return errors.Wrapf(err, "could not write %v", t)
+	}
+	return nil
+}
+
+// Read returns the value of the key, or nothing if the object doesn't exist
+// and would be created
+func (t *KubernetesTarget) Read() ([]byte, error) {
+	object, err := t.read(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if object == nil && !t.Create {
+		return nil, errors.Errorf("%v does not exist", t)
+	}
+	return t.value(object)
+}
+
+// read fetches the object, returning nil if it doesn't exist
+func (t *KubernetesTarget) read(ctx context.Context) (map[string]interface{}, error) {
+	object := map[string]interface{}{}
+	err := t.Config.request(ctx, http.MethodGet, t.path(), nil, &object)
+	if statusErr, ok := errors.Cause(err).(*statusError); ok && statusErr.code == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "could not read %v", t)
+	}
+	return object, nil
+}
+
+// value returns the value of the key in the object, decoding it if the object
+// is a secret
+func (t *KubernetesTarget) value(object map[string]interface{}) ([]byte, error) {
+	data, _ := object["data"].(map[string]interface{})
+	value, _ := data[t.Key].(string)
+	if t.Kind != KubernetesSecret {
+		return []byte(value), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode %v", t)
+	}
+	return decoded, nil
+}
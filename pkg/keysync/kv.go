@@ -0,0 +1,148 @@
+package keysync
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kvWatchWait is how long a watch waits for a key to change before starting
+// over, so a connection that silently died isn't waited on forever
+const kvWatchWait = 5 * time.Minute
+
+// errKVConflict is returned when a key changed since the revision it was to
+// be compared against
+var errKVConflict = errors.New("key changed since it was read")
+
+// KVStore is a key-value store that keysets are published to, so that a
+// single host fetching keys can feed a fleet watching the store, rather than
+// every host fetching them
+type KVStore interface {
+	// Get returns the value of the key, or nil if it doesn't exist, and the
+	// revision it was last changed at, which is 0 if it doesn't exist
+	Get(ctx context.Context, key string) ([]byte, uint64, error)
+	// Put sets the value of the key, if it's still at the revision, and
+	// returns errKVConflict otherwise
+	Put(ctx context.Context, key string, value []byte, revision uint64) error
+	// Watch waits until the key changes after the index, or for a while if
+	// it doesn't, and returns the index to wait from next. An index of 0
+	// returns the current index straight away.
+	Watch(ctx context.Context, key string, index uint64) (uint64, error)
+	// String names the store, e.g. consul://consul.example.com:8500
+	String() string
+}
+
+// ParseKVURL returns the store and key named by a url such as
+// consul://consul.example.com:8500/ssh/authorized_keys or
+// etcd+https://etcd.example.com:2379/ssh/authorized_keys. The key is the path
+// without its leading slash, and the port defaults to the store's usual one.
+func ParseKVURL(rawURL string, client *http.Client) (KVStore, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not parse url")
+	}
+	if u.User != nil {
+		return nil, "", errors.Errorf("credentials can't be given in the url of key %v", u.Redacted())
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, "", errors.Errorf("invalid key url %v, expected e.g. consul://consul.example.com:8500/ssh/authorized_keys", rawURL)
+	}
+
+	store, tls := strings.TrimSuffix(u.Scheme, "+https"), strings.HasSuffix(u.Scheme, "+https")
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	host := u.Host
+	switch store {
+	case "consul":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8500")
+		}
+		return &ConsulKV{URL: scheme + "://" + host, Client: client}, key, nil
+	case "etcd":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "2379")
+		}
+		return &EtcdKV{URL: scheme + "://" + host, Client: client}, key, nil
+	}
+	return nil, "", errors.Errorf("unsupported key store %q in %v, expected consul, consul+https, etcd or etcd+https", u.Scheme, rawURL)
+}
+
+// KVSource fetches keys from keysets published to etcd or consul, e.g. by a
+// KVTarget. The "username" for this source is the url of the key, as taken
+// by ParseKVURL.
+type KVSource struct {
+	Client *http.Client
+}
+
+func (s *KVSource) GetKeys(ctx context.Context, rawURL string) ([]PublicKey, error) {
+	store, key, err := ParseKVURL(rawURL, s.Client)
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		// so a keyset that's yet to be published is treated as a user
+		// that doesn't exist
+		return nil, errors.Wrap(&statusError{http.StatusNotFound}, "key does not exist")
+	}
+	return parseKeysDocument(value), nil
+}
+
+// WatchKV watches the key named by the url, calling changed whenever it
+// changes, until the context is cancelled. Failures are logged, and the watch
+// started over after a while. The client shouldn't time out requests, as
+// watches wait for changes for several minutes.
+func WatchKV(ctx context.Context, rawURL string, client *http.Client, changed func()) error {
+	store, key, err := ParseKVURL(rawURL, client)
+	if err != nil {
+		return err
+	}
+	go func() {
+		index := uint64(0)
+		backoff := time.Second
+		for ctx.Err() == nil {
+			next, err := store.Watch(ctx, key, index)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("could not watch key", "url", rawURL, "wait", backoff, "error", err)
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+				// the key may have changed while it wasn't watched
+				if index != 0 {
+					changed()
+				}
+				index = 0
+				continue
+			}
+			backoff = time.Second
+			if index != 0 && next != index {
+				slog.Debug("watched key changed", "url", rawURL, "index", next)
+				changed()
+			}
+			index = next
+		}
+	}()
+	return nil
+}
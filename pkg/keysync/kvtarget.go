@@ -0,0 +1,70 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+
+	"github.com/pkg/errors"
+)
+
+// KVTarget is a key of an etcd or consul key-value store, holding an
+// authorized_keys file for a fleet to consume with KVSource, so that only the
+// host syncing the target fetches keys. The key is set with the store's
+// compare-and-swap, so the update is abandoned if it changed since it was
+// read.
+type KVTarget struct {
+	Store KVStore
+	Key   string
+	// Create, if set, creates the key if it doesn't exist
+	Create bool
+}
+
+// String names the target in logs by its url, e.g.
+// consul://consul.example.com:8500/ssh/authorized_keys
+func (t *KVTarget) String() string {
+	return t.Store.String() + "/" + t.Key
+}
+
+func (t *KVTarget) Update(ctx context.Context, update func(current []byte) ([]byte, error)) error {
+	current, revision, err := t.Store.Get(ctx, t.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil && !t.Create {
+		return errors.Errorf("%v does not exist", t)
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	if current != nil && bytes.Equal(current, updated) {
+		slog.Debug("key is up to date", "target", t.String())
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if current == nil {
+		slog.Info("creating key", "target", t.String())
+	}
+	err = t.Store.Put(ctx, t.Key, updated, revision)
+	if err == errKVConflict {
+		return errors.Errorf("%v changed while syncing, try again", t)
+	}
+	return err
+}
+
+// Read returns the value of the key, or nothing if it doesn't exist and
+// would be created
+func (t *KVTarget) Read() ([]byte, error) {
+	current, _, err := t.Store.Get(context.Background(), t.Key)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil && !t.Create {
+		return nil, errors.Errorf("%v does not exist", t)
+	}
+	return current, nil
+}
@@ -0,0 +1,52 @@
+package keysync
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fileSourcePrefix = "file://"
+	stdinSource      = "-"
+)
+
+// IsLocalSource returns true if the username actually refers to a local
+// keyset, i.e. a file:// url or - for stdin
+func IsLocalSource(username string) bool {
+	return username == stdinSource || strings.HasPrefix(username, fileSourcePrefix)
+}
+
+// LocalSource reads keys from files given as file:// urls, or from Stdin if
+// the username is -. Stdin can only be read once, so its contents are kept
+// for subsequent syncs.
+type LocalSource struct {
+	Stdin io.Reader
+
+	stdinKeys []byte
+	stdinRead bool
+}
+
+func (c *LocalSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	if username == stdinSource {
+		if !c.stdinRead {
+			document, err := ioutil.ReadAll(c.Stdin)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not read keys from stdin")
+			}
+			c.stdinKeys = document
+			c.stdinRead = true
+		}
+		return parseKeysDocument(c.stdinKeys), nil
+	}
+
+	path := strings.TrimPrefix(username, fileSourcePrefix)
+	document, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read keys file")
+	}
+	return parseKeysDocument(document), nil
+}
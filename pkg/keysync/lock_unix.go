@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package keysync
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is how often to retry taking a lock that is held
+const lockPollInterval = 100 * time.Millisecond
+
+// lockExclusive takes an exclusive advisory lock on the file, waiting until it
+// is available or ctx is cancelled. The lock is released when the file is
+// closed.
+func lockExclusive(ctx context.Context, f *os.File) error {
+	for {
+		// a blocking flock can't be interrupted, so poll instead
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		timer := time.NewTimer(lockPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// tryLockExclusive takes an exclusive advisory lock on the file if it is
+// available, returning whether it was taken
+func tryLockExclusive(f *os.File) (bool, error) {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package keysync
+
+import (
+	"context"
+	"os"
+)
+
+// lockExclusive is a no-op on windows, where advisory locks aren't available
+// without additional dependencies
+func lockExclusive(ctx context.Context, f *os.File) error {
+	return nil
+}
+
+// tryLockExclusive always succeeds on windows, as with lockExclusive
+func tryLockExclusive(f *os.File) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package keysync
+
+import (
+	"strings"
+)
+
+// ManagedKey is a key in the target that was synced by us
+type ManagedKey struct {
+	// Key is the key type and base64 encoded key
+	Key         string
+	Fingerprint string
+	Source      string
+	Username    string
+	// SyncedOn is the date the key was first synced, in the format
+	// 2006-01-02. It and Source are empty for keys synced by old versions.
+	SyncedOn string
+}
+
+// ManagedKeys returns the synced keys currently in the target
+func (s *Syncer) ManagedKeys() ([]ManagedKey, error) {
+	contents, err := s.Target.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []ManagedKey{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		parsed, ok := parseAuthorizedKeysLine(line)
+		if !ok {
+			continue
+		}
+		comment, ok := s.parseSyncComment(parsed.comment)
+		if !ok {
+			continue
+		}
+		keys = append(keys, ManagedKey{
+			Key:         parsed.key(),
+			Fingerprint: fingerprint(parsed.key()),
+			Source:      comment.source,
+			Username:    comment.username,
+			SyncedOn:    comment.syncedOn,
+		})
+	}
+	return keys, nil
+}
@@ -0,0 +1,208 @@
+package keysync
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "sync_github_ssh_keys"
+
+var (
+	syncsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "syncs_total",
+		Help:      "Syncs run, by target and whether they succeeded.",
+	}, []string{"target", "result"})
+	lastSyncTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "When the last sync of the target finished, whether or not it succeeded.",
+	}, []string{"target"})
+	lastSyncSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_sync_success",
+		Help:      "Whether the last sync of the target succeeded.",
+	}, []string{"target"})
+	lastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "When the last successful sync of the target finished.",
+	}, []string{"target"})
+	managedKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_keys",
+		Help:      "Synced keys in the target as of the last sync that updated it.",
+	}, []string{"target"})
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "How long syncs take, including fetching keys.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"target"})
+	keysAdded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "keys_added_total",
+		Help:      "Keys added to the target.",
+	}, []string{"target"})
+	keysRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "keys_removed_total",
+		Help:      "Keys removed from the target.",
+	}, []string{"target"})
+	emptyKeysets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "empty_keysets",
+		Help:      "Users the source returned no keys for in the last sync of the target.",
+	}, []string{"target"})
+	fetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fetch_errors_total",
+		Help:      "Failures to fetch a user's keys, by type of failure.",
+	}, []string{"type"})
+	httpResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_responses_total",
+		Help:      "Responses to requests made to key sources, including retries, by status code.",
+	}, []string{"code"})
+)
+
+// registry holds just this package's metrics, without the process and go
+// runtime ones the default registry has, for writing to a textfile
+var registry = prometheus.NewRegistry()
+
+func init() {
+	collectors := []prometheus.Collector{
+		syncsTotal, lastSyncTimestamp, lastSyncSuccess, lastSuccessTimestamp, managedKeys,
+		syncDuration, keysAdded, keysRemoved, emptyKeysets, fetchErrors, httpResponses,
+	}
+	prometheus.MustRegister(collectors...)
+	registry.MustRegister(collectors...)
+}
+
+// WriteTextfile writes the sync metrics to path in the prometheus text format,
+// for node_exporter's textfile collector. The file is replaced atomically, so
+// the collector never reads a partial file.
+func WriteTextfile(path string) error {
+	err := prometheus.WriteToTextfile(path, registry)
+	if err != nil {
+		return errors.Wrap(err, "could not write metrics textfile")
+	}
+	return nil
+}
+
+// observeSync records the metrics for a sync that took the duration given. If
+// the sync updated the target, current and updated are its contents before
+// and after.
+func (s *Syncer) observeSync(duration time.Duration, current, updated []byte, err error) {
+	syncDuration.WithLabelValues(s.Name).Observe(duration.Seconds())
+	s.Statsd.timing("sync_duration", duration)
+	lastSyncTimestamp.WithLabelValues(s.Name).SetToCurrentTime()
+	if err != nil {
+		syncsTotal.WithLabelValues(s.Name, "failure").Inc()
+		s.Statsd.count("syncs.failure", 1)
+		lastSyncSuccess.WithLabelValues(s.Name).Set(0)
+	} else {
+		syncsTotal.WithLabelValues(s.Name, "success").Inc()
+		s.Statsd.count("syncs.success", 1)
+		lastSyncSuccess.WithLabelValues(s.Name).Set(1)
+		lastSuccessTimestamp.WithLabelValues(s.Name).SetToCurrentTime()
+	}
+
+	if updated != nil {
+		managedKeys.WithLabelValues(s.Name).Set(float64(s.countManagedKeys(updated)))
+		before, after := keySet(current), keySet(updated)
+		added, removed := countMissing(after, before), countMissing(before, after)
+		keysAdded.WithLabelValues(s.Name).Add(float64(added))
+		keysRemoved.WithLabelValues(s.Name).Add(float64(removed))
+		s.Statsd.count("keys_added", added)
+		s.Statsd.count("keys_removed", removed)
+	}
+}
+
+// keySet returns the keys in the authorized keys file, other than
+// certificates and certificate authorities
+func keySet(contents []byte) map[string]bool {
+	keys := map[string]bool{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if parsed, ok := parseAuthorizedKeysLine(line); ok && !parsed.forCertificates() {
+			keys[parsed.key()] = true
+		}
+	}
+	return keys
+}
+
+// countMissing returns how many of the keys in a aren't in b
+func countMissing(a, b map[string]bool) int {
+	n := 0
+	for key := range a {
+		if !b[key] {
+			n++
+		}
+	}
+	return n
+}
+
+// fetchErrorType classifies why fetching keys failed, for metrics
+func fetchErrorType(err error) string {
+	network := false
+	for err != nil {
+		switch e := err.(type) {
+		case *statusError:
+			switch {
+			case isNotFound(e):
+				return "not_found"
+			case e.code == http.StatusTooManyRequests:
+				return "rate_limited"
+			}
+			return "status"
+		case *rateLimitedError:
+			return "rate_limited"
+		case net.Error:
+			if e.Timeout() {
+				return "timeout"
+			}
+			network = true
+		}
+		switch err {
+		case context.DeadlineExceeded:
+			return "timeout"
+		case context.Canceled:
+			return "cancelled"
+		}
+
+		// errors wrapped by pkg/errors have a cause, while the standard
+		// library's unwrap
+		if causer, ok := err.(interface{ Cause() error }); ok {
+			err = causer.Cause()
+		} else if unwrapper, ok := err.(interface{ Unwrap() error }); ok {
+			err = unwrapper.Unwrap()
+		} else {
+			break
+		}
+	}
+
+	if network {
+		return "network"
+	}
+	return "other"
+}
+
+// metricsTransport counts the status codes of responses
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(request)
+	if err == nil {
+		httpResponses.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	}
+	return resp, err
+}
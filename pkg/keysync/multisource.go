@@ -0,0 +1,55 @@
+package keysync
+
+import (
+	"context"
+	"strings"
+)
+
+// MultiSource fetches the keys of usernames qualified with the name of one of
+// Sources, e.g. gitlab:alice, from that source, and those of every other
+// username from Default, so a target can be fed by several sources at once
+type MultiSource struct {
+	Default Source
+	Sources map[string]Source
+}
+
+func (m *MultiSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	for name, source := range m.Sources {
+		if strings.HasPrefix(username, name+":") {
+			return source.GetKeys(ctx, strings.TrimPrefix(username, name+":"))
+		}
+	}
+	return m.Default.GetKeys(ctx, username)
+}
+
+// splitUsername returns the source a username is fetched from, and the
+// username within it
+func (s *Syncer) splitUsername(username string) (string, string) {
+	for _, name := range append([]string{s.sourceName()}, s.Sources...) {
+		if strings.HasPrefix(username, name+":") {
+			return name, strings.TrimPrefix(username, name+":")
+		}
+	}
+	return s.sourceName(), username
+}
+
+// qualifyUsername returns how the username of the source is identified,
+// which is just the username for the default source, so that keys synced
+// before other sources were configured keep their owners
+func (s *Syncer) qualifyUsername(source, username string) string {
+	if source == s.sourceName() {
+		return username
+	}
+	for _, name := range s.Sources {
+		if name == source {
+			return source + ":" + username
+		}
+	}
+	return username
+}
+
+// normalizeUsername qualifies the username as keys synced for it record it,
+// e.g. github:alice is alice when github is the default source
+func (s *Syncer) normalizeUsername(username string) string {
+	return s.qualifyUsername(s.splitUsername(username))
+}
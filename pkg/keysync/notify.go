@@ -0,0 +1,153 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notifier sends a message to a chat channel, for people to spot unexpected
+// changes to keys
+type Notifier interface {
+	Notify(ctx context.Context, message string) error
+}
+
+// SlackNotifier posts messages to a slack incoming webhook
+type SlackNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, message string) error {
+	return postJSON(ctx, n.Client, http.MethodPost, n.URL, nil, map[string]string{"text": message})
+}
+
+// DiscordNotifier posts messages to a discord webhook
+type DiscordNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *DiscordNotifier) Notify(ctx context.Context, message string) error {
+	return postJSON(ctx, n.Client, http.MethodPost, n.URL, nil, map[string]string{"content": message})
+}
+
+// MatrixNotifier sends messages to a matrix room, as the user the access
+// token belongs to, which must have joined the room
+type MatrixNotifier struct {
+	// HomeserverURL is e.g. https://matrix.example.com
+	HomeserverURL string
+	// RoomID is e.g. !abcdefg:example.com
+	RoomID      string
+	AccessToken string
+	Client      *http.Client
+}
+
+func (n *MatrixNotifier) Notify(ctx context.Context, message string) error {
+	// the transaction id makes retries of the same message idempotent
+	txnID := fmt.Sprintf("sync-github-ssh-keys-%v", time.Now().UnixNano())
+	u := strings.TrimSuffix(n.HomeserverURL, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(n.RoomID) + "/send/m.room.message/" + txnID
+	header := http.Header{"Authorization": {"Bearer " + n.AccessToken}}
+	return postJSON(ctx, n.Client, http.MethodPut, u, header, map[string]string{"msgtype": "m.text", "body": message})
+}
+
+// postJSON sends the body encoded as JSON, failing unless the server
+// responds with a 2xx status
+func postJSON(ctx context.Context, client *http.Client, method, u string, header http.Header, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "could not encode request")
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(encoded))
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := clientOrDefault(client).Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("%v responded with %v", request.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+// notify sends the message to every notifier. Notifications are sent after
+// the fact, so failures are only logged.
+func (s *Syncer) notify(message string) {
+	for _, notifier := range s.Notifiers {
+		// the sync has finished, so notifications aren't tied to its context
+		err := notifier.Notify(context.Background(), message)
+		if err != nil {
+			slog.Error("could not send notification", "target", s.Name, "error", err)
+		}
+	}
+}
+
+// notifyFailures tells the notifiers once syncs have been failing for
+// NotifyFailingAfter, and when they succeed again after that
+func (s *Syncer) notifyFailures(err error) {
+	if s.NotifyFailingAfter == 0 || len(s.Notifiers) == 0 {
+		return
+	}
+	if err == nil {
+		if !s.notifiedFailing.IsZero() {
+			s.notify(fmt.Sprintf("syncing keys on host %v into %v succeeded again, after failing since %v", hostname(), s.Name, s.notifiedFailing.UTC().Format(time.RFC3339)))
+			s.notifiedFailing = time.Time{}
+		}
+		return
+	}
+
+	since := s.Status().FailingSince
+	if s.notifiedFailing.IsZero() && time.Since(since) >= s.NotifyFailingAfter {
+		s.notify(fmt.Sprintf("syncing keys on host %v into %v has failed since %v: %v", hostname(), s.Name, since.UTC().Format(time.RFC3339), err))
+		s.notifiedFailing = since
+	}
+}
+
+// changesMessage describes the keys added and removed, one per line, e.g.
+// "added key SHA256:abc for alice on host web-3 in /home/ubuntu/.ssh/authorized_keys"
+func changesMessage(changes []KeyChange) string {
+	host := hostname()
+	lines := []string{}
+	for _, change := range changes {
+		line := "added key "
+		if change.Action == "remove" {
+			line = "removed key "
+		}
+		line += change.Fingerprint
+		if change.Username != "" {
+			line += " for " + change.Username
+		}
+		lines = append(lines, line+" on host "+host+" in "+change.File)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hostname returns the name of this host, to say where something happened
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		slog.Warn("could not get hostname", "error", err)
+		return "unknown"
+	}
+	return host
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package keysync
+
+import (
+	"os"
+	"syscall"
+)
+
+// oNoFollow fails opening a file if it is a symlink
+const oNoFollow = syscall.O_NOFOLLOW
+
+// fileOwner returns the uid and gid that own the file
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// fileLinks returns the number of hard links to the file
+func fileLinks(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Nlink), true
+}
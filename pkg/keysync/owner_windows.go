@@ -0,0 +1,21 @@
+package keysync
+
+import (
+	"os"
+)
+
+// oNoFollow is 0 on windows, where creating symlinks takes privileges that
+// would make following them moot
+const oNoFollow = 0
+
+// fileOwner returns the uid and gid that own the file. Windows has no uids or
+// gids, so this always fails.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// fileLinks returns the number of hard links to the file, which os.FileInfo
+// doesn't expose on windows, so this always fails
+func fileLinks(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
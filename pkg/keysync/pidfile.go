@@ -0,0 +1,74 @@
+package keysync
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PIDFile is a file holding the pid of the process syncing a target. It is
+// locked for as long as the process holds it, so a second process, e.g. a
+// cron job alongside the daemon, can't sync the same target.
+type PIDFile struct {
+	path string
+	file *os.File
+}
+
+// ClaimPIDFile writes the pid of this process to the file at path, failing
+// if another running process holds it. As the file is truncated, it's opened
+// as lock files are, refusing links another user could point at a file they
+// want clobbered.
+func ClaimPIDFile(path string) (*PIDFile, error) {
+	file, err := openLockFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open pid file")
+	}
+
+	locked, err := tryLockExclusive(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "could not lock pid file")
+	}
+	if !locked {
+		contents, _ := ioutil.ReadAll(file)
+		file.Close()
+		pid := strings.TrimSpace(string(contents))
+		if pid == "" {
+			pid = "unknown"
+		}
+		return nil, errors.Errorf("another process (pid %v) holds %v, refusing to sync alongside it", pid, path)
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "could not write pid file")
+	}
+	return &PIDFile{path: path, file: file}, nil
+}
+
+// ClaimPIDFile claims a pid file alongside the authorized keys file, creating
+// its directory first if Create is set
+func (t *FileTarget) ClaimPIDFile() (*PIDFile, error) {
+	if t.Create {
+		err := t.createDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ClaimPIDFile(t.Path + ".pid")
+}
+
+// Release removes the pid file, letting other processes sync the target
+func (p *PIDFile) Release() {
+	// removing the file while it's still locked stops another process from
+	// taking the lock on a file that's about to disappear
+	os.Remove(p.path)
+	p.file.Close()
+}
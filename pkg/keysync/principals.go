@@ -0,0 +1,105 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AuthorizedPrincipals keeps an sshd AuthorizedPrincipalsFile in sync with the
+// users, for hosts that trust certificates signed by a CA rather than the
+// users' keys. Certificates with a user's github username as a principal are
+// accepted for the account the file is for. The synced principals are kept
+// between marker comments, so any others in the file are left as they are.
+type AuthorizedPrincipals struct {
+	Path      string
+	Usernames []string
+	// Members, if set, is called on each sync to list additional usernames
+	Members func(ctx context.Context) ([]string, error)
+	// Options are prepended to each principal, as in authorized_keys
+	Options string
+	// Marker starts the comments around the synced principals, defaulting
+	// to DefaultMarker
+	Marker string
+}
+
+// Sync lists the users and updates the file with them as principals. If the
+// members can't be listed, the file is left as it is.
+func (p *AuthorizedPrincipals) Sync(ctx context.Context) error {
+	usernames, err := githubUsernames(ctx, p.Usernames, p.Members)
+	if err != nil {
+		return err
+	}
+	// an empty team is more likely a mistake than a reason to lock everyone
+	// out
+	if len(usernames) == 0 {
+		return errors.New("no principals to sync")
+	}
+
+	current, err := ioutil.ReadFile(p.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read authorized principals file")
+	}
+
+	synced := bytes.NewBuffer(nil)
+	synced.WriteString(p.begin() + "\n")
+	for _, username := range usernames {
+		if p.Options != "" {
+			synced.WriteString(p.Options + " ")
+		}
+		synced.WriteString(username + "\n")
+	}
+	synced.WriteString(p.end() + "\n")
+
+	// the synced principals replace the previous ones where they were, or
+	// are appended
+	updated := bytes.NewBuffer(nil)
+	inSynced, replaced := false, false
+	for _, line := range strings.SplitAfter(string(current), "\n") {
+		switch {
+		case line == "":
+		case strings.TrimSpace(line) == p.begin():
+			inSynced = true
+		case strings.TrimSpace(line) == p.end():
+			inSynced = false
+			if !replaced {
+				updated.Write(synced.Bytes())
+				replaced = true
+			}
+		case !inSynced:
+			updated.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+		}
+	}
+	if inSynced {
+		return errors.Errorf("%v has no closing %q", p.Path, p.end())
+	}
+	if !replaced {
+		updated.Write(synced.Bytes())
+	}
+
+	if current != nil && bytes.Equal(current, updated.Bytes()) {
+		return nil
+	}
+	slog.Info("updating authorized principals file", "path", p.Path, "principals", len(usernames))
+	return replaceFile(p.Path, updated.Bytes(), 0644)
+}
+
+func (p *AuthorizedPrincipals) begin() string {
+	return "# " + p.marker() + ":principals:begin"
+}
+
+func (p *AuthorizedPrincipals) end() string {
+	return "# " + p.marker() + ":principals:end"
+}
+
+func (p *AuthorizedPrincipals) marker() string {
+	if p.Marker == "" {
+		return DefaultMarker
+	}
+	return p.Marker
+}
@@ -0,0 +1,108 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"unicode"
+)
+
+// RepairReport counts what Repair fixed
+type RepairReport struct {
+	// Duplicates is how many lines repeating a key earlier in the file were
+	// removed
+	Duplicates int
+	// Orphans is how many synced keys of users no longer synced were removed
+	Orphans int
+	// Normalized is how many lines had their whitespace or line ending
+	// normalized
+	Normalized int
+}
+
+// Changed checks if Repair changed anything
+func (r RepairReport) Changed() bool {
+	return r.Duplicates != 0 || r.Orphans != 0 || r.Normalized != 0
+}
+
+// Repair tidies the target without fetching any keys: it removes lines
+// repeating a key already in the file, removes synced keys of users that are
+// no longer synced, and normalizes the whitespace between fields and line
+// endings. Comments, blank lines and malformed lines are kept, other than
+// trailing whitespace.
+func (s *Syncer) Repair(ctx context.Context) (RepairReport, error) {
+	usernames, err := s.usernames(ctx)
+	if err != nil {
+		return RepairReport{}, err
+	}
+	synced := map[string]bool{}
+	for _, username := range usernames {
+		synced[username] = true
+	}
+
+	var report RepairReport
+	var previous, updated []byte
+	err = s.Target.Update(ctx, func(current []byte) ([]byte, error) {
+		report = RepairReport{}
+		seen := map[string]bool{}
+		output := bytes.NewBuffer(nil)
+		lines := strings.SplitAfter(string(current), "\n")
+		for _, line := range lines {
+			if line == "" {
+				continue
+			}
+			trimmed := strings.TrimRightFunc(line, unicode.IsSpace)
+
+			parsed, ok := parseAuthorizedKeysLine(trimmed)
+			if !ok {
+				if trimmed+"\n" != line {
+					report.Normalized++
+				}
+				output.WriteString(trimmed + "\n")
+				continue
+			}
+
+			key := parsed.key()
+			if seen[key] {
+				slog.Info("removing duplicate key", "action", "remove", "fingerprint", fingerprint(key), "key", key)
+				report.Duplicates++
+				continue
+			}
+			seen[key] = true
+
+			// keys from before usernames were tracked can't be told apart
+			if comment, ok := s.parseSyncComment(parsed.comment); ok && comment.username != "" && !synced[comment.username] {
+				slog.Info("removing key of user no longer synced", "action", "remove", "user", comment.username, "fingerprint", fingerprint(key), "key", key)
+				report.Orphans++
+				continue
+			}
+
+			normalized := parsed.String()
+			if normalized+"\n" != line {
+				report.Normalized++
+			}
+			output.WriteString(normalized + "\n")
+		}
+		previous, updated = current, output.Bytes()
+		return updated, nil
+	})
+	// the next sync has to add back any keys that are still wanted
+	s.last = nil
+	if err == nil {
+		s.audit(previous, updated)
+	}
+	return report, err
+}
+
+// String formats the line with its fields separated by single spaces
+func (l authorizedKeysLine) String() string {
+	fields := []string{}
+	if l.options != "" {
+		fields = append(fields, l.options)
+	}
+	fields = append(fields, l.keyType, l.blob)
+	if l.comment != "" {
+		fields = append(fields, l.comment)
+	}
+	return strings.Join(fields, " ")
+}
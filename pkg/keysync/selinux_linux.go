@@ -0,0 +1,56 @@
+package keysync
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// selinuxAttr is the extended attribute holding a file's SELinux context
+const selinuxAttr = "security.selinux"
+
+// selinuxEnabled checks if SELinux is enabled, in which case sshd refuses to
+// read an authorized_keys file without the right context, e.g. ssh_home_t
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// copyLabel gives the file at to the SELinux context of the file at from, so
+// a file replacing another by a rename keeps its context
+func copyLabel(from, to string) error {
+	if !selinuxEnabled() {
+		return nil
+	}
+	label := make([]byte, 256)
+	n, err := syscall.Getxattr(from, selinuxAttr, label)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read SELinux context of authorized keys file")
+	}
+	err = syscall.Setxattr(to, selinuxAttr, label[:n], 0)
+	return errors.Wrap(err, "could not set SELinux context of authorized keys file")
+}
+
+// restoreLabel runs restorecon on the file, if it's installed, to give it the
+// context the policy expects for its path
+func restoreLabel(path string) {
+	if !selinuxEnabled() {
+		return
+	}
+	restorecon, err := exec.LookPath("restorecon")
+	if err != nil {
+		slog.Debug("restorecon isn't installed, not restoring SELinux context", "path", path)
+		return
+	}
+	output, err := exec.Command(restorecon, path).CombinedOutput()
+	if err != nil {
+		slog.Warn("could not restore SELinux context", "path", path, "error", err, "output", strings.TrimSpace(string(output)))
+	}
+}
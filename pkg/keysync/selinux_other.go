@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package keysync
+
+// copyLabel is a no-op outside of linux, which has no SELinux
+func copyLabel(from, to string) error {
+	return nil
+}
+
+// restoreLabel is a no-op outside of linux, which has no SELinux
+func restoreLabel(path string) {}
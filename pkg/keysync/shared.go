@@ -0,0 +1,55 @@
+package keysync
+
+import (
+	"context"
+	"sync"
+)
+
+// SharedSource wraps a Source, fetching each user's keys only once between
+// calls to Reset, however many syncers ask for them, e.g. when pushing the
+// same keys to many hosts. Syncers asking for a user's keys while they're
+// being fetched wait for that fetch.
+type SharedSource struct {
+	Source Source
+
+	mu      sync.Mutex
+	fetches map[string]*sharedFetch
+}
+
+// sharedFetch is a fetch of a user's keys, which is done once done is closed
+type sharedFetch struct {
+	done chan struct{}
+	keys []PublicKey
+	err  error
+}
+
+func (s *SharedSource) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	s.mu.Lock()
+	if s.fetches == nil {
+		s.fetches = map[string]*sharedFetch{}
+	}
+	fetch, ok := s.fetches[username]
+	if !ok {
+		fetch = &sharedFetch{done: make(chan struct{})}
+		s.fetches[username] = fetch
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		fetch.keys, fetch.err = s.Source.GetKeys(ctx, username)
+		close(fetch.done)
+	}
+	select {
+	case <-fetch.done:
+		return fetch.keys, fetch.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reset forgets the keys fetched, so they're fetched again
+func (s *SharedSource) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches = nil
+}
@@ -0,0 +1,151 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AllowedSigners keeps an allowed_signers file, as read by ssh-keygen -Y
+// verify and git's gpg.ssh.allowedSignersFile, in sync with the ssh signing
+// keys users have registered on github, so git verify-commit works for their
+// commits. Each signer is allowed to sign as their public email and their
+// github noreply address. Lines for other signers are left as they are.
+type AllowedSigners struct {
+	Path string
+	// Github fetches the signing keys from its API
+	Github    *GithubSource
+	Usernames []string
+	// Members, if set, is called on each sync to list additional usernames
+	Members func(ctx context.Context) ([]string, error)
+	// Marker starts the comment marking synced signers, defaulting to
+	// DefaultMarker
+	Marker string
+}
+
+// githubSigner is the subset of a github API user object needed to know the
+// addresses they commit as
+type githubSigner struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+// Sync fetches every user's signing keys and updates the file with them. If
+// some users' keys can't be fetched, their lines are left as they are, and an
+// error is returned.
+func (a *AllowedSigners) Sync(ctx context.Context) error {
+	usernames, err := githubUsernames(ctx, a.Usernames, a.Members)
+	if err != nil {
+		return err
+	}
+
+	current, err := ioutil.ReadFile(a.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read allowed signers file")
+	}
+
+	lines := map[string][]string{}
+	failed := map[string]bool{}
+	for _, username := range usernames {
+		signerLines, err := a.signerLines(ctx, username)
+		if err != nil {
+			slog.Warn("could not get signing keys", "user", username, "error", err)
+			failed[strings.ToLower(username)] = true
+			continue
+		}
+		lines[strings.ToLower(username)] = signerLines
+	}
+
+	// other signers stay where they are, as do the users that failed
+	updated := bytes.NewBuffer(nil)
+	for _, line := range strings.SplitAfter(string(current), "\n") {
+		if line == "" {
+			continue
+		}
+		username, ok := a.parseMarker(line)
+		if !ok || failed[username] {
+			updated.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+		}
+	}
+	for _, username := range usernames {
+		for _, line := range lines[strings.ToLower(username)] {
+			updated.WriteString(line + "\n")
+		}
+	}
+
+	if current == nil || !bytes.Equal(current, updated.Bytes()) {
+		slog.Info("updating allowed signers file", "path", a.Path, "users", len(lines))
+		err = replaceFile(a.Path, updated.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(failed) != 0 {
+		return errors.Errorf("could not get signing keys for %v of %v users", len(failed), len(usernames))
+	}
+	return nil
+}
+
+// signerLines returns the allowed_signers lines for the user's signing keys
+func (a *AllowedSigners) signerLines(ctx context.Context, username string) ([]string, error) {
+	signer := githubSigner{}
+	err := a.Github.getAllPages(ctx, fmt.Sprintf("%v/users/%v", a.Github.apiURL(), username), func(resp *http.Response) error {
+		return decodeJSONResponse(resp, &signer)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []PublicKey{}
+	err = a.Github.getAllPages(ctx, fmt.Sprintf("%v/users/%v/ssh_signing_keys?per_page=100", a.Github.apiURL(), username), func(resp *http.Response) error {
+		page := []PublicKey{}
+		err := decodeJSONResponse(resp, &page)
+		keys = append(keys, page...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// commits made through the web, or with email privacy on, use the
+	// noreply address
+	principals := fmt.Sprintf("%v+%v@users.noreply.%v", signer.ID, signer.Login, a.Github.hostname())
+	if signer.Email != "" {
+		principals = signer.Email + "," + principals
+	}
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf(`%v namespaces="git" %v %v:github:%v`, principals, NormalizeKey(key.Key), a.marker(), strings.ToLower(username)))
+	}
+	return lines, nil
+}
+
+func (a *AllowedSigners) marker() string {
+	if a.Marker == "" {
+		return DefaultMarker
+	}
+	return a.Marker
+}
+
+// parseMarker returns the username of a synced signer's line
+func (a *AllowedSigners) parseMarker(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return "", false
+	}
+	prefix := a.marker() + ":github:"
+	last := fields[len(fields)-1]
+	if !strings.HasPrefix(last, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(last, prefix), true
+}
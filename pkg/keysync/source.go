@@ -0,0 +1,127 @@
+package keysync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PublicKey is a public key fetched from a Source. Keys fetched from a plain
+// .keys file only have the Key and Options fields set; APIs may provide
+// metadata.
+type PublicKey struct {
+	ID        int64     `json:"id"`
+	Key       string    `json:"key"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	// Options are the options the key was listed with in an authorized_keys
+	// document, e.g. command="backup",restrict, which are kept whenever it's
+	// written out, so a restricted key never becomes one to log in with
+	Options string `json:"-"`
+}
+
+// Source fetches the public keys registered for a user
+type Source interface {
+	GetKeys(ctx context.Context, username string) ([]PublicKey, error)
+}
+
+// WithLocalSources returns a Source that reads keys for file:// and stdin
+// "usernames" with local, and everything else with source
+func WithLocalSources(local *LocalSource, source Source) Source {
+	return &withLocalSources{local: local, source: source}
+}
+
+type withLocalSources struct {
+	local  *LocalSource
+	source Source
+}
+
+func (s *withLocalSources) GetKeys(ctx context.Context, username string) ([]PublicKey, error) {
+	if IsLocalSource(username) {
+		return s.local.GetKeys(ctx, username)
+	}
+	return s.source.GetKeys(ctx, username)
+}
+
+// NormalizeKey strips any comment or trailing whitespace from the key, leaving
+// just the key type and base64 blob that authorized keys lines are compared by
+func NormalizeKey(key string) string {
+	parts := strings.Fields(key)
+	if len(parts) < 2 {
+		return key
+	}
+	return parts[0] + " " + parts[1]
+}
+
+// getKeysFile makes the request and parses the response as a list of public
+// keys, one per line, as served by the .keys endpoints of github and friends
+func getKeysFile(client *http.Client, request *http.Request) ([]PublicKey, error) {
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not make request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &statusError{resp.StatusCode}
+	}
+
+	publicKeys := []PublicKey{}
+	buf := bufio.NewReader(resp.Body)
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "failed to read response body")
+		}
+
+		line = strings.TrimSpace(line)
+		if line != "" {
+			publicKeys = append(publicKeys, PublicKey{Key: line})
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return publicKeys, nil
+}
+
+// decodeJSONResponse checks the status code of a JSON API response and decodes
+// its JSON body into v, closing the body
+func decodeJSONResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{resp.StatusCode}
+	}
+
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrap(err, "could not decode response body")
+	}
+	return nil
+}
+
+// statusError is returned when a source responds with an unsuccessful status
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("invalid status code: %v", e.code)
+}
+
+// isNotFound checks if the error is a source reporting that the user doesn't
+// exist, rather than a failure that might not happen again
+func isNotFound(err error) bool {
+	statusErr, ok := errors.Cause(err).(*statusError)
+	return ok && (statusErr.code == http.StatusNotFound || statusErr.code == http.StatusGone)
+}
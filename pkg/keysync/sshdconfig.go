@@ -0,0 +1,255 @@
+package keysync
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultAuthorizedKeysFiles are the files sshd reads keys from if its config
+// doesn't set AuthorizedKeysFile
+var DefaultAuthorizedKeysFiles = []string{".ssh/authorized_keys", ".ssh/authorized_keys2"}
+
+// maxSshdIncludeDepth bounds how deeply Include directives are followed, as
+// sshd does, to stop include loops
+const maxSshdIncludeDepth = 16
+
+// SshdAuthorizedKeysFiles returns the files sshd, configured by the
+// sshd_config at configPath, reads the user's authorized keys from, in the
+// order it reads them. It follows Include directives and applies Match blocks
+// on User and Group. Match blocks on anything else, such as the address a
+// connection comes from, can't be known ahead of time, so are skipped.
+func SshdAuthorizedKeysFiles(configPath string, u *user.User) ([]string, error) {
+	groups, err := groupNames(u)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &sshdConfigParser{user: u, groups: groups, dir: filepath.Dir(configPath)}
+	err = parser.parseFile(configPath, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	files := parser.authorizedKeysFiles
+	if files == nil {
+		files = DefaultAuthorizedKeysFiles
+	}
+	paths := []string{}
+	for _, file := range files {
+		if file == "none" {
+			continue
+		}
+		// OpenSSH for windows expands __PROGRAMDATA__, e.g. to find
+		// administrators_authorized_keys
+		file = strings.Replace(file, "__PROGRAMDATA__", os.Getenv("ProgramData"), -1)
+		expanded := ExpandPathTokens(file, u)
+		// relative paths are relative to the user's home directory
+		if !filepath.IsAbs(expanded) {
+			expanded = filepath.Join(u.HomeDir, expanded)
+		}
+		paths = append(paths, expanded)
+	}
+	return paths, nil
+}
+
+// ExpandPathTokens expands the tokens sshd expands in AuthorizedKeysFile
+// paths for the user: %h for their home directory, %u for their username,
+// %U for their uid, and %% for a literal %
+func ExpandPathTokens(path string, u *user.User) string {
+	return strings.NewReplacer("%%", "%", "%h", u.HomeDir, "%u", u.Username, "%U", u.Uid).Replace(path)
+}
+
+// ValidPathTokens checks that every % in the path starts a token that
+// ExpandPathTokens expands
+func ValidPathTokens(path string) bool {
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' {
+			continue
+		}
+		if i+1 == len(path) || !strings.ContainsRune("%huU", rune(path[i+1])) {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// groupNames returns the names of the groups the user belongs to
+func groupNames(u *user.User) ([]string, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not look up groups of %v", u.Username)
+	}
+	names := []string{}
+	for _, id := range ids {
+		group, err := user.LookupGroupId(id)
+		if err != nil {
+			// groups without names can't be matched by name
+			continue
+		}
+		names = append(names, group.Name)
+	}
+	return names, nil
+}
+
+type sshdConfigParser struct {
+	user   *user.User
+	groups []string
+	// dir is the directory relative Include paths are relative to
+	dir string
+
+	// inMatch is set while in a Match block, and matching is whether that
+	// block applies to the user
+	inMatch  bool
+	matching bool
+	// authorizedKeysFiles is the first AuthorizedKeysFile that applies, as
+	// sshd takes the first value set for each keyword
+	authorizedKeysFiles []string
+}
+
+func (p *sshdConfigParser) parseFile(configPath string, depth int) error {
+	if depth > maxSshdIncludeDepth {
+		return errors.Errorf("too many nested includes in %v", configPath)
+	}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return errors.Wrap(err, "could not read sshd config")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		keyword, args := splitSshdConfigLine(scanner.Text())
+		switch keyword {
+		case "":
+		case "include":
+			// an included file's own Match blocks end with it
+			inMatch, matching := p.inMatch, p.matching
+			for _, pattern := range args {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(p.dir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return errors.Wrapf(err, "invalid include in %v", configPath)
+				}
+				sort.Strings(matches)
+				for _, match := range matches {
+					err := p.parseFile(match, depth+1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			p.inMatch, p.matching = inMatch, matching
+		case "match":
+			p.inMatch = true
+			p.matching = p.match(args)
+		case "authorizedkeysfile":
+			if p.authorizedKeysFiles == nil && (!p.inMatch || p.matching) {
+				p.authorizedKeysFiles = args
+			}
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "could not read %v", configPath)
+}
+
+// match checks if a Match line's criteria all apply to the user
+func (p *sshdConfigParser) match(args []string) bool {
+	if len(args) == 1 && strings.ToLower(args[0]) == "all" {
+		return true
+	}
+	if len(args)%2 != 0 {
+		slog.Warn("skipping malformed Match block in sshd config", "criteria", strings.Join(args, " "))
+		return false
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		var matched bool
+		switch strings.ToLower(args[i]) {
+		case "user":
+			matched = matchPatternList(args[i+1], []string{p.user.Username})
+		case "group":
+			matched = matchPatternList(args[i+1], p.groups)
+		default:
+			slog.Debug("skipping Match block in sshd config that depends on the connection", "criteria", strings.Join(args, " "))
+			return false
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPatternList checks if any of the values match a comma separated list
+// of sshd patterns, and none match a pattern negated with a leading !
+func matchPatternList(patterns string, values []string) bool {
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for _, value := range values {
+			// users and groups on windows are case insensitive
+			if runtime.GOOS == "windows" {
+				pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+			}
+			if ok, _ := path.Match(pattern, value); ok {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// splitSshdConfigLine returns the lower cased keyword of a line of sshd
+// config and its arguments, which may be double quoted, or an empty keyword
+// for blank lines and comments
+func splitSshdConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	keyword, rest := line, ""
+	if i := strings.IndexAny(line, " \t="); i != -1 {
+		keyword, rest = line[:i], strings.TrimLeft(line[i:], " \t")
+	}
+	// the keyword can be separated from its arguments by an =
+	rest = strings.TrimPrefix(rest, "=")
+
+	words := []string{}
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return strings.ToLower(keyword), words
+}
@@ -0,0 +1,209 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConnectTimeout bounds how long connecting to a host and authenticating
+// can take
+const sshConnectTimeout = 10 * time.Second
+
+// sshChangedExitCode is what the update script exits with when the file
+// changed since it was read
+const sshChangedExitCode = 3
+
+// SSHTarget is an authorized_keys file on a remote host, read and replaced
+// over ssh with POSIX shell commands, for hosts the tool isn't installed on.
+// Like FileTarget, the file is replaced by writing a temporary file alongside
+// it and renaming that into place. Rather than locking it, the update is
+// abandoned if the file changed since it was read.
+type SSHTarget struct {
+	// Addr is the host and port to connect to
+	Addr string
+	// Path is the file on the host, relative to the home directory of the
+	// user logged in as if not absolute
+	Path   string
+	Config *ssh.ClientConfig
+	// Create, if set, creates the file with mode 0600, and its directory
+	// with mode 0700, if they don't exist
+	Create bool
+
+	mu      sync.Mutex
+	changed bool
+}
+
+// String names the target in logs, e.g. deploy@web1:22:.ssh/authorized_keys
+func (t *SSHTarget) String() string {
+	return fmt.Sprintf("%v@%v:%v", t.Config.User, t.Addr, t.Path)
+}
+
+// Changed checks if the last update changed the file
+func (t *SSHTarget) Changed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.changed
+}
+
+func (t *SSHTarget) Update(ctx context.Context, update func(current []byte) ([]byte, error)) error {
+	t.mu.Lock()
+	t.changed = false
+	t.mu.Unlock()
+
+	client, err := t.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	// abandon the update if ctx is cancelled part way through
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	current, checksum, err := t.read(client)
+	if err != nil {
+		return err
+	}
+	if current == nil && !t.Create {
+		return errors.Errorf("%v does not exist", t)
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	if current != nil && bytes.Equal(current, updated) {
+		slog.Debug("authorized keys file is up to date", "target", t.String())
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	script := "set -e; umask 077; f=" + shellQuote(t.Path) + "\n" +
+		`if [ "$(cat "$f" 2>/dev/null | cksum)" != ` + shellQuote(checksum) + " ]; then exit " + fmt.Sprint(sshChangedExitCode) + "; fi\n" +
+		`mkdir -p "$(dirname "$f")"` + "\n" +
+		`t="$f.sgsk-tmp.$$"` + "\n" +
+		// so a failed write, or a dropped connection, doesn't leave the
+		// temporary file behind; once it's renamed there's nothing to remove
+		`trap 'rm -f "$t"' EXIT; trap 'exit 1' HUP INT TERM` + "\n" +
+		`cat > "$t"` + "\n" +
+		// a dropped connection ends the input early, rather than failing cat
+		`[ "$(wc -c < "$t" | tr -d ' ')" = ` + fmt.Sprint(len(updated)) + ` ] || { echo "incomplete write" >&2; exit 1; }` + "\n" +
+		`mv -f "$t" "$f"` + "\n"
+	_, err = t.run(client, script, updated)
+	if exitErr, ok := errors.Cause(err).(*ssh.ExitError); ok && exitErr.ExitStatus() == sshChangedExitCode {
+		return errors.Errorf("%v changed while syncing, try again", t)
+	} else if err != nil {
+		return errors.Wrapf(err, "could not write %v", t)
+	}
+
+	t.mu.Lock()
+	t.changed = true
+	t.mu.Unlock()
+	return nil
+}
+
+// Read returns the contents of the file, or nothing if it doesn't exist and
+// would be created
+func (t *SSHTarget) Read() ([]byte, error) {
+	client, err := t.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	current, _, err := t.read(client)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil && !t.Create {
+		return nil, errors.Errorf("%v does not exist", t)
+	}
+	return current, nil
+}
+
+// read returns the contents of the file, or nil if it doesn't exist, along
+// with its checksum as printed by cksum, to check it's unchanged before
+// replacing it
+func (t *SSHTarget) read(client *ssh.Client) ([]byte, string, error) {
+	// the checksum is on the first line, then the file follows, if it exists
+	script := "f=" + shellQuote(t.Path) + "\n" +
+		`cat "$f" 2>/dev/null | cksum` + "\n" +
+		`if [ -e "$f" ]; then echo y; cat "$f"; else echo n; fi` + "\n"
+	output, err := t.run(client, script, nil)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "could not read %v", t)
+	}
+
+	parts := bytes.SplitN(output, []byte("\n"), 3)
+	if len(parts) != 3 {
+		return nil, "", errors.Errorf("unexpected output reading %v", t)
+	}
+	checksum := string(parts[0])
+	if string(parts[1]) == "n" {
+		return nil, checksum, nil
+	}
+	return parts[2], checksum, nil
+}
+
+// run runs the script with sh on the host, writing stdin to it, and returns
+// its output
+func (t *SSHTarget) run(client *ssh.Client, script string, stdin []byte) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open session")
+	}
+	defer session.Close()
+
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	session.Stdin = bytes.NewReader(stdin)
+	session.Stdout = stdout
+	session.Stderr = stderr
+	// the login shell may not be POSIX, so the script is run by sh
+	err = session.Run("sh -c " + shellQuote(script))
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, errors.Wrap(err, message)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// dial connects and authenticates to the host
+func (t *SSHTarget) dial(ctx context.Context) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: sshConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to %v", t.Addr)
+	}
+	// the handshake has no timeout of its own
+	conn.SetDeadline(time.Now().Add(sshConnectTimeout))
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, t.Addr, t.Config)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "could not log in to %v", t.Addr)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,49 @@
+package keysync
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StatsdClient sends metrics to a statsd server, such as the datadog agent,
+// over udp. Metrics are named under metricsNamespace, e.g.
+// sync_github_ssh_keys.syncs.success.
+type StatsdClient struct {
+	conn net.Conn
+}
+
+// NewStatsdClient returns a client that sends metrics to the statsd server
+// at addr, e.g. localhost:8125
+func NewStatsdClient(addr string) (*StatsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to statsd")
+	}
+	return &StatsdClient{conn: conn}, nil
+}
+
+// count adds n to the counter name
+func (c *StatsdClient) count(name string, n int) {
+	c.send(fmt.Sprintf("%v.%v:%v|c", metricsNamespace, name, n))
+}
+
+// timing records the duration of name in milliseconds
+func (c *StatsdClient) timing(name string, duration time.Duration) {
+	c.send(fmt.Sprintf("%v.%v:%v|ms", metricsNamespace, name, duration.Milliseconds()))
+}
+
+// send writes a metric, if there is a client. Metrics are best effort, so
+// failures are only logged.
+func (c *StatsdClient) send(metric string) {
+	if c == nil {
+		return
+	}
+	_, err := c.conn.Write([]byte(metric))
+	if err != nil {
+		slog.Debug("could not send metric to statsd", "metric", metric, "error", err)
+	}
+}
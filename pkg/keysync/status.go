@@ -0,0 +1,106 @@
+package keysync
+
+import (
+	"strings"
+	"time"
+)
+
+// Status is a snapshot of a syncer's state, for debugging and monitoring
+type Status struct {
+	// Usernames are the users keys were last synced for, including any
+	// members
+	Usernames []string
+	// LastSync is when the last sync finished, and LastSuccess when the last
+	// one to succeed did. Both are zero if there hasn't been one.
+	LastSync    time.Time
+	LastSuccess time.Time
+	// LastError is the error the last sync failed with, if it failed
+	LastError error
+	// ConsecutiveFailures is how many syncs in a row have failed, and
+	// FailingSince when the first of them finished
+	ConsecutiveFailures int
+	FailingSince        time.Time
+	// ManagedKeys is the number of synced keys in the target as of the last
+	// sync that updated it
+	ManagedKeys int
+	// UserLastFetched is when keys were last fetched successfully for each
+	// user
+	UserLastFetched map[string]time.Time
+}
+
+// Status returns the current state of the syncer. It is safe to call while a
+// sync is in progress.
+func (s *Syncer) Status() Status {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	status := s.status
+	if status.Usernames == nil {
+		status.Usernames = s.Usernames
+	}
+	status.UserLastFetched = map[string]time.Time{}
+	for username, fetched := range s.status.UserLastFetched {
+		status.UserLastFetched[username] = fetched
+	}
+	return status
+}
+
+// recordFetch records the users keys were synced for, which of them failed to
+// be fetched, and which weren't fetched as their keys are stable
+func (s *Syncer) recordFetch(usernames []string, failedUsernames, skippedUsernames map[string]bool) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	now := time.Now()
+	s.status.Usernames = usernames
+	if s.status.UserLastFetched == nil {
+		s.status.UserLastFetched = map[string]time.Time{}
+	}
+	for _, username := range usernames {
+		if !failedUsernames[username] && !skippedUsernames[username] {
+			s.status.UserLastFetched[username] = now
+		}
+	}
+}
+
+// recordSync records the outcome of a sync, and what it left in the target if
+// it got as far as updating it. It returns how many syncs in a row have
+// failed, including this one, or if it succeeded, how many failed before it.
+func (s *Syncer) recordSync(contents []byte, err error) int {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	s.status.LastSync = time.Now()
+	s.status.LastError = err
+	if contents != nil {
+		s.status.ManagedKeys = s.countManagedKeys(contents)
+	}
+	if err != nil {
+		if s.status.ConsecutiveFailures == 0 {
+			s.status.FailingSince = s.status.LastSync
+		}
+		s.status.ConsecutiveFailures++
+		return s.status.ConsecutiveFailures
+	}
+	s.status.LastSuccess = s.status.LastSync
+	failures := s.status.ConsecutiveFailures
+	s.status.ConsecutiveFailures = 0
+	s.status.FailingSince = time.Time{}
+	return failures
+}
+
+// countManagedKeys returns the number of synced keys in the authorized keys
+// file
+func (s *Syncer) countManagedKeys(contents []byte) int {
+	n := 0
+	for _, line := range strings.Split(string(contents), "\n") {
+		parsed, ok := parseAuthorizedKeysLine(line)
+		if !ok {
+			continue
+		}
+		if _, ok := s.parseSyncComment(parsed.comment); ok {
+			n++
+		}
+	}
+	return n
+}
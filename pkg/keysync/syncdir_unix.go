@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package keysync
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// syncDir syncs the directory to disk, so a file renamed into it can't be
+// lost, or revert to the file it replaced, on a power loss
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "could not open authorized keys directory")
+	}
+	defer f.Close()
+	return errors.Wrap(f.Sync(), "could not sync authorized keys directory")
+}
@@ -0,0 +1,7 @@
+package keysync
+
+// syncDir is a no-op on windows, where directories can't be opened to sync
+// them, and renames are journaled by NTFS
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,441 @@
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backupTimeFormat is the format of the timestamps backups are named with
+const backupTimeFormat = "20060102T150405.000Z"
+
+// Target is somewhere synced keys are written to, holding a document in
+// authorized_keys format
+type Target interface {
+	// Update reads the current contents of the target and replaces them with
+	// the result of calling update on them. Cancelling ctx abandons the update
+	// if it hasn't started writing yet.
+	Update(ctx context.Context, update func(current []byte) ([]byte, error)) error
+	// Read returns the current contents of the target
+	Read() ([]byte, error)
+}
+
+// FileTarget is an authorized_keys file on the local filesystem. The file is
+// replaced atomically on each update, by writing the new contents to a
+// temporary file alongside it and renaming that into place, so a crash part
+// way through a write can never leave a truncated file behind.
+type FileTarget struct {
+	Path string
+	// Owner, if set, is the user the file belongs to. The file's owner, group
+	// and permissions are set on each update to satisfy sshd's StrictModes.
+	// Otherwise the existing file's owner, group and permissions are kept.
+	Owner *user.User
+	// Create, if set, creates the file with mode 0600, and its directory with
+	// mode 0700, or 0755 outside the owner's home directory, if they don't
+	// exist
+	Create bool
+	// Backups, if set, is how many copies of the file to keep from before
+	// it was changed, named e.g. authorized_keys.bak.20240501T120000.000Z
+	Backups int
+}
+
+func (t *FileTarget) Update(ctx context.Context, update func(current []byte) ([]byte, error)) error {
+	if t.Create {
+		err := t.createDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock, err := t.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// if the file is a symlink, replace the file it points to rather than
+	// the link itself, unless symlinks are refused
+	path := t.Path
+	if !t.refuseSymlinks() {
+		path, err = filepath.EvalSymlinks(t.Path)
+		if os.IsNotExist(err) {
+			path, err = t.Path, nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not resolve authorized keys file")
+		}
+	}
+
+	current, info, err := t.readFile(path)
+	if os.IsNotExist(errors.Cause(err)) && t.Create {
+		slog.Info("creating authorized keys file", "path", t.Path)
+		return t.replace(t.Path, nil, 0600, nil, update)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read authorized keys file")
+	}
+
+	return t.replace(path, current, info.Mode().Perm(), info, update)
+}
+
+// Read returns the contents of the file, or nothing if it doesn't exist and
+// would be created
+func (t *FileTarget) Read() ([]byte, error) {
+	current, _, err := t.readFile(t.Path)
+	if os.IsNotExist(errors.Cause(err)) && t.Create {
+		return nil, nil
+	}
+	return current, errors.Wrap(err, "could not read authorized keys file")
+}
+
+// refuseSymlinks checks if the file is written as root or on behalf of its
+// owner, where following a symlink would let whoever owns the directory have
+// any file on the system read, rewritten and handed over to them
+func (t *FileTarget) refuseSymlinks() bool {
+	return t.Owner != nil || os.Geteuid() == 0
+}
+
+// readFile returns the contents of the file at path and its info, refusing
+// symlinks and anything else that isn't a regular file if refuseSymlinks
+func (t *FileTarget) readFile(path string) ([]byte, os.FileInfo, error) {
+	flag := os.O_RDONLY
+	if t.refuseSymlinks() {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, nil, errors.Errorf("%v is a symlink, which isn't followed when running as root or with an owner", path)
+		}
+		// in case it's swapped for a symlink since
+		flag |= oNoFollow
+	}
+
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.refuseSymlinks() && !info.Mode().IsRegular() {
+		return nil, nil, errors.Errorf("%v is not a regular file", path)
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contents, info, nil
+}
+
+// lock takes an exclusive lock on a lock file alongside the authorized keys
+// file, so concurrent syncs can't interleave their reads and writes. The file
+// itself can't be locked, as it is replaced on every write. The lock file is
+// only opened for reading, so one left behind by root can still be locked by
+// the file's owner syncing their own keys, without handing it to them.
+func (t *FileTarget) lock(ctx context.Context) (func(), error) {
+	lockFile, err := openLockFile(t.Path+".lock", os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open lock file")
+	}
+
+	err = lockExclusive(ctx, lockFile)
+	if err != nil {
+		lockFile.Close()
+		return nil, errors.Wrap(err, "could not lock authorized keys file")
+	}
+
+	// closing the file releases the lock
+	return func() { lockFile.Close() }, nil
+}
+
+// openLockFile opens the file at path, creating it if it doesn't exist. It's
+// usually in a directory belonging to another user, who could otherwise point
+// a symlink or hard link at any file on the system and have root open it, so
+// links are refused, as is anything that isn't a regular file.
+func openLockFile(path string, flag int, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flag|os.O_CREATE|oNoFollow, mode)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, errors.Errorf("%v is not a regular file", path)
+	}
+	if links, ok := fileLinks(info); ok && links != 1 {
+		f.Close()
+		return nil, errors.Errorf("%v has %v hard links, refusing to use it", path, links)
+	}
+	return f, nil
+}
+
+// createDir creates the directory the file is in if it doesn't exist, owned
+// by the owner if one is set. Directories outside the owner's home directory,
+// such as /etc/ssh/keys for /etc/ssh/keys/%u, may be shared by several users,
+// so are left to whoever created them, and readable by the users sshd reads
+// the files as.
+func (t *FileTarget) createDir() error {
+	dir := filepath.Dir(t.Path)
+	shared := t.Owner != nil && !inDir(dir, t.Owner.HomeDir)
+	mode := os.FileMode(0700)
+	if shared {
+		mode = 0755
+	}
+	err := os.Mkdir(dir, mode)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not create authorized keys directory")
+	}
+
+	slog.Info("created directory", "path", dir)
+	if t.Owner != nil && !shared {
+		uid, gid, err := lookupOwner(t.Owner)
+		if err != nil {
+			return err
+		}
+		err = os.Chown(dir, uid, gid)
+		if err != nil {
+			return errors.Wrap(err, "could not chown authorized keys directory")
+		}
+	}
+	return nil
+}
+
+// replace atomically replaces the file at path with the result of calling
+// update on its current contents. The new file gets the given mode and the
+// owner of the existing file, if there is one, unless the target's owner is
+// set.
+func (t *FileTarget) replace(path string, current []byte, mode os.FileMode, existing os.FileInfo, update func(current []byte) ([]byte, error)) error {
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+
+	var uid, gid int
+	var hasOwner bool
+	if existing != nil {
+		uid, gid, hasOwner = fileOwner(existing)
+	}
+	if t.Owner != nil {
+		mode = 0600
+		uid, gid, err = lookupOwner(t.Owner)
+		if err != nil {
+			return err
+		}
+		hasOwner = true
+	}
+
+	// rewriting an unchanged file churns its mtime, and trips file integrity
+	// monitors
+	if existing != nil && bytes.Equal(current, updated) && existing.Mode().Perm() == mode {
+		currentUID, currentGID, ok := fileOwner(existing)
+		if !hasOwner || (ok && currentUID == uid && currentGID == gid) {
+			slog.Debug("authorized keys file is up to date", "path", path)
+			// put back an ACL that has been changed since
+			return secureFile(path, path)
+		}
+	}
+
+	if existing != nil && t.Backups > 0 {
+		err = t.backup(path, current, existing.Mode().Perm(), uid, gid, hasOwner)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary authorized keys file")
+	}
+	// once the rename succeeds, this is a no-op
+	defer os.Remove(tmp.Name())
+
+	err = writeFile(tmp, updated, mode, uid, gid, hasOwner)
+	if err != nil {
+		return err
+	}
+	// the ACL is decided by the file's final name, not its temporary one
+	err = secureFile(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	// the temporary file may have been created with a different SELinux
+	// context than the file it replaces, which sshd would refuse to read
+	if existing != nil {
+		err = copyLabel(path, tmp.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	// writeFile syncs the temporary file's contents, and syncing the
+	// directory before and after the rename gets its entry and then the
+	// rename to disk, so on ext4 and xfs a power loss leaves either the old
+	// file or the new one, never an empty or partly written one
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrap(err, "could not replace authorized keys file")
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	restoreLabel(path)
+
+	return nil
+}
+
+// replaceFile atomically replaces the file at path with the contents, keeping
+// its mode if it exists and otherwise creating it with the mode given
+func replaceFile(path string, contents []byte, mode os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+	// once the rename succeeds, this is a no-op
+	defer os.Remove(tmp.Name())
+
+	err = writeFile(tmp, contents, mode, 0, 0, false)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrapf(err, "could not replace %v", path)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// backup writes the current contents of the file at path to a timestamped
+// backup alongside it, then removes all but the newest Backups backups
+func (t *FileTarget) backup(path string, current []byte, mode os.FileMode, uid, gid int, hasOwner bool) error {
+	backupPath := path + ".bak." + time.Now().UTC().Format(backupTimeFormat)
+	f, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not create authorized keys backup")
+	}
+	err = writeFile(f, current, mode, uid, gid, hasOwner)
+	if err != nil {
+		os.Remove(backupPath)
+		return err
+	}
+	slog.Debug("backed up authorized keys file", "path", backupPath)
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return errors.Wrap(err, "could not list authorized keys backups")
+	}
+	backups := []string{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), filepath.Base(path)+".bak.") {
+			backups = append(backups, filepath.Join(filepath.Dir(path), file.Name()))
+		}
+	}
+	// the timestamps sort in the order the backups were made
+	sort.Strings(backups)
+	for len(backups) > t.Backups {
+		err := os.Remove(backups[0])
+		if err != nil {
+			return errors.Wrap(err, "could not remove old authorized keys backup")
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// writeFile writes the contents to f, sets its mode and owner, and syncs it
+// to disk before closing it
+func writeFile(f *os.File, contents []byte, mode os.FileMode, uid, gid int, hasOwner bool) error {
+	defer f.Close()
+
+	_, err := f.Write(contents)
+	if err != nil {
+		return errors.Wrap(err, "could not write new contents to authorized keys file")
+	}
+
+	err = f.Chmod(mode)
+	if err != nil {
+		return errors.Wrap(err, "could not chmod authorized keys file")
+	}
+
+	// temporary files are created owned by us, so only chown if that's wrong
+	if hasOwner && (uid != os.Geteuid() || gid != os.Getegid()) {
+		err = f.Chown(uid, gid)
+		if err != nil {
+			return errors.Wrap(err, "could not chown authorized keys file")
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return errors.Wrap(err, "could not sync authorized keys file")
+	}
+
+	return errors.Wrap(f.Close(), "could not close authorized keys file")
+}
+
+// inDir checks if path is dir or within it
+func inDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// DirectoryOwner returns the user that owns the closest existing directory
+// containing path, e.g. ~/.ssh or the home directory for an authorized_keys
+// file, which is who the file should belong to
+func DirectoryOwner(path string) (*user.User, error) {
+	dir := filepath.Dir(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			uid, _, ok := fileOwner(info)
+			if !ok {
+				return nil, errors.Errorf("could not determine owner of %v", dir)
+			}
+			return user.LookupId(strconv.Itoa(uid))
+		}
+		if !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			return nil, errors.Wrap(err, "could not stat authorized keys directory")
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func lookupOwner(owner *user.User) (int, int, error) {
+	uid, err := strconv.Atoi(owner.Uid)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid uid for %v", owner.Username)
+	}
+	gid, err := strconv.Atoi(owner.Gid)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid gid for %v", owner.Username)
+	}
+	return uid, gid, nil
+}
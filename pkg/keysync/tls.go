@@ -0,0 +1,91 @@
+package keysync
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// tlsConfig returns the tls config for the client's connections, or nil to use
+// the defaults
+func tlsConfig(config HTTPConfig) (*tls.Config, error) {
+	if config.CAFile == "" && len(config.PinnedSPKI) == 0 && config.ClientCertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		roots, err := certPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load tls client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(config.PinnedSPKI) != 0 {
+		tlsConfig.VerifyConnection = verifyPinnedSPKI(config.PinnedSPKI)
+	}
+	return tlsConfig, nil
+}
+
+// certPool returns the system's trusted certificates, plus those in caFile
+func certPool(caFile string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read ca file")
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in ca file %v", caFile)
+	}
+	return roots, nil
+}
+
+// verifyPinnedSPKI returns a check that one of the certificates the server's
+// certificate was verified by has one of the pinned public keys. This is on top
+// of the usual verification, so a pin can be for the server's own key, or an
+// intermediate or root CA's.
+func verifyPinnedSPKI(pins []string) func(tls.ConnectionState) error {
+	pinned := map[string]bool{}
+	for _, pin := range pins {
+		pinned[pin] = true
+	}
+
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				if pinned[spkiHash(cert)] {
+					return nil
+				}
+			}
+		}
+		return errors.Errorf("no certificate presented by %v matches a pinned public key", state.ServerName)
+	}
+}
+
+// spkiHash returns the base64 encoded SHA256 hash of the certificate's
+// SubjectPublicKeyInfo
+func spkiHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// ValidSPKIPin checks that the pin is a base64 encoded SHA256 hash
+func ValidSPKIPin(pin string) bool {
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	return err == nil && len(hash) == sha256.Size
+}
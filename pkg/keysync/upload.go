@@ -0,0 +1,80 @@
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// githubKeyUpload is the body of a request to add a key to an account or a
+// repository
+type githubKeyUpload struct {
+	Title    string `json:"title"`
+	Key      string `json:"key"`
+	ReadOnly *bool  `json:"read_only,omitempty"`
+}
+
+// UploadKey adds the public key to the github account the source
+// authenticates as, or if repo is given as owner/name, as a deploy key of the
+// repository, which is read only unless writable is set. The key's comment is
+// dropped, as github keeps the title instead. If the key is already there, it's
+// left as it is and false is returned.
+func (c *GithubSource) UploadKey(ctx context.Context, key, title, repo string, writable bool) (bool, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return false, errors.Wrap(err, "invalid public key")
+	}
+	if _, ok := parsed.(*ssh.Certificate); ok {
+		return false, errors.New("certificates can't be added to github")
+	}
+	key = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(parsed)))
+
+	u := c.apiURL() + "/user/keys"
+	upload := githubKeyUpload{Title: title, Key: key}
+	if repo != "" {
+		if strings.Count(repo, "/") != 1 {
+			return false, errors.Errorf("repository %q should be given as owner/name", repo)
+		}
+		u = fmt.Sprintf("%v/repos/%v/keys", c.apiURL(), repo)
+		readOnly := !writable
+		upload.ReadOnly = &readOnly
+	}
+
+	existing := []PublicKey{}
+	err = c.getAllPages(ctx, u+"?per_page=100", func(resp *http.Response) error {
+		page := []PublicKey{}
+		err := decodeJSONResponse(resp, &page)
+		existing = append(existing, page...)
+		return err
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "could not list existing keys")
+	}
+	for _, existingKey := range existing {
+		if NormalizeKey(existingKey.Key) == key {
+			slog.Info("key already added", "fingerprint", fingerprint(key), "id", existingKey.ID, "title", existingKey.Title)
+			return false, nil
+		}
+	}
+
+	token, err := c.token(ctx)
+	if err != nil {
+		return false, err
+	}
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	err = postJSON(ctx, c.Client, http.MethodPost, u, header, upload)
+	if err != nil {
+		return false, errors.Wrap(err, "could not add key")
+	}
+	slog.Info("added key", "fingerprint", fingerprint(key), "title", title, "repo", repo)
+	return true, nil
+}
@@ -0,0 +1,163 @@
+package keysync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// URLSource fetches keys from arbitrary https urls serving a document in
+// authorized_keys format. The "username" for this source is the url itself.
+//
+// A url may carry the expected sha256 of the document in its fragment, as in
+// https://keys.example.com/team.keys#sha256=<hex>. If SigningKey is set, a
+// base64 encoded ed25519 signature of the document is fetched from the url
+// with .sig appended, and must be valid.
+type URLSource struct {
+	SigningKey ed25519.PublicKey
+	// Client fetches the urls, defaulting to http.DefaultClient
+	Client *http.Client
+}
+
+func (c *URLSource) GetKeys(ctx context.Context, rawURL string) ([]PublicKey, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse url")
+	}
+	if u.Scheme != "https" {
+		return nil, errors.Errorf("refusing to fetch keys from non https url %v", rawURL)
+	}
+
+	var checksum string
+	if u.Fragment != "" {
+		if !strings.HasPrefix(u.Fragment, "sha256=") {
+			return nil, errors.Errorf("unsupported url fragment %q, expected sha256=<hex>", u.Fragment)
+		}
+		checksum = strings.ToLower(strings.TrimPrefix(u.Fragment, "sha256="))
+		u.Fragment = ""
+	}
+
+	document, err := getURL(ctx, clientOrDefault(c.Client), u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum != "" {
+		sum := sha256.Sum256(document)
+		if hex.EncodeToString(sum[:]) != checksum {
+			return nil, errors.Errorf("sha256 of %v does not match %v", u, checksum)
+		}
+	}
+
+	if c.SigningKey != nil {
+		encodedSignature, err := getURL(ctx, clientOrDefault(c.Client), u.String()+".sig")
+		if err != nil {
+			return nil, errors.Wrap(err, "could not fetch signature")
+		}
+		signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encodedSignature)))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode signature")
+		}
+		if !ed25519.Verify(c.SigningKey, document, signature) {
+			return nil, errors.Errorf("signature of %v is not valid", u)
+		}
+	}
+
+	return parseKeysDocument(document), nil
+}
+
+func getURL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not construct request")
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not make request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &statusError{resp.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+	return body, nil
+}
+
+// parseKeysDocument extracts the keys from a document in authorized_keys
+// format, along with their options, skipping blank lines and comments.
+// Certificates and certificate authorities are skipped too, as they aren't
+// keys to log in with.
+func parseKeysDocument(document []byte) []PublicKey {
+	publicKeys := []PublicKey{}
+	scanner := bufio.NewScanner(bytes.NewReader(document))
+	for i := 1; scanner.Scan(); i++ {
+		parsed, ok := parseAuthorizedKeysLine(scanner.Text())
+		if !ok || parsed.forCertificates() {
+			continue
+		}
+		// a key without the options restricting it could be used for more
+		// than it was meant to, so is skipped rather than stripped
+		if !ValidKeyOptions(parsed.options) {
+			slog.Error("invalid options in keys document, skipping key", "line", i, "fingerprint", fingerprint(parsed.key()))
+			continue
+		}
+		publicKeys = append(publicKeys, PublicKey{Key: parsed.key(), Options: parsed.options})
+	}
+	return publicKeys
+}
+
+// ParseEd25519PublicKey parses an ed25519 public key in authorized_keys
+// format, e.g. "ssh-ed25519 AAAAC3Nz... comment"
+func ParseEd25519PublicKey(key string) (ed25519.PublicKey, error) {
+	fields := strings.Fields(key)
+	if len(fields) < 2 || fields[0] != "ssh-ed25519" {
+		return nil, errors.New("expected an ssh-ed25519 public key")
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode public key")
+	}
+
+	// the blob is two length prefixed strings: the key type, then the key
+	keyType, rest, ok := readSSHString(blob)
+	if !ok || string(keyType) != "ssh-ed25519" {
+		return nil, errors.New("malformed ssh-ed25519 public key")
+	}
+	rawKey, _, ok := readSSHString(rest)
+	if !ok || len(rawKey) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed ssh-ed25519 public key")
+	}
+	return ed25519.PublicKey(rawKey), nil
+}
+
+// readSSHString reads a length prefixed string in the ssh wire format,
+// returning it and the remaining data
+func readSSHString(data []byte) ([]byte, []byte, bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(length) {
+		return nil, nil, false
+	}
+	return data[4 : 4+length], data[4+length:], true
+}
@@ -0,0 +1,51 @@
+package keysync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeysDocument(t *testing.T) {
+	document := "# automation\n" +
+		"ssh-ed25519 " + testEd25519Blob + " alice@laptop\r\n" +
+		`command="backup --only /srv",restrict sk-ssh-ed25519@openssh.com ` + testSKBlob + " backup\n" +
+		"\n" +
+		`cert-authority,principals="alice" ssh-ed25519 ` + testEd25519Blob + "\n" +
+		"ssh-ed25519-cert-v01@openssh.com " + testEd25519Blob + "\n" +
+		`command="unterminated ssh-ed25519 ` + testEd25519Blob + "\n" +
+		"from=\"10.0.0.0/8\" ssh-ed25519 " + testEd25519Blob
+	want := []PublicKey{
+		{Key: "ssh-ed25519 " + testEd25519Blob},
+		{Key: "sk-ssh-ed25519@openssh.com " + testSKBlob, Options: `command="backup --only /srv",restrict`},
+		{Key: "ssh-ed25519 " + testEd25519Blob, Options: `from="10.0.0.0/8"`},
+	}
+
+	if got := parseKeysDocument([]byte(document)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeysDocument() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLineKeepsOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		syncer  *Syncer
+		options string
+		want    string
+	}{
+		{"no options", &Syncer{}, "", "ssh-ed25519 " + testEd25519Blob},
+		{"key options", &Syncer{}, "restrict", "restrict ssh-ed25519 " + testEd25519Blob},
+		{"configured options", &Syncer{KeyOptions: "no-pty"}, "", "no-pty ssh-ed25519 " + testEd25519Blob},
+		{"both", &Syncer{KeyOptions: "no-pty"}, `command="backup"`, `command="backup",no-pty ssh-ed25519 ` + testEd25519Blob},
+		{"user options", &Syncer{KeyOptions: "no-pty", UserKeyOptions: map[string]string{"alice": `from="10.0.0.0/8"`}}, "restrict", `restrict,from="10.0.0.0/8" ssh-ed25519 ` + testEd25519Blob},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := syncedKey{PublicKey: PublicKey{Key: "ssh-ed25519 " + testEd25519Blob, Options: test.options}, username: "alice", syncedOn: "2024-05-01"}
+			want := test.want + " " + test.syncer.comment(key)
+			if got := test.syncer.line(key); got != want {
+				t.Errorf("line() = %q, want %q", got, want)
+			}
+		})
+	}
+}
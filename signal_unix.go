@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpStateSignals are the signals that log the daemon's state
+var dumpStateSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"os"
+)
+
+// dumpStateSignals is empty on windows, which has no SIGUSR1
+var dumpStateSignals = []os.Signal{}
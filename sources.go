@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+)
+
+const (
+	sourceGithub     = "github"
+	sourceGitlab     = "gitlab"
+	sourceGitea      = "gitea"
+	sourceURL        = "url"
+	sourceKV         = "kv"
+	execSourcePrefix = "exec:"
+)
+
+// sourceConfig holds the configuration of every supported key source
+type sourceConfig struct {
+	github keysync.GithubSource
+	gitlab keysync.GitlabSource
+	gitea  keysync.GiteaSource
+	url    keysync.URLSource
+	kv     keysync.KVSource
+	local  keysync.LocalSource
+	// mirrors are base urls to fetch keys from in turn before the chosen
+	// source's own
+	mirrors []string
+}
+
+// keySource returns the named key source. Local files and stdin can be used
+// whichever source is chosen, as can the other sources, by qualifying
+// usernames with their names, e.g. gitlab:alice.
+func (c *sourceConfig) keySource(name string) (keysync.Source, error) {
+	var source keysync.Source
+	switch {
+	case c.builtin(name) != nil:
+		source = c.builtin(name)
+		if len(c.mirrors) != 0 {
+			source = c.withMirrors(name)
+		}
+	case strings.HasPrefix(name, execSourcePrefix):
+		command := strings.Fields(strings.TrimPrefix(name, execSourcePrefix))
+		if len(command) == 0 {
+			return nil, errors.New("exec source requires a command, e.g. exec:/usr/local/bin/keys-for")
+		}
+		source = &keysync.ExecSource{Command: command}
+	default:
+		return nil, errors.Errorf("unknown key source %q", name)
+	}
+
+	others := map[string]keysync.Source{}
+	for _, other := range otherSources(name) {
+		others[other] = c.builtin(other)
+	}
+	source = &keysync.MultiSource{Default: source, Sources: others}
+	return keysync.WithLocalSources(&c.local, source), nil
+}
+
+// builtin returns the named source, unless it needs configuring with more
+// than a name, like exec sources
+func (c *sourceConfig) builtin(name string) keysync.Source {
+	switch name {
+	case sourceGithub:
+		return &c.github
+	case sourceGitlab:
+		return &c.gitlab
+	case sourceGitea:
+		return &c.gitea
+	case sourceURL:
+		return &c.url
+	case sourceKV:
+		return &c.kv
+	}
+	return nil
+}
+
+// withMirrors returns the named source, fetching keys from each of the
+// mirrors in turn before falling back to the source itself
+func (c *sourceConfig) withMirrors(name string) keysync.Source {
+	sources := []keysync.Source{}
+	for _, mirror := range c.mirrors {
+		switch name {
+		case sourceGithub:
+			sources = append(sources, &keysync.GithubSource{
+				BaseURL: mirror,
+				Token:   c.github.Token,
+				UseAPI:  c.github.UseAPI,
+				App:     c.github.App,
+				Client:  c.github.Client,
+			})
+		case sourceGitlab:
+			gitlab := c.gitlab
+			gitlab.BaseURL = mirror
+			sources = append(sources, &gitlab)
+		case sourceGitea:
+			gitea := c.gitea
+			gitea.BaseURL = mirror
+			sources = append(sources, &gitea)
+		}
+	}
+	return &keysync.FailoverSource{Sources: append(sources, c.builtin(name)), Names: c.mirrors}
+}
+
+// orgMembers returns a function listing the members of -org, or -team within
+// it, if they're set
+func orgMembers(cfg *config, sources *sourceConfig) func(ctx context.Context) ([]string, error) {
+	if cfg.Github.Team != "" {
+		return func(ctx context.Context) ([]string, error) {
+			return sources.github.TeamMembers(ctx, cfg.Github.Org, cfg.Github.Team)
+		}
+	} else if cfg.Github.Org != "" {
+		return func(ctx context.Context) ([]string, error) {
+			return sources.github.OrgMembers(ctx, cfg.Github.Org)
+		}
+	}
+	return nil
+}
+
+// otherSources returns the names of the sources, other than the named one,
+// that usernames can be qualified with to fetch them from that source
+func otherSources(name string) []string {
+	others := []string{}
+	for _, other := range []string{sourceGithub, sourceGitlab, sourceGitea, sourceURL, sourceKV} {
+		if other != name {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// sourceName returns the name recorded in the comments of keys synced from
+// the named source
+func sourceName(name string) string {
+	if strings.HasPrefix(name, execSourcePrefix) {
+		return "exec"
+	}
+	return name
+}
+
+// githubApp returns the GitHub App to authenticate to github as
+func githubApp(cfg *config) (*keysync.GithubApp, error) {
+	encoded, err := ioutil.ReadFile(cfg.Github.AppKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read private key")
+	}
+	key, err := keysync.ParseGithubAppKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return &keysync.GithubApp{
+		AppID:          cfg.Github.AppID,
+		PrivateKey:     key,
+		InstallationID: cfg.Github.InstallationID,
+		Org:            cfg.Github.Org,
+	}, nil
+}
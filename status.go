@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+)
+
+// keyStatus is a synced key, as listed by the status command
+type keyStatus struct {
+	File        string `json:"file"`
+	User        string `json:"user"`
+	Source      string `json:"source"`
+	Fingerprint string `json:"fingerprint"`
+	Key         string `json:"key"`
+	// SyncedOn is the date the key was first synced
+	SyncedOn string `json:"synced_on"`
+	// LastConfirmed is when the key was last fetched from the source, if the
+	// cache records it
+	LastConfirmed *time.Time `json:"last_confirmed"`
+}
+
+// keyStatuses lists the synced keys in each syncer's target, looking up when
+// they were last confirmed in the cache in cacheDir, if set
+func keyStatuses(syncers map[string]*keysync.Syncer, cacheDir string) ([]keyStatus, error) {
+	names := []string{}
+	for name := range syncers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cache := &keysync.CachedSource{Dir: cacheDir}
+	statuses := []keyStatus{}
+	for _, name := range names {
+		keys, err := syncers[name].ManagedKeys()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not list keys in %v", name)
+		}
+		for _, key := range keys {
+			status := keyStatus{
+				File:        name,
+				User:        key.Username,
+				Source:      key.Source,
+				Fingerprint: key.Fingerprint,
+				Key:         key.Key,
+				SyncedOn:    key.SyncedOn,
+			}
+			if cacheDir != "" {
+				if confirmed := cache.LastConfirmed(key.Username, key.Key); !confirmed.IsZero() {
+					status.LastConfirmed = &confirmed
+				}
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// writeStatus writes the synced keys as a table, or as a JSON array
+func writeStatus(w io.Writer, statuses []keyStatus, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.Wrap(encoder.Encode(statuses), "could not write status")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tUSER\tSYNCED ON\tLAST CONFIRMED\tFINGERPRINT")
+	for _, status := range statuses {
+		confirmed := "unknown"
+		if status.LastConfirmed != nil {
+			confirmed = status.LastConfirmed.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", status.File, status.User, status.SyncedOn, confirmed, status.Fingerprint)
+	}
+	return errors.Wrap(tw.Flush(), "could not write status")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+)
+
+// notifySystemd sends the state, e.g. READY=1, to systemd's notify socket. It
+// does nothing unless running as a systemd service with Type=notify or
+// WatchdogSec set.
+func notifySystemd(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// a leading @ denotes an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err == nil {
+		_, err = conn.Write([]byte(state))
+		conn.Close()
+	}
+	if err != nil {
+		slog.Warn("could not notify systemd", "error", err)
+	}
+}
+
+// systemdWatchdogInterval returns how often systemd expects to be pinged, or
+// zero if the watchdog isn't enabled for this process
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// systemdStatus summarises the last sync of every syncer for systemctl status
+func systemdStatus(syncers map[string]*keysync.Syncer) string {
+	failed, managedKeys := 0, 0
+	var lastError error
+	for _, syncer := range syncers {
+		status := syncer.Status()
+		if status.LastError != nil {
+			failed++
+			lastError = status.LastError
+		}
+		managedKeys += status.ManagedKeys
+	}
+
+	at := time.Now().Format(time.RFC3339)
+	switch {
+	case failed == 0:
+		return fmt.Sprintf("last synced %v, %v keys managed", at, managedKeys)
+	case len(syncers) == 1:
+		return fmt.Sprintf("last sync at %v failed: %v", at, lastError)
+	default:
+		return fmt.Sprintf("last sync at %v failed for %v of %v files, %v keys managed", at, failed, len(syncers), managedKeys)
+	}
+}
+
+// syncClock tracks when the sync in flight, if any, started, so the watchdog
+// can stop being pinged once a sync hangs
+type syncClock struct {
+	mu      sync.Mutex
+	started time.Time
+}
+
+func (c *syncClock) start() {
+	c.mu.Lock()
+	c.started = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *syncClock) stop() {
+	c.mu.Lock()
+	c.started = time.Time{}
+	c.mu.Unlock()
+}
+
+// running returns how long the sync in flight has been running, or zero
+func (c *syncClock) running() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started.IsZero() {
+		return 0
+	}
+	return time.Since(c.started)
+}
+
+// systemdCredential returns the credential passed to the service with
+// LoadCredential= or SetCredential=, or nothing if it wasn't
+func systemdCredential(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", nil
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "could not read credential %v", name)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
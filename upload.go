@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+	"github.com/pkg/errors"
+)
+
+// uploadCommand, given as the first argument, adds a local public key to
+// github, the opposite of syncing
+const uploadCommand = "upload"
+
+// uploadTimeout bounds how long uploading a key can take
+const uploadTimeout = time.Minute
+
+// uploadOptions are the flags the upload command takes
+type uploadOptions struct {
+	baseURL   string
+	tokenFile string
+	repo      string
+	title     string
+	writable  bool
+}
+
+// runUpload adds the public key in the file given in args to github, and
+// returns the exit code
+func runUpload(args []string) int {
+	fs, options := uploadFlags()
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	err = upload(options, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync-github-ssh-keys: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// uploadFlags returns the flags the upload command takes
+func uploadFlags() (*flag.FlagSet, *uploadOptions) {
+	options := &uploadOptions{baseURL: keysync.DefaultGithubBaseURL}
+	options.title, _ = os.Hostname()
+
+	fs := flag.NewFlagSet(uploadCommand, flag.ContinueOnError)
+	fs.StringVar(&options.baseURL, "github-base-url", options.baseURL, "base url of the github instance to add the key to, e.g. https://ghe.example.com for GitHub Enterprise")
+	fs.StringVar(&options.tokenFile, "github-token-file", options.tokenFile, "file to read the github token from rather than GITHUB_TOKEN, or fd:<n> to read it from an inherited file descriptor")
+	fs.StringVar(&options.repo, "repo", options.repo, "repository to add the key to as a deploy key, as owner/name, rather than to the token's account")
+	fs.StringVar(&options.title, "title", options.title, "title to give the key on github")
+	fs.BoolVar(&options.writable, "read-write", options.writable, "let the deploy key push to -repo, rather than only read from it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sync-github-ssh-keys %v [flags] <public key file>|-\n\nflags:\n", uploadCommand)
+		fs.PrintDefaults()
+	}
+	return fs, options
+}
+
+// upload adds the public key in the file at path, or stdin if it's -, to
+// github
+func upload(options *uploadOptions, path string) error {
+	var key []byte
+	var err error
+	if path == "-" {
+		key, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		key, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read public key")
+	}
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if options.tokenFile != "" {
+		token, err = readSecretFile(options.tokenFile)
+	} else if token == "" {
+		token, err = systemdCredential("github_token")
+	}
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("a github token is required, in GITHUB_TOKEN or -github-token-file")
+	}
+	if options.title == "" {
+		return errors.New("-title is required")
+	}
+
+	client, err := keysync.NewHTTPClient(keysync.HTTPConfig{
+		ConnectTimeout: 10 * time.Second,
+		Timeout:        30 * time.Second,
+		UserAgent:      userAgent(),
+	})
+	if err != nil {
+		return err
+	}
+	source := &keysync.GithubSource{BaseURL: options.baseURL, Token: token, Client: client}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	_, err = source.UploadKey(ctx, string(key), options.title, options.repo, options.writable)
+	return err
+}
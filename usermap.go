@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// userMapping maps a local user to the usernames whose keys they should have
+type userMapping struct {
+	localUser string
+	usernames []string
+}
+
+// readUserMap reads a user map file, with one local user per line followed by
+// a colon and the usernames to sync keys for, e.g.
+//
+//	# local user: github usernames
+//	deploy: alice bob
+//	alice: alice
+func readUserMap(path string) ([]userMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open user map")
+	}
+	defer f.Close()
+
+	mappings := []userMapping{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		localUser := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || localUser == "" {
+			return nil, errors.Errorf("line %v in user map malformed", i)
+		}
+		if seen[localUser] {
+			return nil, errors.Errorf("line %v in user map duplicates local user %v", i, localUser)
+		}
+		seen[localUser] = true
+
+		mappings = append(mappings, userMapping{
+			localUser: localUser,
+			usernames: strings.Fields(parts[1]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read user map")
+	}
+
+	return mappings, nil
+}
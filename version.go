@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/lclarkmichalek/sync-github-ssh-keys/pkg/keysync"
+)
+
+// set when building releases with e.g.
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.date=2024-05-01T12:00:00Z"
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// versionInfo returns the version, commit and build date, falling back to
+// what the go toolchain recorded in the binary for any not set with ldflags
+func versionInfo() (string, string, string) {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && c == "":
+				c = setting.Value
+			case setting.Key == "vcs.time" && d == "":
+				d = setting.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "unknown"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return v, c, d
+}
+
+// versionString describes the build, for -version
+func versionString() string {
+	v, c, d := versionInfo()
+	return fmt.Sprintf("sync-github-ssh-keys %v\ncommit: %v\nbuilt: %v\ngo: %v %v/%v",
+		v, c, d, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// userAgent identifies the build in requests to key sources
+func userAgent() string {
+	v, _, _ := versionInfo()
+	return fmt.Sprintf("%v/%v (+https://github.com/lclarkmichalek/sync-github-ssh-keys)", keysync.DefaultUserAgent, v)
+}
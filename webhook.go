@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// maxWebhookSize is the largest payload github sends
+const maxWebhookSize = 25 << 20
+
+// webhookPayload holds the fields of the webhook events that change who has
+// access
+type webhookPayload struct {
+	Action string `json:"action"`
+	// Membership is set on organization events
+	Membership struct {
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"membership"`
+	// Member and Team are set on membership events
+	Member struct {
+		Login string `json:"login"`
+	} `json:"member"`
+	Team struct {
+		Name string `json:"name"`
+	} `json:"team"`
+}
+
+// webhookHandler handles github organization webhooks, calling sync when
+// an org or team's members change. Payloads must be signed with the secret.
+// The affected user is only logged, as sync resyncs every user: the org's
+// members have to be listed again anyway to know who's left, and
+// -max-fetch-interval keeps the resync from refetching every user's keys.
+func webhookHandler(secret string, sync func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+		if err != nil {
+			http.Error(w, "could not read payload", http.StatusBadRequest)
+			return
+		}
+		if !validWebhookSignature(secret, body, r.Header.Get("X-Hub-Signature-256")) {
+			slog.Warn("rejected webhook with invalid signature", "remote_addr", r.RemoteAddr)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		event := r.Header.Get("X-GitHub-Event")
+		var payload webhookPayload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+
+		var user string
+		switch {
+		case event == "ping":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case event == "organization" && (payload.Action == "member_added" || payload.Action == "member_removed"):
+			user = payload.Membership.User.Login
+		case event == "membership" && (payload.Action == "added" || payload.Action == "removed"):
+			user = payload.Member.Login
+		case event == "team" && payload.Action == "deleted":
+			// every member of the team is affected, rather than one user,
+			// so there's no user to log
+		default:
+			slog.Debug("ignoring webhook", "event", event, "action", payload.Action)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		slog.Info("syncing after webhook", "event", event, "action", payload.Action, "user", user, "team", payload.Team.Name)
+		sync()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// validWebhookSignature checks the X-Hub-Signature-256 header github sends,
+// an HMAC of the body keyed by the webhook's secret
+func validWebhookSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}